@@ -0,0 +1,1786 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Shared helpers for talking to the Riot API."""
+
+from __future__ import absolute_import
+from __future__ import division
+from __future__ import print_function
+
+import collections
+from concurrent import futures
+import email.utils
+import os
+import random
+import re
+import threading
+import time
+from urllib import parse
+import uuid
+
+from absl import logging
+from google.protobuf import json_format
+import grpc
+from opentelemetry import trace
+import requests
+
+from hypebot.protos.riot import platform_pb2
+from riot import riot_metrics_lib
+
+# Riot HTTP status codes mapped to the closest gRPC equivalent. Anything not
+# listed here is surfaced as UNKNOWN.
+_HTTP_TO_GRPC_STATUS = {
+    requests.codes.bad_request: grpc.StatusCode.INVALID_ARGUMENT,
+    requests.codes.unauthorized: grpc.StatusCode.UNAUTHENTICATED,
+    requests.codes.forbidden: grpc.StatusCode.PERMISSION_DENIED,
+    requests.codes.not_found: grpc.StatusCode.NOT_FOUND,
+    requests.codes.too_many_requests: grpc.StatusCode.RESOURCE_EXHAUSTED,
+    requests.codes.internal_server_error: grpc.StatusCode.UNAVAILABLE,
+    requests.codes.service_unavailable: grpc.StatusCode.UNAVAILABLE,
+}
+
+# Message for 503s with an HTML body, which Riot serves during maintenance and
+# outages instead of its usual JSON errors.
+_MAINTENANCE_MESSAGE = ('Riot maintenance or outage; LoLStatusService.'
+                        'GetShardData may have details')
+
+# Response headers describing Riot's rate limits. These are forwarded to gRPC
+# clients as trailing metadata so that quota usage can be monitored per call.
+_RATE_LIMIT_HEADERS = (
+    'X-App-Rate-Limit',
+    'X-App-Rate-Limit-Count',
+    'X-Method-Rate-Limit',
+    'X-Method-Rate-Limit-Count',
+)
+
+# Response headers Riot uses to mark an endpoint as deprecated.
+_DEPRECATION_HEADERS = ('X-Riot-Deprecated', 'Deprecation')
+
+# Regional routing clusters used by newer endpoints (e.g., match-v5,
+# account-v1), keyed by the platform served by each cluster.
+_PLATFORM_TO_REGIONAL_ROUTE = {
+    'BR1': 'americas',
+    'LA1': 'americas',
+    'LA2': 'americas',
+    'NA1': 'americas',
+    'OC1': 'americas',
+    'PBE1': 'americas',
+    'EUN1': 'europe',
+    'EUW1': 'europe',
+    'RU': 'europe',
+    'TR1': 'europe',
+    'JP1': 'asia',
+    'KR': 'asia',
+}
+
+
+class Error(Exception):
+  """Base error for failed Riot calls.
+
+  Attributes:
+    code: The gRPC status code which should be returned to the caller.
+  """
+  code = grpc.StatusCode.UNKNOWN
+
+
+class InvalidRequestError(Error):
+  """The request can't be sent to Riot as specified."""
+  code = grpc.StatusCode.INVALID_ARGUMENT
+
+
+class DeadlineExceededError(Error):
+  """Riot did not respond before the request timed out."""
+  code = grpc.StatusCode.DEADLINE_EXCEEDED
+
+
+class CancelledError(Error):
+  """The gRPC call ended before Riot responded."""
+  code = grpc.StatusCode.CANCELLED
+
+
+class UnavailableError(Error):
+  """Riot couldn't be reached, e.g., DNS failed or the connection was reset."""
+  code = grpc.StatusCode.UNAVAILABLE
+
+
+class ResponseTooLargeError(Error):
+  """Riot's response was larger than we're willing to read."""
+  code = grpc.StatusCode.RESOURCE_EXHAUSTED
+
+
+class ResponseParseError(Error):
+  """Riot's response could not be decoded into the expected proto."""
+  code = grpc.StatusCode.INTERNAL
+
+
+# Values of Riot's X-Rate-Limit-Type header, which says which limit a 429 hit.
+# Application and method limits are our own quota. Service limits are Riot's
+# backend being overloaded, regardless of which application is calling.
+RATE_LIMIT_TYPE_APPLICATION = 'application'
+RATE_LIMIT_TYPE_METHOD = 'method'
+RATE_LIMIT_TYPE_SERVICE = 'service'
+
+
+class RiotAPIError(Error):
+  """A non-OK response from the Riot API.
+
+  Attributes:
+    status_code: HTTP status code returned by Riot.
+    message: Error message from Riot's response body, or a generic description
+      if the body could not be parsed.
+    url: The URL which was requested, including its query params but never an
+      API key.
+    retry_after: Seconds Riot asked us to wait before retrying, from the
+      Retry-After header. None if the header was absent.
+    method: The HTTP method of the request, e.g., "GET", or None if unknown.
+    rate_limit_type: For 429s, which limit was hit, one of the RATE_LIMIT_TYPE
+      constants, from the X-Rate-Limit-Type header. None if the header was
+      absent.
+  """
+
+  def __init__(self,
+               status_code,
+               message,
+               url=None,
+               retry_after=None,
+               method=None,
+               rate_limit_type=None):
+    url = _SanitizeUrl(url)
+    super(RiotAPIError, self).__init__(status_code, message, url)
+    self.status_code = status_code
+    self.message = message
+    self.url = url
+    self.retry_after = retry_after
+    self.method = method
+    self.rate_limit_type = rate_limit_type
+
+  @property
+  def code(self):
+    """The gRPC status code corresponding to status_code."""
+    return _HTTP_TO_GRPC_STATUS.get(self.status_code, grpc.StatusCode.UNKNOWN)
+
+  def __str__(self):
+    request = self.url
+    if self.method:
+      request = '%s %s' % (self.method, self.url)
+    status = 'http status %d' % self.status_code
+    if self.rate_limit_type:
+      status += ', %s rate limit' % self.rate_limit_type
+    return 'Failed request for: %s (%s): %s' % (request, status, self.message)
+
+  @classmethod
+  def FromResponse(cls, response, method=None, url=None):
+    """Builds a RiotAPIError from a failed requests.Response.
+
+    Riot errors look like {"status": {"message": "...", "status_code": 404}}.
+    If the body doesn't match, a generic message is used instead. HTML 503s are
+    maintenance pages, so their body isn't parsed at all.
+
+    Args:
+      response: The failed requests.Response.
+      method: The HTTP method of the request.
+      url: The URL which was requested. Defaults to the response's URL.
+
+    Returns:
+      The RiotAPIError describing the failure.
+    """
+    status_code = response.status_code
+    message = 'http status %d' % status_code
+    content_type = response.headers.get('Content-Type', '').lower()
+    if (status_code == requests.codes.service_unavailable and
+        'html' in content_type):
+      message = _MAINTENANCE_MESSAGE
+    else:
+      try:
+        status = response.json()['status']
+        message = status['message']
+        status_code = int(status.get('status_code', status_code))
+      except (ValueError, KeyError, TypeError):
+        pass
+    retry_after = None
+    try:
+      retry_after = float(response.headers['Retry-After'])
+    except (KeyError, ValueError):
+      pass
+    rate_limit_type = response.headers.get('X-Rate-Limit-Type')
+    if rate_limit_type:
+      rate_limit_type = rate_limit_type.lower()
+    return cls(status_code, message, url or response.url, retry_after, method,
+               rate_limit_type)
+
+
+def _SanitizeUrl(url):
+  """Removes any API key from url's query params, so it's safe to log."""
+  if not url:
+    return url
+  parts = parse.urlsplit(url)
+  params = parse.parse_qsl(parts.query, keep_blank_values=True)
+  query = [(name, value) for name, value in params if name.lower() != 'api_key']
+  return parse.urlunsplit(parts._replace(query=parse.urlencode(query)))
+
+
+class _TokenBucket(object):
+  """A bucket allowing limit requests every window_secs seconds."""
+
+  def __init__(self, limit, window_secs, now):
+    self.limit = limit
+    self.window_secs = window_secs
+    self.tokens = float(limit)
+    self._last_refill = now
+
+  def Refill(self, now):
+    self.tokens = self.TokensAt(now)
+    self._last_refill = now
+
+  def TokensAt(self, now):
+    elapsed = now - self._last_refill
+    return min(self.limit,
+               self.tokens + elapsed * self.limit / self.window_secs)
+
+  def SecondsUntilAvailable(self):
+    if self.tokens >= 1:
+      return 0
+    return (1 - self.tokens) * self.window_secs / self.limit
+
+
+def ParseRateLimitHeader(value):
+  """Parses a rate limit header like "20:1,100:120".
+
+  Args:
+    value: Header value, a comma separated list of limit:window_secs pairs.
+
+  Returns:
+    List of (limit, window_secs) tuples. Malformed entries are skipped.
+  """
+  windows = []
+  for part in (value or '').split(','):
+    try:
+      limit, window_secs = part.split(':')
+      limit, window_secs = int(limit), int(window_secs)
+    except ValueError:
+      continue
+    if limit > 0 and window_secs > 0:
+      windows.append((limit, window_secs))
+  return windows
+
+
+# Riot's default app rate limits for each tier of API key, as (limit,
+# window_secs) windows. Personal development keys allow 20 requests per second
+# and 100 per 2 minutes. Production keys start at 500 requests per 10 seconds
+# and 30,000 per 10 minutes, though Riot may grant an application more.
+KEY_TIER_RATE_LIMITS = {
+    'development': [(20, 1), (100, 120)],
+    'production': [(500, 10), (30000, 600)],
+}
+
+
+class RateLimiter(object):
+  """Client-side token bucket limiter honoring Riot's app rate limits.
+
+  Riot advertises the app rate limit on every response via X-App-Rate-Limit.
+  Limits are tracked per platform, since Riot enforces them per platform. Until
+  a platform's limits have been observed, requests to it are limited by the
+  default windows, if any, and otherwise not throttled.
+  """
+
+  def __init__(self,
+               block=True,
+               clock=time.monotonic,
+               sleep=time.sleep,
+               default_windows=None):
+    """Constructor.
+
+    Args:
+      block: If True, Acquire waits until a request is allowed. Otherwise it
+        fails fast by raising a RiotAPIError.
+      clock: Function returning the current time in seconds.
+      sleep: Function to sleep for the given number of seconds.
+      default_windows: List of (limit, window_secs) tuples limiting requests to
+        platforms whose limits haven't been observed yet, e.g., from
+        KEY_TIER_RATE_LIMITS. This keeps a cold start from bursting past the
+        key's limit before Riot's first response arrives.
+    """
+    self._block = block
+    self._clock = clock
+    self._sleep = sleep
+    self._default_windows = list(default_windows or [])
+    self._lock = threading.Lock()
+    # platform_id -> (windows, [_TokenBucket])
+    self._buckets = {}
+
+  def Acquire(self, platform_id):
+    """Takes a token for a request to platform_id.
+
+    Args:
+      platform_id: The platform the request is for.
+
+    Raises:
+      RiotAPIError: If not blocking and the platform has no tokens left.
+    """
+    while True:
+      with self._lock:
+        wait_secs = self._TryAcquire(platform_id)
+      if not wait_secs:
+        return
+      if not self._block:
+        raise RiotAPIError(
+            requests.codes.too_many_requests,
+            'client-side rate limit exceeded for %s' % platform_id,
+            retry_after=wait_secs)
+      self._sleep(wait_secs)
+
+  def _TryAcquire(self, platform_id):
+    """Returns 0 if a token was taken, else seconds until one is available."""
+    now = self._clock()
+    if platform_id not in self._buckets and self._default_windows:
+      self._buckets[platform_id] = (self._default_windows, [
+          _TokenBucket(limit, window_secs, now)
+          for limit, window_secs in self._default_windows
+      ])
+    _, buckets = self._buckets.get(platform_id, ((), []))
+    for bucket in buckets:
+      bucket.Refill(now)
+    wait_secs = max([b.SecondsUntilAvailable() for b in buckets] or [0])
+    if wait_secs:
+      return wait_secs
+    for bucket in buckets:
+      bucket.tokens -= 1
+    return 0
+
+  def Update(self, platform_id, header_value):
+    """Updates the limits for platform_id from an X-App-Rate-Limit header."""
+    windows = ParseRateLimitHeader(header_value)
+    if not windows:
+      return
+    with self._lock:
+      current_windows, _ = self._buckets.get(platform_id, ((), []))
+      if windows == current_windows:
+        return
+      now = self._clock()
+      buckets = []
+      for limit, window_secs in windows:
+        bucket = _TokenBucket(limit, window_secs, now)
+        # The request which returned this header already used a token.
+        bucket.tokens -= 1
+        buckets.append(bucket)
+      self._buckets[platform_id] = (windows, buckets)
+
+  def State(self):
+    """Returns the limits and remaining tokens of every platform.
+
+    Tokens are neither taken nor refilled, so this is safe for debugging.
+
+    Returns:
+      Dict from platform_id to a list with a dict of limit, window_secs and
+      tokens for each of its rate limit windows.
+    """
+    state = {}
+    with self._lock:
+      now = self._clock()
+      for platform_id, (_, buckets) in self._buckets.items():
+        state[platform_id] = [{
+            'limit': bucket.limit,
+            'window_secs': bucket.window_secs,
+            'tokens': bucket.TokensAt(now),
+        } for bucket in buckets]
+    return state
+
+
+# Limiter shared by all calls to Riot. Configured by the server at startup.
+_rate_limiter = None
+
+
+def SetRateLimiter(rate_limiter):
+  """Sets the RateLimiter used for all Riot calls. None disables limiting."""
+  global _rate_limiter
+  _rate_limiter = rate_limiter
+
+
+def GetRateLimitState():
+  """Returns the RateLimiter's State, or {} if limiting is disabled."""
+  rate_limiter = _rate_limiter
+  if not rate_limiter:
+    return {}
+  return rate_limiter.State()
+
+
+# Spans are no-ops unless the server configures a tracer provider.
+_tracer = trace.get_tracer(__name__)
+
+
+class ApiKeyPool(object):
+  """Rotates between several Riot API keys to multiply the app rate limit.
+
+  Keys are handed out round-robin per platform, since Riot enforces limits per
+  platform. A key which gets rate limited is skipped for that platform until
+  its cool down ends, unless every key is cooling down.
+  """
+
+  def __init__(self, keys, cooldown_secs=10, clock=time.monotonic):
+    """Constructor.
+
+    Args:
+      keys: Riot API keys to rotate between.
+      cooldown_secs: How long to avoid a rate limited key when Riot doesn't
+        specify Retry-After.
+      clock: Function returning the current time in seconds.
+    """
+    if not keys:
+      raise ValueError('ApiKeyPool requires at least one key.')
+    self._keys = list(keys)
+    self._cooldown_secs = cooldown_secs
+    self._clock = clock
+    self._lock = threading.Lock()
+    # platform_id -> index of the next key to try.
+    self._next_index = {}
+    # (platform_id, key index) -> time the key may be used again.
+    self._cooldown_until = {}
+
+  @property
+  def keys(self):
+    return tuple(self._keys)
+
+  def Get(self, platform_id):
+    """Returns the (index, key) to use for the next request to platform_id."""
+    with self._lock:
+      now = self._clock()
+      start = self._next_index.get(platform_id, 0)
+      indices = [(start + i) % len(self._keys) for i in range(len(self._keys))]
+      ready = [
+          i for i in indices
+          if self._cooldown_until.get((platform_id, i), 0) <= now
+      ]
+      if ready:
+        index = ready[0]
+      else:
+        index = min(indices, key=lambda i: self._cooldown_until[platform_id, i])
+      self._next_index[platform_id] = (index + 1) % len(self._keys)
+      return index, self._keys[index]
+
+  def ReportRateLimited(self, platform_id, index, retry_after=None):
+    """Cools down the key at index for platform_id after a 429."""
+    if retry_after is None:
+      retry_after = self._cooldown_secs
+    with self._lock:
+      self._cooldown_until[platform_id, index] = self._clock() + retry_after
+
+
+# Keys used for calls which don't specify an api-key in their metadata.
+# Configured by the server at startup.
+_api_key_pool = None
+
+
+def SetApiKeyPool(api_key_pool):
+  """Sets the ApiKeyPool used by calls without an api-key, or None."""
+  global _api_key_pool
+  _api_key_pool = api_key_pool
+
+
+# Only static data is safe to cache, everything else changes from minute to
+# minute.
+_CACHEABLE_PATH_PREFIX = '/lol/static-data/'
+
+_MAX_AGE_RE = re.compile(r'max-age=(\d+)')
+
+
+class ResponseCache(object):
+  """In-memory cache of successful static data responses, keyed by full URL.
+
+  Entries live for as long as the response's Cache-Control max-age or Expires
+  header allows, falling back to default_ttl_secs when neither is present.
+  Responses marked no-store or no-cache are never cached.
+  """
+
+  def __init__(self, default_ttl_secs, clock=time.time):
+    """Constructor.
+
+    Args:
+      default_ttl_secs: How long to keep responses without caching headers.
+      clock: Function returning the current wall time in seconds. Wall time is
+        needed to interpret Expires headers.
+    """
+    self._default_ttl_secs = default_ttl_secs
+    self._clock = clock
+    self._lock = threading.Lock()
+    # url -> (expiration time, requests.Response)
+    self._entries = {}
+
+  def IsCacheable(self, url):
+    return parse.urlparse(url).path.startswith(_CACHEABLE_PATH_PREFIX)
+
+  def Get(self, url):
+    """Returns the cached response for url, or None if missing or expired."""
+    with self._lock:
+      expiration, response = self._entries.get(url, (0, None))
+      if response and expiration <= self._clock():
+        del self._entries[url]
+        return None
+      return response
+
+  def Put(self, url, response):
+    """Caches response for url if the URL and response headers allow it."""
+    if not self.IsCacheable(url):
+      return
+    ttl_secs = self._GetTtlSecs(response)
+    if ttl_secs <= 0:
+      return
+    with self._lock:
+      self._entries[url] = (self._clock() + ttl_secs, response)
+
+  def _GetTtlSecs(self, response):
+    cache_control = response.headers.get('Cache-Control', '').lower()
+    if 'no-store' in cache_control or 'no-cache' in cache_control:
+      return 0
+    match = _MAX_AGE_RE.search(cache_control)
+    if match:
+      return int(match.group(1))
+    expires = response.headers.get('Expires')
+    if expires:
+      try:
+        return email.utils.parsedate_to_datetime(
+            expires).timestamp() - self._clock()
+      except (TypeError, ValueError):
+        # Per RFC 7234, an invalid Expires means already expired.
+        return 0
+    return self._default_ttl_secs
+
+
+# Cache shared by all calls to Riot. Configured by the server at startup.
+_response_cache = None
+
+
+def SetResponseCache(response_cache):
+  """Sets the ResponseCache used for all Riot calls. None disables caching."""
+  global _response_cache
+  _response_cache = response_cache
+
+
+class ETagStore(object):
+  """Remembers the ETag and body of previous responses, keyed by full URL.
+
+  When a store is configured, requests for a URL with a known ETag are sent
+  with If-None-Match, and a 304 response is served from the stored body.
+  Implementations must be thread-safe.
+  """
+
+  def Get(self, url):
+    """Returns an (etag, body) tuple for url, or None if unknown."""
+    raise NotImplementedError()
+
+  def Put(self, url, etag, body):
+    """Stores the ETag and raw body of a successful response for url."""
+    raise NotImplementedError()
+
+
+class InMemoryETagStore(ETagStore):
+  """ETagStore holding the most recently stored max_entries URLs."""
+
+  def __init__(self, max_entries=1000):
+    self._max_entries = max_entries
+    self._lock = threading.Lock()
+    self._entries = collections.OrderedDict()
+
+  def Get(self, url):
+    with self._lock:
+      return self._entries.get(url)
+
+  def Put(self, url, etag, body):
+    with self._lock:
+      self._entries.pop(url, None)
+      self._entries[url] = (etag, body)
+      while len(self._entries) > self._max_entries:
+        self._entries.popitem(last=False)
+
+
+# ETags shared by all calls to Riot. Configured by the server at startup.
+_etag_store = None
+
+
+def SetETagStore(etag_store):
+  """Sets the ETagStore used for all Riot calls. None disables ETags."""
+  global _etag_store
+  _etag_store = etag_store
+
+
+def _DefaultBaseUrl(route):
+  return 'https://%s.api.riotgames.com' % route
+
+
+# Maps a routing value to the base URL of the Riot API. Tests override this to
+# point at a local server.
+_base_url_fn = _DefaultBaseUrl
+
+
+def SetBaseUrlFn(base_url_fn):
+  """Sets the function mapping a routing value to the Riot API base URL.
+
+  Args:
+    base_url_fn: Function taking a platform ID or regional route and returning
+      a base URL, e.g., "http://127.0.0.1:8080". None restores the default of
+      https://<route>.api.riotgames.com.
+  """
+  global _base_url_fn
+  _base_url_fn = base_url_fn or _DefaultBaseUrl
+
+
+# Identifies the application to Riot, as Riot recommends. Configured by the
+# server at startup. None sends requests' default User-Agent.
+_user_agent = None
+
+
+def SetUserAgent(user_agent):
+  """Sets the User-Agent header sent with all Riot requests, or None."""
+  global _user_agent
+  _user_agent = user_agent
+
+
+def NormalizeSummonerName(summoner_name):
+  """Returns the form of summoner_name which Riot uses to compare names.
+
+  Riot ignores case and whitespace in summoner names, so e.g. "Hide on bush" and
+  "hideonbush" are the same summoner. Normalize names before using them as
+  cache keys so each summoner has a single entry.
+  """
+  return ''.join(summoner_name.split()).lower()
+
+
+# Metadata key of the ID correlating a gRPC call with its logs and the requests
+# it makes to Riot.
+REQUEST_ID_METADATA_KEY = 'x-request-id'
+
+# Client supplied request IDs are sent to Riot, so they must be valid headers.
+_REQUEST_ID_RE = re.compile(r'^[\w.:-]{1,128}$')
+
+_local = threading.local()
+
+
+def NewRequestId(request_id=None):
+  """Returns request_id if it's a usable request ID, else a new random one."""
+  if request_id and _REQUEST_ID_RE.match(request_id):
+    return request_id
+  return uuid.uuid4().hex
+
+
+def SetRequestId(request_id):
+  """Sends request_id to Riot with requests from this thread. None clears it."""
+  _local.request_id = request_id
+
+
+def GetRequestId():
+  """Returns the request ID of this thread's call, or None."""
+  return getattr(_local, 'request_id', None)
+
+
+def ConvertMetadataToDict(metadata):
+  """Converts gRPC invocation metadata into a dict."""
+  metadata_dict = {}
+  for key, value in metadata:
+    metadata_dict[key] = value
+  return metadata_dict
+
+
+class BackgroundContext(object):
+  """Stands in for a gRPC context when the services are used as a library.
+
+  Use WithPlatformId and WithApiKey to choose how calls are sent.
+  """
+
+  def invocation_metadata(self):
+    return ()
+
+  def is_active(self):
+    return True
+
+  def time_remaining(self):
+    return None
+
+  def add_callback(self, unused_callback):
+    return True
+
+  def abort(self, code, details):
+    error = Error(details)
+    error.code = code
+    raise error
+
+
+class _ValueContext(object):
+  """Wraps a context, attaching a value for the lib to read.
+
+  All other attributes are forwarded to the wrapped context, so it can be used
+  wherever the wrapped context could.
+  """
+
+  def __init__(self, parent, key, value):
+    self._parent = parent
+    self._key = key
+    self._value = value
+
+  def __getattr__(self, name):
+    return getattr(self._parent, name)
+
+
+def _GetContextValue(context, key):
+  """Returns the value attached to context for key, or None."""
+  while isinstance(context, _ValueContext):
+    if context._key == key:  # pylint: disable=protected-access
+      return context._value  # pylint: disable=protected-access
+    context = context._parent  # pylint: disable=protected-access
+  return None
+
+
+def WithPlatformId(context, platform_id):
+  """Returns a context whose calls are sent to platform_id.
+
+  A platform-id in the call's metadata takes precedence, so this only applies
+  when the caller didn't specify one, e.g., when using the services directly
+  with a BackgroundContext.
+
+  Args:
+    context: gRPC context or BackgroundContext to wrap.
+    platform_id: platform_pb2.PlatformId to call.
+
+  Returns:
+    The wrapped context.
+  """
+  return _ValueContext(context, 'platform-id',
+                       platform_pb2.PlatformId.Name(platform_id))
+
+
+def WithApiKey(context, api_key):
+  """Returns a context whose calls are authenticated with api_key.
+
+  API keys are chosen in order of precedence from:
+    1. The api-key in the call's metadata.
+    2. The key set by WithApiKey.
+    3. The server's keys, set by SetApiKeyPool.
+
+  Args:
+    context: gRPC context or BackgroundContext to wrap.
+    api_key: Riot API key.
+
+  Returns:
+    The wrapped context.
+  """
+  return _ValueContext(context, 'api-key', api_key)
+
+
+def GetCallerApiKey(context):
+  """Returns the API key chosen by the caller, or None to use the server's.
+
+  Args:
+    context: gRPC context of the current call.
+
+  Returns:
+    The api-key in the call's metadata, else the key set by WithApiKey.
+  """
+  metadata = ConvertMetadataToDict(context.invocation_metadata())
+  return metadata.get('api-key') or _GetContextValue(context, 'api-key')
+
+
+def GetFixedApiKey(context):
+  """Returns the API key every Riot request of the call is sent with, if known.
+
+  Args:
+    context: gRPC context of the current call.
+
+  Returns:
+    The caller's API key, else the server's only key. None if the server rotates
+    between several keys, since which one a request uses isn't known until it
+    is sent.
+  """
+  api_key = GetCallerApiKey(context)
+  if api_key:
+    return api_key
+  api_key_pool = _api_key_pool
+  if api_key_pool and len(api_key_pool.keys) == 1:
+    return api_key_pool.keys[0]
+  return None
+
+
+# Platform for calls which don't specify one. Configured by the server.
+_default_platform_id = 'na1'
+
+
+def SetDefaultPlatformId(platform_id):
+  """Sets the platform used when neither metadata nor context specifies one.
+
+  Args:
+    platform_id: platform_pb2.PlatformId to default to.
+
+  Raises:
+    ValueError: If platform_id is not a valid PlatformId.
+  """
+  global _default_platform_id
+  if platform_id == platform_pb2.INVALID_PLATFORM_ID:
+    raise ValueError('Default platform must be a valid PlatformId')
+  _default_platform_id = platform_pb2.PlatformId.Name(platform_id).lower()
+
+
+def GetValidatedPlatformId(context):
+  """Returns the platform ID requested in the call's metadata.
+
+  Args:
+    context: gRPC context of the current call.
+
+  Returns:
+    The lowercase platform ID, suitable for use in a hostname. The call's
+    metadata takes precedence over a platform set with WithPlatformId. Defaults
+    to the platform set by SetDefaultPlatformId, or na1, if neither specified a
+    platform.
+
+  Raises:
+    InvalidRequestError: If the platform ID is not a known PlatformId.
+  """
+  metadata = ConvertMetadataToDict(context.invocation_metadata())
+  platform_id = metadata.get('platform-id')
+  if platform_id is None:
+    platform_id = (_GetContextValue(context, 'platform-id') or
+                   _default_platform_id)
+  if (platform_id.upper() not in platform_pb2.PlatformId.keys() or
+      platform_id.upper() == 'INVALID_PLATFORM_ID'):
+    raise InvalidRequestError('Unknown platform-id: %s' % platform_id)
+  return platform_id.lower()
+
+
+def GetPlatformId(context):
+  """Like GetValidatedPlatformId, but falls back to the default for unknowns."""
+  try:
+    return GetValidatedPlatformId(context)
+  except InvalidRequestError:
+    return _default_platform_id
+
+
+def GetRegionalRoute(context):
+  """Returns the regional routing cluster for the call's platform.
+
+  Args:
+    context: gRPC context of the current call.
+
+  Returns:
+    One of americas, europe, or asia. Calls without a platform route to the
+    default platform's cluster.
+
+  Raises:
+    InvalidRequestError: If the platform ID is not a known PlatformId.
+  """
+  return _PLATFORM_TO_REGIONAL_ROUTE[GetValidatedPlatformId(context).upper()]
+
+
+def _SetRateLimitTrailers(context, response):
+  """Copies Riot's rate limit headers into the call's trailing metadata."""
+  set_trailing_metadata = getattr(context, 'set_trailing_metadata', None)
+  if not set_trailing_metadata:
+    return
+  trailers = tuple((header.lower(), response.headers[header])
+                   for header in _RATE_LIMIT_HEADERS
+                   if header in response.headers)
+  if trailers:
+    set_trailing_metadata(trailers)
+
+
+class _DeprecationWarner(object):
+  """Logs a warning when Riot marks an API as deprecated.
+
+  Warnings are keyed by API, e.g., "lol/summoner/v3", rather than full endpoint
+  so that IDs in the path don't defeat the rate limit, and are repeated at most
+  every interval_secs so they aren't lost in long running servers' logs.
+  """
+
+  def __init__(self, interval_secs=3600, clock=time.monotonic):
+    self._interval_secs = interval_secs
+    self._clock = clock
+    self._lock = threading.Lock()
+    # api -> time of the last warning.
+    self._last_warned = {}
+
+  def Check(self, endpoint, response):
+    """Warns if response carries a deprecation header, at most once per API.
+
+    Args:
+      endpoint: Riot endpoint which was called, e.g., "lol/summoner/v3/...".
+      response: requests.Response from Riot.
+
+    Returns:
+      Whether a warning was logged.
+    """
+    headers = [(header, response.headers[header])
+               for header in _DEPRECATION_HEADERS
+               if header in response.headers]
+    if not headers:
+      return False
+    api = '/'.join(endpoint.split('/')[:3])
+    now = self._clock()
+    with self._lock:
+      last_warned = self._last_warned.get(api)
+      if last_warned is not None and now - last_warned < self._interval_secs:
+        return False
+      self._last_warned[api] = now
+    fields = ' '.join('%s=%s' % (header.lower(), value)
+                      for header, value in headers)
+    logging.warning(
+        'Riot API is deprecated, migrate before it is removed: api=%s %s '
+        'sunset=%s', api, fields, response.headers.get('Sunset', 'unknown'))
+    return True
+
+
+_deprecation_warner = _DeprecationWarner()
+
+
+# Maximum seconds to wait for Riot to respond. Configured by the server at
+# startup. None waits as long as the gRPC call's deadline allows.
+_request_timeout_secs = None
+
+
+def SetRequestTimeout(timeout_secs):
+  """Sets the timeout for all Riot requests. None disables the timeout."""
+  global _request_timeout_secs
+  _request_timeout_secs = timeout_secs
+
+
+# Timeouts overriding _request_timeout_secs for requests made by specific gRPC
+# methods, by method name. Configured by the server at startup.
+_method_timeouts = {}
+
+
+def SetMethodTimeouts(method_timeouts):
+  """Overrides the request timeout for the Riot requests of some gRPC methods.
+
+  Args:
+    method_timeouts: Dict from method name to timeout in seconds, or None to
+      disable the timeout. Names are either a method's full name, e.g.,
+      "/hypebot.riot.v4.MatchService/GetMatch", or just the method, e.g.,
+      "GetMatch". A full name takes precedence.
+  """
+  global _method_timeouts
+  _method_timeouts = dict(method_timeouts)
+
+
+def _GetConfiguredTimeoutSecs():
+  """Returns the request timeout configured for the current gRPC method."""
+  rpc_method = riot_metrics_lib.GetRpcMethod()
+  if rpc_method:
+    for name in (rpc_method, rpc_method.rpartition('/')[2]):
+      if name in _method_timeouts:
+        return _method_timeouts[name]
+  return _request_timeout_secs
+
+
+def _GetTimeoutSecs(context):
+  """Returns how long a Riot request made for the current call may take.
+
+  Args:
+    context: gRPC context of the current call.
+
+  Returns:
+    The request timeout configured for the call's method, or the time left
+    before the call's deadline if that is sooner. None if neither is set.
+
+  Raises:
+    DeadlineExceededError: If the call's deadline has already passed.
+  """
+  timeout_secs = _GetConfiguredTimeoutSecs()
+  remaining_secs = context.time_remaining()
+  if remaining_secs is not None:
+    if remaining_secs <= 0:
+      raise DeadlineExceededError('deadline exceeded before calling Riot')
+    if timeout_secs is None or remaining_secs < timeout_secs:
+      timeout_secs = remaining_secs
+  return timeout_secs
+
+
+# Maximum seconds to wait for a connection to Riot, including the TLS handshake.
+# Configured by the server at startup. None uses the request timeout.
+_connect_timeout_secs = None
+
+
+def SetConnectTimeout(timeout_secs):
+  """Sets the timeout for connecting to Riot. None uses the request timeout."""
+  global _connect_timeout_secs
+  _connect_timeout_secs = timeout_secs
+
+
+def _GetRequestsTimeout(timeout_secs):
+  """Returns the timeout argument for requests given the request timeout."""
+  connect_timeout_secs = _connect_timeout_secs
+  if connect_timeout_secs is None:
+    return timeout_secs
+  if timeout_secs is not None:
+    connect_timeout_secs = min(connect_timeout_secs, timeout_secs)
+  return (connect_timeout_secs, timeout_secs)
+
+
+# Sends requests to Riot, reusing connections. Configured by the server at
+# startup. None opens a new connection for every request.
+_http_session = None
+
+# Riot is served from one host per platform and regional route.
+_MAX_RIOT_HOSTS = 16
+
+
+class _ChainedAdapter(requests.adapters.BaseAdapter):
+  """Adapter which sends requests through a chain of middleware."""
+
+  def __init__(self, base, send):
+    super(_ChainedAdapter, self).__init__()
+    self._base = base
+    self._send = send
+
+  def send(self, request, **kwargs):  # pylint: disable=arguments-differ
+    return self._send(request, **kwargs)
+
+  def close(self):
+    self._base.close()
+
+
+def ChainAdapters(base, middlewares):
+  """Returns a requests adapter which sends through middlewares, then base.
+
+  A middleware is a function which takes the send function of the next adapter
+  in the chain and returns a send function wrapping it. Send functions have the
+  signature of requests.adapters.BaseAdapter.send. For example:
+
+    def LogRequests(next_send):
+      def Send(request, **kwargs):
+        logging.info('Sending %s', request.url)
+        return next_send(request, **kwargs)
+      return Send
+
+  Middleware only sees the HTTP request, so it suits concerns such as logging
+  or fault injection. Retries, rate limiting and caching stay in CallRiot, since
+  they depend on the call's context and API key.
+
+  Args:
+    base: The requests adapter which actually sends requests.
+    middlewares: Middleware functions, outermost first, i.e., middlewares[0]
+      sees each request first and its response last.
+
+  Returns:
+    The requests adapter, to be mounted on a requests.Session.
+  """
+  send = base.send
+  for middleware in reversed(middlewares):
+    send = middleware(send)
+  return _ChainedAdapter(base, send)
+
+
+def NewHttpSession(max_connections_per_host, middlewares=()):
+  """Returns a requests.Session which pools connections to Riot.
+
+  Args:
+    max_connections_per_host: Maximum number of idle connections kept open to
+      each host. More connections are opened when needed, but are closed after
+      their request.
+    middlewares: Middleware wrapping each request, outermost first. See
+      ChainAdapters.
+
+  Returns:
+    The requests.Session, to be passed to SetHttpSession.
+  """
+  session = requests.Session()
+  adapter = requests.adapters.HTTPAdapter(
+      pool_connections=_MAX_RIOT_HOSTS, pool_maxsize=max_connections_per_host)
+  if middlewares:
+    adapter = ChainAdapters(adapter, middlewares)
+  session.mount('https://', adapter)
+  session.mount('http://', adapter)
+  return session
+
+
+def SetHttpSession(session):
+  """Sends all Riot requests with session. None disables connection reuse."""
+  global _http_session
+  _http_session = session
+
+
+# Most responses are small, but match timelines and static data can be several
+# megabytes. Configured by the server at startup.
+_max_response_bytes = 4 * 1024 * 1024
+_max_large_response_bytes = 32 * 1024 * 1024
+_LARGE_RESPONSE_PREFIXES = ('lol/match/v4/timelines/', 'lol/static-data/')
+_READ_CHUNK_BYTES = 64 * 1024
+
+
+def SetMaxResponseBytes(max_bytes, max_large_bytes):
+  """Limits the size of Riot responses which will be read.
+
+  Args:
+    max_bytes: Limit for most endpoints.
+    max_large_bytes: Limit for endpoints known to return large responses, i.e.,
+      match timelines and static data.
+  """
+  global _max_response_bytes, _max_large_response_bytes
+  _max_response_bytes = max_bytes
+  _max_large_response_bytes = max_large_bytes
+
+
+def _GetMaxResponseBytes(endpoint):
+  if endpoint.startswith(_LARGE_RESPONSE_PREFIXES):
+    return _max_large_response_bytes
+  return _max_response_bytes
+
+
+def _ReadBody(response, max_bytes):
+  """Reads a streamed response's body, refusing to read more than max_bytes.
+
+  Args:
+    response: requests.Response sent with stream=True.
+    max_bytes: Largest body to accept.
+
+  Raises:
+    ResponseTooLargeError: If the body is larger than max_bytes.
+    requests.RequestException: If reading the body failed.
+  """
+  chunks = []
+  size = 0
+  for chunk in response.iter_content(_READ_CHUNK_BYTES):
+    size += len(chunk)
+    if size > max_bytes:
+      response.close()
+      raise ResponseTooLargeError(
+          'response from %s exceeded %d bytes' % (response.url, max_bytes))
+    chunks.append(chunk)
+  response._content = b''.join(chunks)  # pylint: disable=protected-access
+
+
+def _SendWhileActive(context, method, url, timeout_secs, max_response_bytes,
+                     **kwargs):
+  """Sends a request, giving up as soon as the gRPC call ends.
+
+  requests can't be interrupted, so the request is sent from its own thread and
+  abandoned if the call is cancelled. It still ends within timeout_secs.
+
+  Args:
+    context: gRPC context of the current call.
+    method: HTTP method, e.g., "GET".
+    url: See requests.request.
+    timeout_secs: See requests.request.
+    max_response_bytes: Largest response body to read.
+    **kwargs: Passed through to requests.
+
+  Returns:
+    The requests.Response, with its body read.
+
+  Raises:
+    CancelledError: If the call ended before the response arrived.
+    ResponseTooLargeError: If the response body exceeded max_response_bytes.
+    requests.RequestException: If the request failed.
+    Exception: Anything else raised while sending, e.g., by a middleware.
+  """
+  done = threading.Event()
+  result = {}
+  send = getattr(_http_session or requests, method.lower())
+
+  def _Send():
+    try:
+      response = send(
+          url, timeout=_GetRequestsTimeout(timeout_secs), stream=True, **kwargs)
+      _ReadBody(response, max_response_bytes)
+      result['response'] = response
+    except Exception as e:  # pylint: disable=broad-except
+      # Raised on the caller's thread instead.
+      result['error'] = e
+    finally:
+      done.set()
+
+  if not context.add_callback(done.set):
+    raise CancelledError('call ended before calling Riot')
+  threading.Thread(target=_Send, daemon=True).start()
+  done.wait()
+  if 'error' in result:
+    raise result['error']
+  if 'response' not in result:
+    raise CancelledError('call ended while waiting for %s' % url)
+  return result['response']
+
+
+def _TimedRequest(context, route, method, url, max_response_bytes, **kwargs):
+  """Sends a request to Riot, recording metrics and a trace span for it.
+
+  The span is a child of the current span, which is the incoming gRPC call's
+  span when tracing is enabled in the server. Failures to send the request are
+  raised as Errors, so callers don't need to handle requests' exceptions.
+  """
+  timeout_secs = _GetTimeoutSecs(context)
+  with _tracer.start_as_current_span(
+      parse.urlparse(url).path, kind=trace.SpanKind.CLIENT) as span:
+    span.set_attribute('http.method', method)
+    span.set_attribute('http.url', url)
+    span.set_attribute('riot.route', route)
+    start_time = time.monotonic()
+    try:
+      response = _SendWhileActive(context, method, url, timeout_secs,
+                                  max_response_bytes, **kwargs)
+    except Exception as e:
+      riot_metrics_lib.RecordRequest(route, 'error',
+                                     time.monotonic() - start_time)
+      if isinstance(e, requests.Timeout):
+        raise DeadlineExceededError('timed out waiting for %s %s' %
+                                    (method, url))
+      if isinstance(e, requests.RequestException):
+        raise UnavailableError('failed to send %s %s: %s' % (method, url, e))
+      raise
+    riot_metrics_lib.RecordRequest(route, response.status_code,
+                                   time.monotonic() - start_time)
+    span.set_attribute('http.status_code', response.status_code)
+    if response.status_code >= requests.codes.bad_request:
+      span.set_status(trace.Status(trace.StatusCode.ERROR))
+    return response
+
+
+# Whether fields missing from our protos fail responses. Riot adds fields
+# without notice, so unknown fields are ignored unless the server opts in.
+_strict_parsing = False
+
+
+def SetStrictParsing(strict):
+  """Sets whether responses with fields unknown to our protos are errors.
+
+  Strict parsing is meant for tests and canaries, to detect when Riot's schema
+  has diverged from our protos. Production should stay lenient, so that Riot
+  adding a field doesn't break every call.
+
+  Args:
+    strict: If True, such responses raise a ResponseParseError.
+  """
+  global _strict_parsing
+  _strict_parsing = strict
+
+
+def _ParseBody(body, message, body_transform):
+  # Some endpoints respond with no content rather than an empty object.
+  if not body.strip():
+    return message
+  if body_transform:
+    body = body_transform(body)
+  try:
+    return json_format.Parse(
+        body, message, ignore_unknown_fields=not _strict_parsing)
+  except json_format.ParseError as e:
+    raise ResponseParseError('Failed to parse Riot response as %s: %s' %
+                             (message.DESCRIPTOR.full_name, e))
+
+
+def MarshalResponse(message):
+  """Renders a decoded response as JSON, e.g., for debugging or golden files.
+
+  Unlike Riot's JSON, every field is included, even if it has its default value,
+  and fields keep their proto names, so renderings are stable and comparable.
+
+  Args:
+    message: Proto message to render.
+
+  Returns:
+    UTF-8 encoded JSON.
+  """
+  return json_format.MessageToJson(
+      message,
+      including_default_value_fields=True,
+      preserving_proto_field_name=True).encode('utf-8')
+
+
+def _GetMethod(method, request_body):
+  """Returns the HTTP method to use for a request, defaulting based on body."""
+  if method:
+    return method.upper()
+  return 'GET' if request_body is None else 'POST'
+
+
+def CallRiot(context,
+             endpoint,
+             params,
+             message,
+             body_transform=None,
+             route_fn=GetValidatedPlatformId,
+             request_body=None,
+             method=None,
+             max_response_bytes=None):
+  """Helper function to call rito API.
+
+  Args:
+    context: gRPC context of the current call. Used to read invocation
+      metadata.
+    endpoint: relative path to endpoint within Riot API.
+    params: Additional params to pass to the web request.
+    message: Proto message into which to write response. Note: this is an actual
+      message object and not simply the type. E.g., match_pb2.Match() not
+      match_pb2.Match.
+    body_transform: Optional function to apply to raw response body prior to
+      parsing. JSON supports lists as the base object in the response, but
+      protos do not, so we sometimes need to add a wrapper Dict around the
+      response.
+    route_fn: Function returning the routing value used to pick the Riot API
+      host. Either GetValidatedPlatformId or GetRegionalRoute.
+    request_body: Optional proto message to send as the JSON request body. It
+      is marshaled for each request, so retries resend the whole body.
+    method: HTTP method of the request. Defaults to POST if request_body is set,
+      otherwise GET.
+    max_response_bytes: Largest response body to read. Defaults to the limit
+      set by SetMaxResponseBytes for the endpoint.
+  Returns:
+    The input message with fields set based on the call.
+  Raises:
+    InvalidRequestError: If the call specified an unknown platform.
+    ResponseTooLargeError: If the response exceeds max_response_bytes.
+    RiotAPIError: If the request fails.
+    ResponseParseError: If the response doesn't match message.
+    UnavailableError: If Riot couldn't be reached.
+  """
+  metadata = ConvertMetadataToDict(context.invocation_metadata())
+  route = route_fn(context)
+  method = _GetMethod(method, request_body)
+
+  url = os.path.join(_base_url_fn(route), endpoint)
+  full_url = requests.Request('GET', url, params=params).prepare().url
+  # Only GET responses may be reused.
+  response_cache = _response_cache if method == 'GET' else None
+  etag_store = _etag_store if method == 'GET' else None
+  if response_cache:
+    response = response_cache.Get(full_url)
+    if response:
+      return _ParseBody(response.text, message, body_transform)
+
+  # Keys from the client take precedence over the server's.
+  api_key_pool = _api_key_pool
+  key_index = None
+  # Each key has its own rate limit.
+  rate_limit_key = route
+  api_key = GetCallerApiKey(context)
+  if not api_key and api_key_pool:
+    key_index, api_key = api_key_pool.Get(route)
+    rate_limit_key = '%s/key%d' % (route, key_index)
+  elif not api_key:
+    api_key = metadata['api-key']
+  headers = {'X-Riot-Token': api_key}
+  if _user_agent:
+    headers['User-Agent'] = _user_agent
+  if GetRequestId():
+    headers['X-Request-Id'] = GetRequestId()
+  etag_entry = etag_store.Get(full_url) if etag_store else None
+  if etag_entry:
+    headers['If-None-Match'] = etag_entry[0]
+
+  request_kwargs = {'params': params, 'headers': headers}
+  if request_body is not None:
+    headers['Content-Type'] = 'application/json'
+    request_kwargs['data'] = json_format.MessageToJson(request_body)
+
+  rate_limiter = _rate_limiter
+  if rate_limiter:
+    rate_limiter.Acquire(rate_limit_key)
+  response = _TimedRequest(
+      context, route, method, url, max_response_bytes or
+      _GetMaxResponseBytes(endpoint), **request_kwargs)
+  if rate_limiter:
+    rate_limiter.Update(rate_limit_key,
+                        response.headers.get('X-App-Rate-Limit'))
+  _SetRateLimitTrailers(context, response)
+  _deprecation_warner.Check(endpoint, response)
+  if etag_entry and response.status_code == requests.codes.not_modified:
+    return _ParseBody(etag_entry[1], message, body_transform)
+  if response.status_code not in (requests.codes.ok, requests.codes.no_content):
+    error = RiotAPIError.FromResponse(response, method, full_url)
+    # Service limits aren't the key's fault, so other keys wouldn't help.
+    if (key_index is not None and
+        error.status_code == requests.codes.too_many_requests and
+        error.rate_limit_type != RATE_LIMIT_TYPE_SERVICE):
+      api_key_pool.ReportRateLimited(route, key_index, error.retry_after)
+    raise error
+
+  if response_cache:
+    response_cache.Put(full_url, response)
+  etag = response.headers.get('ETag')
+  if etag_store and etag:
+    etag_store.Put(full_url, etag, response.text)
+  return _ParseBody(response.text, message, body_transform)
+
+
+def SleepWhileActive(context, seconds):
+  """Sleeps for seconds unless the call ends first.
+
+  Args:
+    context: gRPC context of the current call.
+    seconds: How long to sleep.
+
+  Returns:
+    True if the full duration elapsed and the call is still active. False if
+    the call was cancelled, or its deadline would pass before we woke up.
+  """
+  remaining = context.time_remaining()
+  if remaining is not None and remaining < seconds:
+    return False
+  done = threading.Event()
+  if not context.add_callback(done.set):
+    # The call has already terminated.
+    return False
+  return not done.wait(seconds)
+
+
+# Statuses which indicate a transient problem on Riot's side.
+_RETRYABLE_SERVER_ERRORS = (
+    requests.codes.internal_server_error,
+    requests.codes.bad_gateway,
+    requests.codes.service_unavailable,
+    requests.codes.gateway_timeout,
+)
+
+
+class RetryPolicy(object):
+  """Exponential backoff with jitter for transient Riot server errors.
+
+  This only covers 5xx responses. Rate limited requests are retried according
+  to Riot's Retry-After header instead.
+  """
+
+  def __init__(self,
+               max_attempts=3,
+               base_delay_secs=0.5,
+               max_delay_secs=8,
+               max_elapsed_secs=20,
+               jitter=0.5,
+               rand=random.random):
+    """Constructor.
+
+    Args:
+      max_attempts: Maximum number of requests to send, including the first.
+      base_delay_secs: Delay before the first retry. Doubles with each retry.
+      max_delay_secs: Upper bound on the delay between two attempts.
+      max_elapsed_secs: No retry is started if it would begin more than this
+        many seconds after the first attempt.
+      jitter: Fraction of each delay which is randomized, between 0 and 1.
+      rand: Function returning a random float in [0, 1).
+    """
+    self.max_attempts = max_attempts
+    self.base_delay_secs = base_delay_secs
+    self.max_delay_secs = max_delay_secs
+    self.max_elapsed_secs = max_elapsed_secs
+    self.jitter = jitter
+    self._rand = rand
+
+  def GetDelaySecs(self, status_code, attempt, elapsed_secs):
+    """Returns how long to wait before retrying, or None to give up.
+
+    Args:
+      status_code: HTTP status of the failed attempt.
+      attempt: Number of attempts made so far.
+      elapsed_secs: Time since the first attempt started.
+    """
+    if status_code not in _RETRYABLE_SERVER_ERRORS:
+      return None
+    return self.GetBackoffSecs(attempt, elapsed_secs)
+
+  def GetBackoffSecs(self, attempt, elapsed_secs):
+    """Like GetDelaySecs, for any retryable failure."""
+    if attempt >= self.max_attempts:
+      return None
+    delay_secs = min(self.max_delay_secs,
+                     self.base_delay_secs * 2**(attempt - 1))
+    delay_secs *= 1 - self.jitter * self._rand()
+    if elapsed_secs + delay_secs > self.max_elapsed_secs:
+      return None
+    return delay_secs
+
+
+# Policy for retrying server errors. Configured by the server at startup. None
+# disables retries of server errors.
+_retry_policy = None
+
+
+def SetRetryPolicy(retry_policy):
+  """Sets the default RetryPolicy used by CallRiotWithRetry."""
+  global _retry_policy
+  _retry_policy = retry_policy
+
+
+class RetryBudget(object):
+  """Stops retries when most requests fail, like gRPC's retry throttling.
+
+  Every retryable failure takes a token and every success returns token_ratio
+  tokens. Retries are only allowed while more than half of max_tokens remain.
+  During an outage the tokens run out and retries stop, so traffic to Riot isn't
+  multiplied by retries. They resume once enough requests succeed.
+  """
+
+  def __init__(self, max_tokens=10, token_ratio=0.1):
+    """Constructor.
+
+    Args:
+      max_tokens: Size of the budget. Half of it is the number of failures in a
+        row after which retries stop.
+      token_ratio: Tokens returned per success. Bounds the steady state ratio
+        of retries to successful requests.
+    """
+    self._max_tokens = max_tokens
+    self._token_ratio = token_ratio
+    self._lock = threading.Lock()
+    self._tokens = float(max_tokens)
+
+  def RecordSuccess(self):
+    with self._lock:
+      self._tokens = min(self._max_tokens, self._tokens + self._token_ratio)
+
+  def RecordFailure(self):
+    with self._lock:
+      self._tokens = max(0, self._tokens - 1)
+
+  def AllowRetry(self):
+    with self._lock:
+      return self._tokens > self._max_tokens / 2
+
+
+# Budget shared by all retries, both of rate limited requests and of server
+# errors. Configured by the server at startup. None allows all retries.
+_retry_budget = None
+
+
+def SetRetryBudget(retry_budget):
+  """Sets the RetryBudget used by CallRiotWithRetry, or None."""
+  global _retry_budget
+  _retry_budget = retry_budget
+
+
+def CallRiotWithRetry(context,
+                      endpoint,
+                      params,
+                      message,
+                      body_transform=None,
+                      max_attempts=3,
+                      route_fn=GetValidatedPlatformId,
+                      retry_policy=None,
+                      request_body=None,
+                      method=None,
+                      max_response_bytes=None):
+  """Like CallRiot, but retries requests which failed transiently.
+
+  When Riot responds with a 429 and a Retry-After header, we wait the requested
+  amount of time and try again, up to max_attempts total attempts. Service rate
+  limits, which Riot may send without Retry-After, are instead backed off
+  according to retry_policy. Server errors are retried with exponential backoff
+  according to retry_policy. If the gRPC call is cancelled or its deadline would
+  expire while waiting, or the RetryBudget set by SetRetryBudget is exhausted,
+  the last error is raised instead.
+
+  Args:
+    context: See CallRiot.
+    endpoint: See CallRiot.
+    params: See CallRiot.
+    message: See CallRiot.
+    body_transform: See CallRiot.
+    max_attempts: Maximum number of requests to send when rate limited,
+      including the first.
+    route_fn: See CallRiot.
+    retry_policy: RetryPolicy for server errors. Defaults to the policy set by
+      SetRetryPolicy.
+    request_body: See CallRiot.
+    method: See CallRiot. Server errors are not retried for POST requests,
+      since they are not idempotent.
+    max_response_bytes: See CallRiot.
+  Returns:
+    The input message with fields set based on the call.
+  Raises:
+    InvalidRequestError: If the call specified an unknown platform.
+    RiotAPIError: If the request fails with a non-retryable error, or retries
+      are exhausted.
+  """
+  retry_policy = retry_policy or _retry_policy
+  if _GetMethod(method, request_body) == 'POST':
+    retry_policy = None
+  retry_budget = _retry_budget
+  start_time = time.monotonic()
+  rate_limited_attempts = 0
+  server_error_attempts = 0
+  while True:
+    try:
+      response = CallRiot(context, endpoint, params, message, body_transform,
+                          route_fn, request_body, method, max_response_bytes)
+    except RiotAPIError as e:
+      delay_secs = None
+      if e.status_code == requests.codes.too_many_requests:
+        rate_limited_attempts += 1
+        if rate_limited_attempts < max_attempts:
+          delay_secs = e.retry_after
+          if (delay_secs is None and retry_policy and
+              e.rate_limit_type == RATE_LIMIT_TYPE_SERVICE):
+            delay_secs = retry_policy.GetBackoffSecs(
+                rate_limited_attempts, time.monotonic() - start_time)
+      elif retry_policy:
+        server_error_attempts += 1
+        delay_secs = retry_policy.GetDelaySecs(
+            e.status_code, server_error_attempts,
+            time.monotonic() - start_time)
+      if retry_budget and (
+          e.status_code == requests.codes.too_many_requests or
+          e.status_code in _RETRYABLE_SERVER_ERRORS):
+        retry_budget.RecordFailure()
+        if not retry_budget.AllowRetry():
+          raise
+      if delay_secs is None or not SleepWhileActive(context, delay_secs):
+        raise
+    else:
+      if retry_budget:
+        retry_budget.RecordSuccess()
+      return response
+
+
+def CallRiotWithBody(context,
+                     method,
+                     endpoint,
+                     params,
+                     request_body,
+                     message,
+                     body_transform=None,
+                     route_fn=GetValidatedPlatformId):
+  """Sends request_body to a write endpoint of the Riot API.
+
+  The body is marshaled to JSON with the proto's JSON field names, sent with
+  Content-Type: application/json, and authenticated like any other call.
+
+  Args:
+    context: See CallRiot.
+    method: HTTP method, e.g., "POST" or "PUT".
+    endpoint: See CallRiot.
+    params: See CallRiot.
+    request_body: Proto message to send as the request body.
+    message: See CallRiot.
+    body_transform: See CallRiot.
+    route_fn: See CallRiot.
+  Returns:
+    The input message with fields set based on the response.
+  Raises:
+    InvalidRequestError: If the call specified an unknown platform.
+    RiotAPIError: If the request fails.
+  """
+  return CallRiotWithRetry(
+      context,
+      endpoint,
+      params,
+      message,
+      body_transform=body_transform,
+      route_fn=route_fn,
+      request_body=request_body,
+      method=method)
+
+
+# Maximum number of Riot requests a single call may have in flight. Configured
+# by the server at startup.
+_fan_out_concurrency = 8
+
+
+def SetFanOutConcurrency(max_concurrency):
+  """Limits how many Riot requests a call may have in flight at once."""
+  global _fan_out_concurrency
+  _fan_out_concurrency = max_concurrency
+
+
+def _FanOutWorker(context, fn):
+  """Returns fn wrapped to be called on a fan-out worker thread.
+
+  Workers attribute their requests to the same RPC, trace and request ID as the
+  thread which creates the wrapper.
+  """
+  rpc_method = riot_metrics_lib.GetRpcMethod()
+  request_id = GetRequestId()
+  span = trace.get_current_span()
+
+  def _Call(item):
+    if not context.is_active():
+      raise CancelledError('call ended before calling Riot')
+    riot_metrics_lib.SetRpcMethod(rpc_method)
+    SetRequestId(request_id)
+    try:
+      # The caller's span reports the call's status, not each fan-out.
+      with trace.use_span(
+          span, record_exception=False, set_status_on_exception=False):
+        return fn(item)
+    finally:
+      riot_metrics_lib.SetRpcMethod(None)
+      SetRequestId(None)
+
+  return _Call
+
+
+def FanOut(context, fn, items, max_concurrency=None):
+  """Calls fn on each item in parallel, for calls which need many requests.
+
+  Each fn call is expected to call Riot, so they are still subject to the rate
+  limiter. Calls not yet started when the gRPC call ends are skipped, and
+  in-flight requests are abandoned as usual.
+
+  Args:
+    context: gRPC context of the current call.
+    fn: Function taking an item, e.g., a function calling CallRiot.
+    items: Iterable of the items to call fn with.
+    max_concurrency: Maximum number of concurrent fn calls. Defaults to the
+      limit set by SetFanOutConcurrency.
+
+  Returns:
+    List of fn's results, in the same order as items.
+
+  Raises:
+    CancelledError: If the call ended before all items were processed.
+    Exception: The first exception raised by fn, by order of items.
+  """
+  items = list(items)
+  if not items:
+    return []
+  max_concurrency = max_concurrency or _fan_out_concurrency
+  call = _FanOutWorker(context, fn)
+  with futures.ThreadPoolExecutor(
+      max_workers=min(max_concurrency, len(items))) as executor:
+    results = [executor.submit(call, item) for item in items]
+    try:
+      return [result.result() for result in results]
+    finally:
+      # Don't start any more calls once one has failed.
+      for result in results:
+        result.cancel()
+
+
+def FanOutStream(context, fn, items, max_concurrency=None):
+  """Like FanOut, but yields each result as soon as it and earlier ones are in.
+
+  items is consumed lazily, and only max_concurrency items are called ahead of
+  the result last yielded, so a slow consumer, e.g., a streaming gRPC client,
+  pauses the calls instead of results piling up in memory.
+
+  Args:
+    context: gRPC context of the current call.
+    fn: Function taking an item, e.g., a function calling CallRiot.
+    items: Iterable of the items to call fn with.
+    max_concurrency: Maximum number of concurrent fn calls. Defaults to the
+      limit set by SetFanOutConcurrency.
+
+  Yields:
+    fn's results, in the same order as items.
+
+  Raises:
+    CancelledError: If the call ended before all items were processed.
+    Exception: The exception raised by fn for the next item to be yielded.
+  """
+  max_concurrency = max_concurrency or _fan_out_concurrency
+  call = _FanOutWorker(context, fn)
+  pending = collections.deque()
+  executor = futures.ThreadPoolExecutor(max_workers=max_concurrency)
+  try:
+    for item in items:
+      pending.append(executor.submit(call, item))
+      if len(pending) >= max_concurrency:
+        yield pending.popleft().result()
+    while pending:
+      yield pending.popleft().result()
+  finally:
+    # Runs when a result raises or the consumer stops early, e.g., because the
+    # gRPC call ended.
+    for result in pending:
+      result.cancel()
+    executor.shutdown(wait=False)
@@ -0,0 +1,1647 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Tests for riot_api_lib."""
+
+from http import server as http_server
+import json
+import threading
+import time
+import unittest
+from unittest import mock
+
+from google.protobuf import json_format
+import grpc
+from opentelemetry import trace
+from opentelemetry.sdk import trace as sdk_trace
+from opentelemetry.sdk.trace import export as trace_export
+from opentelemetry.sdk.trace.export import in_memory_span_exporter
+import prometheus_client
+import requests
+
+from hypebot.protos.riot import platform_pb2
+from hypebot.protos.riot.v3 import tournament_pb2
+from hypebot.protos.riot.v4 import summoner_pb2
+from riot import riot_api_lib
+from riot import riot_metrics_lib
+from riot import riottest
+
+
+def _MakeResponse(status_code=200, body='{}', headers=None):
+  response = requests.Response()
+  response.status_code = status_code
+  response._content = body.encode('utf-8')
+  response._content_consumed = True
+  response.headers.update(headers or {})
+  response.url = 'https://na1.api.riotgames.com/test'
+  return response
+
+
+def _MakeContext(platform_id='NA1', api_key='test-key', time_remaining=None):
+  context = mock.MagicMock()
+  context.invocation_metadata.return_value = (('platform-id', platform_id),
+                                              ('api-key', api_key))
+  context.time_remaining.return_value = time_remaining
+  return context
+
+
+class CallRiotTest(unittest.TestCase):
+
+  @mock.patch.object(requests, 'get')
+  def test_rate_limit_headers_set_as_trailers(self, mock_get):
+    mock_get.return_value = _MakeResponse(
+        body='{"name": "Tester"}',
+        headers={
+            'X-App-Rate-Limit': '20:1,100:120',
+            'X-App-Rate-Limit-Count': '1:1,1:120',
+            'X-Method-Rate-Limit': '2000:60',
+            'X-Method-Rate-Limit-Count': '1:60',
+        })
+    context = _MakeContext()
+
+    summoner = riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                                     summoner_pb2.Summoner())
+
+    self.assertEqual('Tester', summoner.name)
+    context.set_trailing_metadata.assert_called_once_with((
+        ('x-app-rate-limit', '20:1,100:120'),
+        ('x-app-rate-limit-count', '1:1,1:120'),
+        ('x-method-rate-limit', '2000:60'),
+        ('x-method-rate-limit-count', '1:60'),
+    ))
+
+  @mock.patch.object(requests, 'get')
+  def test_no_trailers_without_rate_limit_headers(self, mock_get):
+    mock_get.return_value = _MakeResponse()
+    context = _MakeContext()
+
+    riot_api_lib.CallRiot(context, 'lol/summoner', {}, summoner_pb2.Summoner())
+
+    context.set_trailing_metadata.assert_not_called()
+
+  @mock.patch.object(requests, 'get')
+  def test_user_agent(self, mock_get):
+    mock_get.return_value = _MakeResponse()
+    riot_api_lib.SetUserAgent('hypebot-test/1.0')
+    self.addCleanup(riot_api_lib.SetUserAgent, None)
+
+    riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                          summoner_pb2.Summoner())
+
+    headers = mock_get.call_args[1]['headers']
+    self.assertEqual('hypebot-test/1.0', headers['User-Agent'])
+    self.assertEqual('test-key', headers['X-Riot-Token'])
+
+  @mock.patch.object(requests, 'get')
+  def test_no_user_agent_by_default(self, mock_get):
+    mock_get.return_value = _MakeResponse()
+
+    riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                          summoner_pb2.Summoner())
+
+    self.assertNotIn('User-Agent', mock_get.call_args[1]['headers'])
+
+  @mock.patch.object(requests, 'post')
+  def test_request_body_posted_as_json(self, mock_post):
+    mock_post.return_value = _MakeResponse(body='{"name": "Tester"}')
+
+    summoner = riot_api_lib.CallRiot(
+        _MakeContext(),
+        'lol/summoner', {},
+        summoner_pb2.Summoner(),
+        request_body=summoner_pb2.Summoner(name='Requested'))
+
+    self.assertEqual('Tester', summoner.name)
+    kwargs = mock_post.call_args[1]
+    self.assertEqual('application/json', kwargs['headers']['Content-Type'])
+    self.assertEqual({'name': 'Requested'}, json.loads(kwargs['data']))
+
+  @mock.patch.object(requests, 'get')
+  def test_empty_body(self, mock_get):
+    for status_code, body in ((200, ''), (200, ' \n'), (204, '')):
+      with self.subTest(status_code=status_code, body=body):
+        mock_get.return_value = _MakeResponse(
+            body=body, status_code=status_code)
+
+        response = riot_api_lib.CallRiot(
+            _MakeContext(),
+            'lol/champion-mastery',
+            {},
+            summoner_pb2.Summoner(),
+            body_transform=lambda x: '{"masteries": %s }' % x)
+
+        self.assertEqual(summoner_pb2.Summoner(), response)
+
+
+  @mock.patch.object(requests, 'get')
+  def test_error_includes_method_and_url(self, mock_get):
+    mock_get.return_value = _MakeResponse(
+        status_code=404, body='{"status": {"message": "Data not found"}}')
+
+    with self.assertRaises(riot_api_lib.RiotAPIError) as cm:
+      riot_api_lib.CallRiot(
+          _MakeContext(api_key='secret-key'),
+          'lol/summoner/v4/summoners/by-name/Tester', {'locale': 'en_US'},
+          summoner_pb2.Summoner())
+
+    self.assertEqual(
+        'Failed request for: GET https://na1.api.riotgames.com/lol/summoner/'
+        'v4/summoners/by-name/Tester?locale=en_US (http status 404): '
+        'Data not found', str(cm.exception))
+    self.assertNotIn('secret-key', str(cm.exception))
+
+  @mock.patch.object(requests, 'get')
+  def test_unknown_fields_ignored_by_default(self, mock_get):
+    mock_get.return_value = _MakeResponse(
+        body='{"name": "Tester", "newRiotField": 1}')
+
+    summoner = riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                                     summoner_pb2.Summoner())
+
+    self.assertEqual('Tester', summoner.name)
+
+  @mock.patch.object(requests, 'get')
+  def test_strict_parsing_rejects_unknown_fields(self, mock_get):
+    mock_get.return_value = _MakeResponse(
+        body='{"name": "Tester", "newRiotField": 1}')
+    riot_api_lib.SetStrictParsing(True)
+    self.addCleanup(riot_api_lib.SetStrictParsing, False)
+
+    with self.assertRaisesRegex(riot_api_lib.ResponseParseError,
+                                'newRiotField') as cm:
+      riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+    self.assertEqual(grpc.StatusCode.INTERNAL, cm.exception.code)
+
+  @mock.patch.object(requests, 'get')
+  def test_strict_parsing_accepts_known_fields(self, mock_get):
+    mock_get.return_value = _MakeResponse(
+        body='{"name": "Tester", "summonerLevel": 30}')
+    riot_api_lib.SetStrictParsing(True)
+    self.addCleanup(riot_api_lib.SetStrictParsing, False)
+
+    summoner = riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                                     summoner_pb2.Summoner())
+
+    self.assertEqual(30, summoner.summoner_level)
+
+  def test_rate_limit_type(self):
+    test_cases = [
+        ('application', 'application'),
+        ('method', 'method'),
+        ('service', 'service'),
+        ('Service', 'service'),
+        (None, None),
+    ]
+    for header, expected_type in test_cases:
+      with self.subTest(header=header):
+        headers = {'X-Rate-Limit-Type': header} if header else {}
+        error = riot_api_lib.RiotAPIError.FromResponse(
+            _MakeResponse(status_code=429, headers=headers), 'GET')
+
+        self.assertEqual(expected_type, error.rate_limit_type)
+        self.assertEqual(grpc.StatusCode.RESOURCE_EXHAUSTED, error.code)
+        if expected_type:
+          self.assertIn('%s rate limit' % expected_type, str(error))
+        else:
+          self.assertNotIn('rate limit', str(error))
+
+  def test_html_503_is_maintenance(self):
+    response = _MakeResponse(
+        status_code=503,
+        body='<html><body>Down for maintenance</body></html>',
+        headers={'Content-Type': 'text/html; charset=utf-8'})
+    response.json = mock.Mock(side_effect=AssertionError('body was parsed'))
+
+    error = riot_api_lib.RiotAPIError.FromResponse(response, 'GET')
+
+    self.assertEqual(grpc.StatusCode.UNAVAILABLE, error.code)
+    self.assertEqual(503, error.status_code)
+    self.assertIn('Riot maintenance or outage', str(error))
+
+  def test_json_503_keeps_riot_message(self):
+    error = riot_api_lib.RiotAPIError.FromResponse(
+        _MakeResponse(
+            status_code=503,
+            body='{"status": {"message": "Service unavailable", '
+            '"status_code": 503}}',
+            headers={'Content-Type': 'application/json;charset=utf-8'}), 'GET')
+
+    self.assertEqual(grpc.StatusCode.UNAVAILABLE, error.code)
+    self.assertEqual('Service unavailable', error.message)
+
+  def test_error_url_never_includes_api_key(self):
+    error = riot_api_lib.RiotAPIError(
+        401, 'Unauthorized',
+        'https://na1.api.riotgames.com/lol?api_key=secret-key&locale=en_US')
+
+    self.assertEqual('https://na1.api.riotgames.com/lol?locale=en_US',
+                     error.url)
+
+
+class ResponseSizeTest(unittest.TestCase):
+
+  def setUp(self):
+    super(ResponseSizeTest, self).setUp()
+    riot_api_lib.SetMaxResponseBytes(20, 100)
+    self.addCleanup(riot_api_lib.SetMaxResponseBytes, 4 * 1024 * 1024,
+                    32 * 1024 * 1024)
+    patcher = mock.patch.object(requests, 'get')
+    self.mock_get = patcher.start()
+    self.addCleanup(patcher.stop)
+    self.mock_get.return_value = _MakeResponse(body='{"name": "%s"}' %
+                                               ('x' * 50))
+
+  def test_exceeds_limit(self):
+    with self.assertRaises(riot_api_lib.ResponseTooLargeError) as cm:
+      riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+
+    self.assertEqual(grpc.StatusCode.RESOURCE_EXHAUSTED, cm.exception.code)
+    self.assertTrue(self.mock_get.call_args[1]['stream'])
+
+  def test_large_endpoints_have_larger_limit(self):
+    summoner = riot_api_lib.CallRiot(_MakeContext(),
+                                     'lol/static-data/v3/summoner', {},
+                                     summoner_pb2.Summoner())
+
+    self.assertEqual('x' * 50, summoner.name)
+
+  def test_per_call_limit(self):
+    summoner = riot_api_lib.CallRiot(
+        _MakeContext(),
+        'lol/summoner', {},
+        summoner_pb2.Summoner(),
+        max_response_bytes=1000)
+
+    self.assertEqual('x' * 50, summoner.name)
+
+
+class TimeoutTest(unittest.TestCase):
+
+  def setUp(self):
+    super(TimeoutTest, self).setUp()
+    riot_api_lib.SetRequestTimeout(5)
+    self.addCleanup(riot_api_lib.SetRequestTimeout, None)
+    patcher = mock.patch.object(requests, 'get')
+    self.mock_get = patcher.start()
+    self.addCleanup(patcher.stop)
+    self.mock_get.return_value = _MakeResponse()
+
+  def _CallRiot(self, context):
+    return riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                                 summoner_pb2.Summoner())
+
+  def test_uses_configured_timeout(self):
+    self._CallRiot(_MakeContext())
+    self.assertEqual(5, self.mock_get.call_args[1]['timeout'])
+
+  def test_earlier_deadline_wins(self):
+    self._CallRiot(_MakeContext(time_remaining=2.5))
+    self.assertEqual(2.5, self.mock_get.call_args[1]['timeout'])
+
+    self._CallRiot(_MakeContext(time_remaining=30))
+    self.assertEqual(5, self.mock_get.call_args[1]['timeout'])
+
+  def test_deadline_without_configured_timeout(self):
+    riot_api_lib.SetRequestTimeout(None)
+
+    self._CallRiot(_MakeContext())
+    self.assertIsNone(self.mock_get.call_args[1]['timeout'])
+
+    self._CallRiot(_MakeContext(time_remaining=30))
+    self.assertEqual(30, self.mock_get.call_args[1]['timeout'])
+
+  def test_method_timeouts(self):
+    riot_api_lib.SetMethodTimeouts({
+        'GetMatch': 30,
+        '/hypebot.riot.v4.MatchService/ListMatches': 15,
+        'ListMatches': 20,
+        'GetSummoner': None,
+    })
+    self.addCleanup(riot_api_lib.SetMethodTimeouts, {})
+    self.addCleanup(riot_metrics_lib.SetRpcMethod, None)
+    test_cases = [
+        ('method name', '/hypebot.riot.v4.MatchService/GetMatch', 30),
+        ('full name wins', '/hypebot.riot.v4.MatchService/ListMatches', 15),
+        ('disabled', '/hypebot.riot.v4.SummonerService/GetSummoner', None),
+        ('default', '/hypebot.riot.v4.LeagueService/GetLeague', 5),
+        ('no method', None, 5),
+    ]
+    for description, rpc_method, expected_timeout in test_cases:
+      with self.subTest(description):
+        riot_metrics_lib.SetRpcMethod(rpc_method)
+
+        self._CallRiot(_MakeContext())
+
+        self.assertEqual(expected_timeout,
+                         self.mock_get.call_args[1]['timeout'])
+
+  def test_earlier_deadline_wins_over_method_timeout(self):
+    riot_api_lib.SetMethodTimeouts({'GetMatch': 30})
+    self.addCleanup(riot_api_lib.SetMethodTimeouts, {})
+    riot_metrics_lib.SetRpcMethod('/hypebot.riot.v4.MatchService/GetMatch')
+    self.addCleanup(riot_metrics_lib.SetRpcMethod, None)
+
+    self._CallRiot(_MakeContext(time_remaining=10))
+
+    self.assertEqual(10, self.mock_get.call_args[1]['timeout'])
+
+  def test_expired_deadline(self):
+    with self.assertRaises(riot_api_lib.DeadlineExceededError):
+      self._CallRiot(_MakeContext(time_remaining=0))
+    self.mock_get.assert_not_called()
+
+  def test_timeout_is_deadline_exceeded(self):
+    self.mock_get.side_effect = requests.ReadTimeout()
+
+    with self.assertRaises(riot_api_lib.DeadlineExceededError) as cm:
+      self._CallRiot(_MakeContext())
+    self.assertEqual(grpc.StatusCode.DEADLINE_EXCEEDED, cm.exception.code)
+
+  def test_transport_errors_are_unavailable(self):
+    test_cases = [
+        requests.ConnectionError('Name or service not known'),
+        requests.exceptions.SSLError('certificate verify failed'),
+        requests.exceptions.ChunkedEncodingError('connection reset'),
+    ]
+    for error in test_cases:
+      with self.subTest(error=type(error).__name__):
+        self.mock_get.side_effect = error
+
+        with self.assertRaisesRegex(riot_api_lib.UnavailableError,
+                                    str(error)) as cm:
+          self._CallRiot(_MakeContext())
+        self.assertEqual(grpc.StatusCode.UNAVAILABLE, cm.exception.code)
+
+  def test_other_errors_are_raised_on_callers_thread(self):
+    # E.g., a bug in an HTTP middleware.
+    self.mock_get.side_effect = ValueError('bad middleware')
+
+    with self.assertRaisesRegex(ValueError, 'bad middleware'):
+      self._CallRiot(_MakeContext())
+
+
+class _SlowHandler(http_server.BaseHTTPRequestHandler):
+  """Doesn't respond until the server's release event is set."""
+
+  def do_GET(self):  # pylint: disable=invalid-name
+    self.server.requests += 1
+    self.server.release.wait(10)
+    self.send_response(200)
+    self.send_header('Content-Length', '2')
+    self.end_headers()
+    self.wfile.write(b'{}')
+
+  def log_message(self, *unused_args):
+    pass
+
+
+class HttpSessionTest(unittest.TestCase):
+
+  def test_requests_sent_with_session(self):
+    session = mock.MagicMock()
+    session.get.return_value = _MakeResponse(body='{"name": "Tester"}')
+    riot_api_lib.SetHttpSession(session)
+    self.addCleanup(riot_api_lib.SetHttpSession, None)
+
+    with mock.patch.object(requests, 'get') as mock_get:
+      summoner = riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                                       summoner_pb2.Summoner())
+
+    self.assertEqual('Tester', summoner.name)
+    session.get.assert_called_once()
+    mock_get.assert_not_called()
+
+  def test_new_http_session_pools_connections(self):
+    session = riot_api_lib.NewHttpSession(25)
+
+    adapter = session.get_adapter('https://na1.api.riotgames.com')
+    self.assertEqual(25, adapter._pool_maxsize)
+
+  def test_chain_adapters_order(self):
+    calls = []
+
+    def _Middleware(name):
+
+      def _Wrap(next_send):
+
+        def _Send(request, **kwargs):
+          calls.append('%s request' % name)
+          response = next_send(request, **kwargs)
+          calls.append('%s response' % name)
+          return response
+
+        return _Send
+
+      return _Wrap
+
+    base = mock.create_autospec(requests.adapters.BaseAdapter, instance=True)
+
+    def _BaseSend(request, **unused_kwargs):
+      calls.append('base')
+      response = _MakeResponse(body='{"name": "Tester"}')
+      response.request = request
+      return response
+
+    base.send.side_effect = _BaseSend
+    session = requests.Session()
+    session.mount(
+        'https://',
+        riot_api_lib.ChainAdapters(
+            base, [_Middleware('retry'),
+                   _Middleware('rate limit')]))
+
+    response = session.get('https://na1.api.riotgames.com/lol/summoner')
+
+    self.assertEqual('Tester', response.json()['name'])
+    self.assertEqual([
+        'retry request', 'rate limit request', 'base', 'rate limit response',
+        'retry response'
+    ], calls)
+    session.close()
+    base.close.assert_called_once()
+
+  @mock.patch.object(requests, 'get')
+  def test_connect_timeout(self, mock_get):
+    mock_get.return_value = _MakeResponse()
+    riot_api_lib.SetConnectTimeout(3)
+    self.addCleanup(riot_api_lib.SetConnectTimeout, None)
+    test_cases = [
+        (None, (3, None)),
+        (10, (3, 10)),
+        (2, (2, 2)),
+    ]
+    for time_remaining, expected_timeout in test_cases:
+      with self.subTest(time_remaining=time_remaining):
+        riot_api_lib.CallRiot(
+            _MakeContext(time_remaining=time_remaining), 'lol/summoner', {},
+            summoner_pb2.Summoner())
+
+        self.assertEqual(expected_timeout, mock_get.call_args[1]['timeout'])
+
+
+class CancellationTest(unittest.TestCase):
+
+  def setUp(self):
+    super(CancellationTest, self).setUp()
+    self.server = http_server.ThreadingHTTPServer(('127.0.0.1', 0),
+                                                  _SlowHandler)
+    self.server.requests = 0
+    self.server.release = threading.Event()
+    threading.Thread(target=self.server.serve_forever, daemon=True).start()
+    self.addCleanup(self.server.server_close)
+    self.addCleanup(self.server.shutdown)
+    self.addCleanup(self.server.release.set)
+    port = self.server.server_address[1]
+    riot_api_lib.SetBaseUrlFn(lambda unused_route: 'http://127.0.0.1:%d' % port)
+    self.addCleanup(riot_api_lib.SetBaseUrlFn, None)
+
+  def test_cancelled_mid_flight(self):
+    context = riottest.FakeContext()
+    threading.Timer(0.1, context.Cancel).start()
+    start_time = time.monotonic()
+
+    with self.assertRaises(riot_api_lib.CancelledError) as cm:
+      riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+
+    self.assertLess(time.monotonic() - start_time, 5)
+    self.assertEqual(grpc.StatusCode.CANCELLED, cm.exception.code)
+    self.assertEqual(1, self.server.requests)
+
+  def test_cancelled_before_request(self):
+    context = riottest.FakeContext()
+    context.Cancel()
+
+    with self.assertRaises(riot_api_lib.CancelledError):
+      riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+    self.assertEqual(0, self.server.requests)
+
+  def test_completes_if_not_cancelled(self):
+    self.server.release.set()
+
+    summoner = riot_api_lib.CallRiot(riottest.FakeContext(), 'lol/summoner', {},
+                                     summoner_pb2.Summoner())
+
+    self.assertEqual(summoner_pb2.Summoner(), summoner)
+
+
+class _EchoHandler(http_server.BaseHTTPRequestHandler):
+  """Responds with the body of the request.
+
+  The first server.rate_limited_requests requests are rate limited instead.
+  """
+
+  def _Echo(self):
+    self.server.requests.append((self.command, self.headers))
+    body = self.rfile.read(int(self.headers['Content-Length']))
+    self.server.bodies.append(body)
+    if self.server.rate_limited_requests:
+      self.server.rate_limited_requests -= 1
+      self.send_response(429)
+      self.send_header('Retry-After', '0')
+      self.send_header('Content-Length', '0')
+      self.end_headers()
+      return
+    self.send_response(200)
+    self.send_header('Content-Length', str(len(body)))
+    self.end_headers()
+    self.wfile.write(body)
+
+  do_POST = _Echo  # pylint: disable=invalid-name
+  do_PUT = _Echo  # pylint: disable=invalid-name
+
+  def log_message(self, *unused_args):
+    pass
+
+
+class CallRiotWithBodyTest(unittest.TestCase):
+
+  def setUp(self):
+    super(CallRiotWithBodyTest, self).setUp()
+    self.server = http_server.ThreadingHTTPServer(('127.0.0.1', 0),
+                                                  _EchoHandler)
+    self.server.requests = []
+    self.server.bodies = []
+    self.server.rate_limited_requests = 0
+    threading.Thread(target=self.server.serve_forever, daemon=True).start()
+    self.addCleanup(self.server.server_close)
+    self.addCleanup(self.server.shutdown)
+    port = self.server.server_address[1]
+    riot_api_lib.SetBaseUrlFn(lambda unused_route: 'http://127.0.0.1:%d' % port)
+    self.addCleanup(riot_api_lib.SetBaseUrlFn, None)
+
+  def test_round_trip(self):
+    parameters = tournament_pb2.TournamentCodeParameters
+    request_body = parameters(
+        allowed_summoner_ids=['summoner-1', 'summoner-2'],
+        map_type=parameters.HOWLING_ABYSS,
+        pick_type=parameters.ALL_RANDOM,
+        team_size=5)
+    for method in ('POST', 'PUT'):
+      with self.subTest(method=method):
+        response = riot_api_lib.CallRiotWithBody(
+            riottest.FakeContext(), method, 'lol/tournament/v3/codes', {},
+            request_body, parameters())
+
+        self.assertEqual(request_body, response)
+        command, headers = self.server.requests[-1]
+        self.assertEqual(method, command)
+        self.assertEqual('application/json', headers['Content-Type'])
+        self.assertEqual('test-key', headers['X-Riot-Token'])
+
+  def test_retried_post_resends_body(self):
+    self.server.rate_limited_requests = 2
+    request_body = tournament_pb2.TournamentCodeParameters(
+        allowed_summoner_ids=['summoner-1'], team_size=5)
+
+    response = riot_api_lib.CallRiotWithBody(
+        riottest.FakeContext(), 'POST', 'lol/tournament/v3/codes', {},
+        request_body, tournament_pb2.TournamentCodeParameters())
+
+    self.assertEqual(request_body, response)
+    self.assertEqual(3, len(self.server.bodies))
+    # Every attempt sent the whole body, not what was left of a consumed one.
+    self.assertEqual(
+        request_body,
+        json_format.Parse(self.server.bodies[0],
+                          tournament_pb2.TournamentCodeParameters()))
+    self.assertEqual([self.server.bodies[0]] * 3, self.server.bodies)
+
+
+class RetryTest(unittest.TestCase):
+
+  def setUp(self):
+    super(RetryTest, self).setUp()
+    patcher = mock.patch.object(requests, 'get')
+    self.mock_get = patcher.start()
+    self.addCleanup(patcher.stop)
+    # Tiny delays without jitter keep the tests fast and deterministic.
+    self.policy = riot_api_lib.RetryPolicy(
+        max_attempts=3, base_delay_secs=0.001, jitter=0)
+
+  def _CallRiot(self, context=None):
+    return riot_api_lib.CallRiotWithRetry(
+        context or riottest.FakeContext(),
+        'lol/summoner', {},
+        summoner_pb2.Summoner(),
+        max_attempts=2,
+        retry_policy=self.policy)
+
+  def test_flaky_server(self):
+    retry_now = {'Retry-After': '0'}
+    test_cases = [
+        # (name, status codes returned in order, response headers, expected
+        #  number of requests, whether the call succeeds)
+        ('success', [200], {}, 1, True),
+        ('recovers_from_503', [503, 200], {}, 2, True),
+        ('recovers_from_500_and_504', [500, 504, 200], {}, 3, True),
+        ('max_attempts', [502, 502, 502, 200], {}, 3, False),
+        ('client_error', [404, 200], {}, 1, False),
+        ('rate_limited', [429, 200], retry_now, 2, True),
+        ('rate_limited_without_retry_after', [429, 200], {}, 1, False),
+        ('application_rate_limited_without_retry_after', [429, 200], {
+            'X-Rate-Limit-Type': 'application'
+        }, 1, False),
+        ('service_rate_limited_without_retry_after', [429, 200], {
+            'X-Rate-Limit-Type': 'service'
+        }, 2, True),
+        ('service_rate_limited_max_attempts', [429, 429, 200], {
+            'X-Rate-Limit-Type': 'service'
+        }, 2, False),
+        ('rate_limit_and_server_error_budgets_are_separate',
+         [503, 429, 503, 200], retry_now, 4, True),
+    ]
+    for name, status_codes, headers, expected_requests, success in test_cases:
+      with self.subTest(name=name):
+        self.mock_get.reset_mock()
+        self.mock_get.side_effect = [
+            _MakeResponse(status_code=code, headers=headers)
+            for code in status_codes
+        ]
+
+        if success:
+          self._CallRiot()
+        else:
+          with self.assertRaises(riot_api_lib.RiotAPIError):
+            self._CallRiot()
+        self.assertEqual(expected_requests, self.mock_get.call_count)
+
+  def test_no_retry_once_cancelled(self):
+    context = riottest.FakeContext()
+
+    def _CancelAndFail(*unused_args, **unused_kwargs):
+      context.Cancel()
+      return _MakeResponse(status_code=503)
+
+    self.mock_get.side_effect = _CancelAndFail
+
+    with self.assertRaises(riot_api_lib.Error):
+      self._CallRiot(context)
+    self.assertEqual(1, self.mock_get.call_count)
+
+  def test_retries_stop_once_budget_exhausted(self):
+    riot_api_lib.SetRetryBudget(
+        riot_api_lib.RetryBudget(max_tokens=4, token_ratio=1))
+    self.addCleanup(riot_api_lib.SetRetryBudget, None)
+    self.mock_get.side_effect = lambda *args, **kwargs: _MakeResponse(
+        status_code=503)
+
+    for _ in range(3):
+      with self.assertRaises(riot_api_lib.RiotAPIError):
+        self._CallRiot()
+
+    # The first failure is retried, after which half the budget is used up and
+    # each call only makes one request.
+    self.assertEqual(2 + 1 + 1, self.mock_get.call_count)
+
+  def test_budget_refills_on_success(self):
+    budget = riot_api_lib.RetryBudget(max_tokens=4, token_ratio=2)
+    riot_api_lib.SetRetryBudget(budget)
+    self.addCleanup(riot_api_lib.SetRetryBudget, None)
+    budget.RecordFailure()
+    budget.RecordFailure()
+    self.assertFalse(budget.AllowRetry())
+    self.mock_get.side_effect = [
+        _MakeResponse(status_code=200),
+        _MakeResponse(status_code=429, headers={'Retry-After': '0'}),
+        _MakeResponse(status_code=200),
+    ]
+
+    self._CallRiot()
+    # Retried, since the success refilled the budget.
+    self._CallRiot()
+
+    self.assertEqual(3, self.mock_get.call_count)
+
+  def test_backoff(self):
+    policy = riot_api_lib.RetryPolicy(
+        max_attempts=10,
+        base_delay_secs=1,
+        max_delay_secs=5,
+        max_elapsed_secs=100,
+        jitter=0.5,
+        rand=lambda: 1)
+
+    self.assertEqual(
+        [0.5, 1, 2, 2.5, 2.5],
+        [policy.GetDelaySecs(503, attempt, 0) for attempt in range(1, 6)])
+    self.assertIsNone(policy.GetDelaySecs(503, 10, 0))
+    self.assertIsNone(policy.GetDelaySecs(503, 1, 99.9))
+    self.assertIsNone(policy.GetDelaySecs(400, 1, 0))
+
+
+class RoutingTest(unittest.TestCase):
+
+  def test_validated_platform_id(self):
+    self.assertEqual('euw1',
+                     riot_api_lib.GetValidatedPlatformId(_MakeContext('EUW1')))
+    self.assertEqual('kr',
+                     riot_api_lib.GetValidatedPlatformId(_MakeContext('kr')))
+    for platform_id in ('garbage', 'INVALID_PLATFORM_ID', ''):
+      with self.assertRaises(riot_api_lib.InvalidRequestError):
+        riot_api_lib.GetValidatedPlatformId(_MakeContext(platform_id))
+
+  def test_platform_id_defaults_to_na1(self):
+    context = mock.MagicMock()
+    context.invocation_metadata.return_value = ()
+    self.assertEqual('na1', riot_api_lib.GetValidatedPlatformId(context))
+    self.assertEqual('na1', riot_api_lib.GetPlatformId(_MakeContext('garbage')))
+
+  def test_default_platform_id(self):
+    riot_api_lib.SetDefaultPlatformId(platform_pb2.EUW1)
+    self.addCleanup(riot_api_lib.SetDefaultPlatformId, platform_pb2.NA1)
+    test_cases = [
+        ('default', riot_api_lib.BackgroundContext(), 'euw1'),
+        ('metadata', _MakeContext('KR'), 'kr'),
+        ('context value',
+         riot_api_lib.WithPlatformId(riot_api_lib.BackgroundContext(),
+                                     platform_pb2.JP1), 'jp1'),
+    ]
+    for name, context, expected_platform_id in test_cases:
+      with self.subTest(name=name):
+        self.assertEqual(expected_platform_id,
+                         riot_api_lib.GetValidatedPlatformId(context))
+    self.assertEqual('euw1',
+                     riot_api_lib.GetPlatformId(_MakeContext('garbage')))
+    self.assertEqual('europe',
+                     riot_api_lib.GetRegionalRoute(
+                         riot_api_lib.BackgroundContext()))
+
+  def test_default_platform_id_must_be_valid(self):
+    with self.assertRaises(ValueError):
+      riot_api_lib.SetDefaultPlatformId(platform_pb2.INVALID_PLATFORM_ID)
+    self.assertEqual(
+        'na1',
+        riot_api_lib.GetValidatedPlatformId(riot_api_lib.BackgroundContext()))
+
+  def test_platform_id_precedence(self):
+    background = riot_api_lib.BackgroundContext()
+    test_cases = [
+        ('metadata', riot_api_lib.WithPlatformId(
+            _MakeContext('KR'), platform_pb2.EUW1), 'kr'),
+        ('context value',
+         riot_api_lib.WithPlatformId(background, platform_pb2.EUW1), 'euw1'),
+        ('most recent context value',
+         riot_api_lib.WithPlatformId(
+             riot_api_lib.WithPlatformId(background, platform_pb2.EUW1),
+             platform_pb2.JP1), 'jp1'),
+        ('default', background, 'na1'),
+    ]
+    for name, context, expected_platform_id in test_cases:
+      with self.subTest(name=name):
+        self.assertEqual(expected_platform_id,
+                         riot_api_lib.GetValidatedPlatformId(context))
+
+  @mock.patch.object(requests, 'get')
+  def test_background_context(self, mock_get):
+    mock_get.return_value = _MakeResponse(body='{"name": "Tester"}')
+    context = riot_api_lib.WithPlatformId(riot_api_lib.BackgroundContext(),
+                                          platform_pb2.EUW1)
+    riot_api_lib.SetApiKeyPool(riot_api_lib.ApiKeyPool(['server-key']))
+    self.addCleanup(riot_api_lib.SetApiKeyPool, None)
+
+    summoner = riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                                     summoner_pb2.Summoner())
+
+    self.assertEqual('Tester', summoner.name)
+    self.assertEqual('https://euw1.api.riotgames.com/lol/summoner',
+                     mock_get.call_args[0][0])
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_rejects_unknown_platform(self, mock_get):
+    with self.assertRaises(riot_api_lib.InvalidRequestError) as cm:
+      riot_api_lib.CallRiot(
+          _MakeContext('garbage'), 'lol/summoner', {}, summoner_pb2.Summoner())
+
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, cm.exception.code)
+    mock_get.assert_not_called()
+
+  def test_regional_route(self):
+    expected_routes = {
+        platform_pb2.BR1: 'americas',
+        platform_pb2.EUN1: 'europe',
+        platform_pb2.EUW1: 'europe',
+        platform_pb2.JP1: 'asia',
+        platform_pb2.KR: 'asia',
+        platform_pb2.LA1: 'americas',
+        platform_pb2.LA2: 'americas',
+        platform_pb2.NA1: 'americas',
+        platform_pb2.OC1: 'americas',
+        platform_pb2.PBE1: 'americas',
+        platform_pb2.RU: 'europe',
+        platform_pb2.TR1: 'europe',
+    }
+    # Make sure new platforms get a route.
+    self.assertCountEqual(
+        set(platform_pb2.PlatformId.values()) -
+        {platform_pb2.INVALID_PLATFORM_ID}, expected_routes.keys())
+    for platform_id, route in expected_routes.items():
+      context = _MakeContext(platform_pb2.PlatformId.Name(platform_id))
+      self.assertEqual(route, riot_api_lib.GetRegionalRoute(context))
+
+  def test_regional_route_ignores_case(self):
+    self.assertEqual('europe',
+                     riot_api_lib.GetRegionalRoute(_MakeContext('euw1')))
+
+  def test_regional_route_defaults_to_default_platform(self):
+    context = mock.MagicMock()
+    context.invocation_metadata.return_value = ()
+    self.assertEqual('americas', riot_api_lib.GetRegionalRoute(context))
+
+  def test_regional_route_rejects_unknown_platform(self):
+    riot_api_lib.SetDefaultPlatformId(platform_pb2.EUW1)
+    self.addCleanup(riot_api_lib.SetDefaultPlatformId, platform_pb2.NA1)
+    for platform_id in ('garbage', 'INVALID_PLATFORM_ID'):
+      with self.subTest(platform_id=platform_id):
+        with self.assertRaises(riot_api_lib.InvalidRequestError) as cm:
+          riot_api_lib.GetRegionalRoute(_MakeContext(platform_id))
+
+        self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, cm.exception.code)
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_rejects_unknown_regional_platform(self, mock_get):
+    with self.assertRaises(riot_api_lib.InvalidRequestError):
+      riot_api_lib.CallRiot(
+          _MakeContext('garbage'),
+          'riot/account', {},
+          summoner_pb2.Summoner(),
+          route_fn=riot_api_lib.GetRegionalRoute)
+
+    mock_get.assert_not_called()
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_uses_route_fn(self, mock_get):
+    mock_get.return_value = _MakeResponse()
+
+    riot_api_lib.CallRiot(
+        _MakeContext('KR'),
+        'riot/account', {},
+        summoner_pb2.Summoner(),
+        route_fn=riot_api_lib.GetRegionalRoute)
+
+    self.assertEqual('https://asia.api.riotgames.com/riot/account',
+                     mock_get.call_args[0][0])
+
+
+class _FakeClock(object):
+
+  def __init__(self):
+    self.now = 0.0
+    self.sleeps = []
+
+  def Time(self):
+    return self.now
+
+  def Sleep(self, secs):
+    self.sleeps.append(secs)
+    self.now += secs
+
+
+class RateLimiterTest(unittest.TestCase):
+
+  def setUp(self):
+    super(RateLimiterTest, self).setUp()
+    self.clock = _FakeClock()
+
+  def _MakeLimiter(self, block, **kwargs):
+    return riot_api_lib.RateLimiter(
+        block=block, clock=self.clock.Time, sleep=self.clock.Sleep, **kwargs)
+
+  def test_parse_rate_limit_header(self):
+    self.assertEqual([(20, 1), (100, 120)],
+                     riot_api_lib.ParseRateLimitHeader('20:1,100:120'))
+    self.assertEqual([(20, 1)], riot_api_lib.ParseRateLimitHeader('20:1,junk'))
+    self.assertEqual([], riot_api_lib.ParseRateLimitHeader(None))
+
+  def test_unknown_platform_is_not_limited(self):
+    limiter = self._MakeLimiter(block=False)
+    for _ in range(100):
+      limiter.Acquire('na1')
+
+  def test_default_windows_limit_unknown_platform(self):
+    limiter = self._MakeLimiter(
+        block=False,
+        default_windows=riot_api_lib.KEY_TIER_RATE_LIMITS['development'])
+    for _ in range(20):
+      limiter.Acquire('na1')
+
+    with self.assertRaises(riot_api_lib.RiotAPIError) as cm:
+      limiter.Acquire('na1')
+    self.assertAlmostEqual(0.05, cm.exception.retry_after)
+    self.assertEqual([(20, 1), (100, 120)],
+                     [(w['limit'], w['window_secs'])
+                      for w in limiter.State()['na1']])
+    # Other platforms have their own buckets.
+    limiter.Acquire('euw1')
+
+  def test_observed_limits_replace_default_windows(self):
+    limiter = self._MakeLimiter(block=False, default_windows=[(1, 1)])
+    limiter.Acquire('na1')
+
+    limiter.Update('na1', '3:1')
+
+    limiter.Acquire('na1')
+    limiter.Acquire('na1')
+    with self.assertRaises(riot_api_lib.RiotAPIError):
+      limiter.Acquire('na1')
+
+  def test_observed_limits_matching_default_windows_keep_tokens(self):
+    limiter = self._MakeLimiter(block=False, default_windows=[(2, 10)])
+    limiter.Acquire('na1')
+    limiter.Acquire('na1')
+
+    limiter.Update('na1', '2:10')
+
+    with self.assertRaises(riot_api_lib.RiotAPIError):
+      limiter.Acquire('na1')
+
+  def test_fail_fast_when_bucket_empty(self):
+    limiter = self._MakeLimiter(block=False)
+    limiter.Update('na1', '3:1')
+    limiter.Acquire('na1')
+    limiter.Acquire('na1')
+
+    with self.assertRaises(riot_api_lib.RiotAPIError) as cm:
+      limiter.Acquire('na1')
+    self.assertEqual(429, cm.exception.status_code)
+    # Other platforms have their own buckets.
+    limiter.Acquire('euw1')
+
+  def test_blocks_until_refilled(self):
+    limiter = self._MakeLimiter(block=True)
+    limiter.Update('na1', '2:1')
+    limiter.Acquire('na1')
+
+    limiter.Acquire('na1')
+
+    self.assertEqual([0.5], self.clock.sleeps)
+
+  def test_longest_window_governs(self):
+    limiter = self._MakeLimiter(block=False)
+    limiter.Update('na1', '20:1,2:120')
+    limiter.Acquire('na1')
+    self.clock.now += 1
+
+    with self.assertRaises(riot_api_lib.RiotAPIError) as cm:
+      limiter.Acquire('na1')
+    self.assertAlmostEqual(59, cm.exception.retry_after)
+
+  def test_state(self):
+    limiter = self._MakeLimiter(block=False)
+    limiter.Update('na1', '20:1,100:120')
+    limiter.Acquire('na1')
+    self.clock.now += 0.5
+
+    state = limiter.State()
+    # Reading the state doesn't take tokens.
+    self.assertEqual(state, limiter.State())
+
+    self.assertEqual(['na1'], list(state))
+    self.assertEqual([(20, 1), (100, 120)],
+                     [(w['limit'], w['window_secs']) for w in state['na1']])
+    self.assertAlmostEqual(20, state['na1'][0]['tokens'])
+    self.assertAlmostEqual(98 + 100 * 0.5 / 120, state['na1'][1]['tokens'])
+
+  def test_rate_limit_state_empty_without_limiter(self):
+    self.assertEqual({}, riot_api_lib.GetRateLimitState())
+
+  @mock.patch.object(requests, 'get')
+  def test_burst_against_fake_server(self, mock_get):
+    mock_get.return_value = _MakeResponse(
+        headers={'X-App-Rate-Limit': '5:10'})
+    riot_api_lib.SetRateLimiter(self._MakeLimiter(block=False))
+    self.addCleanup(riot_api_lib.SetRateLimiter, None)
+    context = _MakeContext()
+
+    for _ in range(5):
+      riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+    with self.assertRaises(riot_api_lib.RiotAPIError):
+      riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+    self.assertEqual(5, mock_get.call_count)
+
+
+class MarshalResponseTest(unittest.TestCase):
+
+  def test_round_trip(self):
+    summoner = summoner_pb2.Summoner(
+        id='summoner-id', puuid='puuid', name='Tester', profile_icon_id=7)
+
+    marshaled = riot_api_lib.MarshalResponse(summoner)
+
+    self.assertEqual(summoner,
+                     json_format.Parse(marshaled, summoner_pb2.Summoner()))
+    rendered = json.loads(marshaled.decode('utf-8'))
+    # Defaults are emitted with the proto field names.
+    self.assertEqual('', rendered['account_id'])
+    self.assertEqual(0, int(rendered['summoner_level']))
+    self.assertEqual(7, rendered['profile_icon_id'])
+
+
+class NormalizeSummonerNameTest(unittest.TestCase):
+
+  def test_normalize_summoner_name(self):
+    test_cases = [
+        ('tester', 'tester'),
+        ('Tester', 'tester'),
+        ('  TeSTer\t', 'tester'),
+        ('Hide on  bush', 'hideonbush'),
+        ('\u00c9clair', '\u00e9clair'),
+        ('\ud398\uc774\ucee4', '\ud398\uc774\ucee4'),
+        ('   ', ''),
+    ]
+    for name, expected_name in test_cases:
+      with self.subTest(name=name):
+        self.assertEqual(expected_name,
+                         riot_api_lib.NormalizeSummonerName(name))
+
+
+class DeprecationWarningTest(unittest.TestCase):
+
+  def setUp(self):
+    super(DeprecationWarningTest, self).setUp()
+    self.clock = _FakeClock()
+    self.warner = riot_api_lib._DeprecationWarner(
+        interval_secs=60, clock=self.clock.Time)
+    patcher = mock.patch.object(riot_api_lib.logging, 'warning')
+    self.mock_warning = patcher.start()
+    self.addCleanup(patcher.stop)
+
+  def test_warns_once_per_api(self):
+    response = _MakeResponse(headers={
+        'X-Riot-Deprecated': 'true',
+        'Sunset': 'Wed, 01 Sep 2021 00:00:00 GMT'
+    })
+
+    self.assertTrue(
+        self.warner.Check('lol/summoner/v3/summoners/1', response))
+    self.assertFalse(
+        self.warner.Check('lol/summoner/v3/summoners/2', response))
+    self.assertTrue(self.warner.Check('lol/champion/v3/champions', response))
+
+    self.assertEqual(2, self.mock_warning.call_count)
+    args = self.mock_warning.call_args_list[0][0]
+    self.assertEqual(('lol/summoner/v3', 'x-riot-deprecated=true',
+                      'Wed, 01 Sep 2021 00:00:00 GMT'), args[1:])
+
+  def test_warns_again_after_interval(self):
+    response = _MakeResponse(headers={'Deprecation': 'true'})
+    self.warner.Check('lol/summoner/v3/summoners/1', response)
+
+    self.clock.now += 61
+
+    self.assertTrue(
+        self.warner.Check('lol/summoner/v3/summoners/1', response))
+    self.assertEqual(2, self.mock_warning.call_count)
+
+  def test_ignores_current_apis(self):
+    self.assertFalse(
+        self.warner.Check('lol/summoner/v4/summoners/1', _MakeResponse()))
+    self.mock_warning.assert_not_called()
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_warns(self, mock_get):
+    mock_get.return_value = _MakeResponse(headers={'Deprecation': 'true'})
+
+    with mock.patch.object(riot_api_lib, '_deprecation_warner', self.warner):
+      riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner/v3/summoners/1', {},
+                            summoner_pb2.Summoner())
+
+    self.mock_warning.assert_called_once()
+
+
+class ApiKeyPoolTest(unittest.TestCase):
+
+  def setUp(self):
+    super(ApiKeyPoolTest, self).setUp()
+    self.clock = _FakeClock()
+    self.pool = riot_api_lib.ApiKeyPool(['a', 'b', 'c'],
+                                        cooldown_secs=10,
+                                        clock=self.clock.Time)
+
+  def _NextKeys(self, platform_id, n):
+    return [self.pool.Get(platform_id)[1] for _ in range(n)]
+
+  def test_round_robin(self):
+    self.assertEqual(['a', 'b', 'c', 'a'], self._NextKeys('na1', 4))
+
+  def test_platforms_rotate_independently(self):
+    self.pool.Get('na1')
+    self.assertEqual('a', self.pool.Get('kr')[1])
+    self.assertEqual('b', self.pool.Get('na1')[1])
+
+  def test_rate_limited_key_cools_down(self):
+    self.pool.ReportRateLimited('na1', 1)
+
+    self.assertEqual(['a', 'c', 'a', 'c'], self._NextKeys('na1', 4))
+    # Other platforms are unaffected.
+    self.assertEqual(['a', 'b'], self._NextKeys('kr', 2))
+    self.clock.now += 10
+    self.assertEqual(['a', 'b', 'c'], self._NextKeys('na1', 3))
+
+  def test_retry_after_sets_cooldown(self):
+    self.pool.ReportRateLimited('na1', 0, retry_after=2)
+
+    self.assertEqual(['b', 'c', 'b'], self._NextKeys('na1', 3))
+    self.clock.now += 2
+    self.assertEqual(['c', 'a'], self._NextKeys('na1', 2))
+
+  def test_all_keys_cooling_down(self):
+    self.pool.ReportRateLimited('na1', 0, retry_after=30)
+    self.pool.ReportRateLimited('na1', 1, retry_after=10)
+    self.pool.ReportRateLimited('na1', 2, retry_after=20)
+
+    # The key available soonest is used.
+    self.assertEqual(1, self.pool.Get('na1')[0])
+
+  def test_requires_keys(self):
+    with self.assertRaises(ValueError):
+      riot_api_lib.ApiKeyPool([])
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_uses_pool(self, mock_get):
+    mock_get.side_effect = [
+        _MakeResponse(status_code=429, headers={'Retry-After': '5'}),
+        _MakeResponse(),
+        _MakeResponse(),
+    ]
+    riot_api_lib.SetApiKeyPool(self.pool)
+    self.addCleanup(riot_api_lib.SetApiKeyPool, None)
+    context = mock.MagicMock()
+    context.invocation_metadata.return_value = (('platform-id', 'NA1'),)
+    context.time_remaining.return_value = None
+
+    with self.assertRaises(riot_api_lib.RiotAPIError):
+      riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+    riot_api_lib.CallRiot(context, 'lol/summoner', {}, summoner_pb2.Summoner())
+    # Keys from the client take precedence.
+    riot_api_lib.CallRiot(
+        _MakeContext(api_key='client-key'), 'lol/summoner', {},
+        summoner_pb2.Summoner())
+
+    sent_keys = [
+        call[1]['headers']['X-Riot-Token'] for call in mock_get.call_args_list
+    ]
+    self.assertEqual(['a', 'b', 'client-key'], sent_keys)
+    # The rate limited key is skipped.
+    self.assertEqual(['c', 'b', 'c'], self._NextKeys('na1', 3))
+
+  @mock.patch.object(requests, 'get')
+  def test_service_rate_limit_keeps_key(self, mock_get):
+    mock_get.return_value = _MakeResponse(
+        status_code=429, headers={'X-Rate-Limit-Type': 'service'})
+    riot_api_lib.SetApiKeyPool(self.pool)
+    self.addCleanup(riot_api_lib.SetApiKeyPool, None)
+    context = mock.MagicMock()
+    context.invocation_metadata.return_value = (('platform-id', 'NA1'),)
+    context.time_remaining.return_value = None
+
+    with self.assertRaises(riot_api_lib.RiotAPIError) as cm:
+      riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+
+    self.assertEqual(riot_api_lib.RATE_LIMIT_TYPE_SERVICE,
+                     cm.exception.rate_limit_type)
+    # Key a isn't cooling down.
+    self.assertEqual(['b', 'c', 'a'], self._NextKeys('na1', 3))
+
+  @mock.patch.object(requests, 'get')
+  def test_api_key_precedence(self, mock_get):
+    mock_get.return_value = _MakeResponse()
+    riot_api_lib.SetApiKeyPool(self.pool)
+    self.addCleanup(riot_api_lib.SetApiKeyPool, None)
+    background = riot_api_lib.BackgroundContext()
+    test_cases = [
+        ('metadata',
+         riot_api_lib.WithApiKey(_MakeContext(api_key='client-key'),
+                                 'context-key'), 'client-key'),
+        ('context value', riot_api_lib.WithApiKey(background, 'context-key'),
+         'context-key'),
+        ('server pool', background, 'a'),
+    ]
+    for name, context, expected_key in test_cases:
+      with self.subTest(name=name):
+        riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                              summoner_pb2.Summoner())
+
+        self.assertEqual(expected_key,
+                         mock_get.call_args[1]['headers']['X-Riot-Token'])
+
+  def test_fixed_api_key(self):
+    background = riot_api_lib.BackgroundContext()
+    test_cases = [
+        ('caller key', ['a', 'b'], _MakeContext(api_key='client-key'),
+         'client-key'),
+        ('single pooled key', ['a'], background, 'a'),
+        ('rotating pool', ['a', 'b'], background, None),
+    ]
+    for name, keys, context, expected_key in test_cases:
+      with self.subTest(name=name):
+        riot_api_lib.SetApiKeyPool(riot_api_lib.ApiKeyPool(keys))
+        self.addCleanup(riot_api_lib.SetApiKeyPool, None)
+
+        self.assertEqual(expected_key, riot_api_lib.GetFixedApiKey(context))
+
+
+class ResponseCacheTest(unittest.TestCase):
+
+  _URL = 'https://na1.api.riotgames.com/lol/static-data/v3/versions'
+
+  def setUp(self):
+    super(ResponseCacheTest, self).setUp()
+    self.clock = _FakeClock()
+    # Sun, 01 Jan 2017 00:00:00 GMT.
+    self.clock.now = 1483228800.0
+    self.cache = riot_api_lib.ResponseCache(60, clock=self.clock.Time)
+
+  def test_default_ttl(self):
+    response = _MakeResponse()
+    self.cache.Put(self._URL, response)
+
+    self.clock.now += 59
+    self.assertIs(response, self.cache.Get(self._URL))
+    self.clock.now += 1
+    self.assertIsNone(self.cache.Get(self._URL))
+
+  def test_max_age(self):
+    self.cache.Put(
+        self._URL,
+        _MakeResponse(headers={'Cache-Control': 'public, max-age=5'}))
+
+    self.clock.now += 4
+    self.assertIsNotNone(self.cache.Get(self._URL))
+    self.clock.now += 1
+    self.assertIsNone(self.cache.Get(self._URL))
+
+  def test_expires(self):
+    self.cache.Put(
+        self._URL,
+        _MakeResponse(headers={'Expires': 'Sun, 01 Jan 2017 00:02:00 GMT'}))
+
+    self.clock.now += 119
+    self.assertIsNotNone(self.cache.Get(self._URL))
+    self.clock.now += 1
+    self.assertIsNone(self.cache.Get(self._URL))
+
+  def test_uncacheable_responses(self):
+    for headers in ({
+        'Cache-Control': 'no-store'
+    }, {
+        'Cache-Control': 'no-cache'
+    }, {
+        'Cache-Control': 'max-age=0'
+    }, {
+        'Expires': '0'
+    }):
+      self.cache.Put(self._URL, _MakeResponse(headers=headers))
+      self.assertIsNone(self.cache.Get(self._URL), headers)
+
+  def test_only_static_data_is_cached(self):
+    url = 'https://na1.api.riotgames.com/lol/summoner/v4/summoners/abc'
+    self.cache.Put(url, _MakeResponse())
+    self.assertIsNone(self.cache.Get(url))
+
+  def test_concurrent_access(self):
+    urls = ['%s?version=%d' % (self._URL, i) for i in range(10)]
+
+    def Worker():
+      for url in urls * 10:
+        self.cache.Put(url, _MakeResponse(body=url))
+        self.assertEqual(url, self.cache.Get(url).text)
+
+    threads = [threading.Thread(target=Worker) for _ in range(8)]
+    for thread in threads:
+      thread.start()
+    for thread in threads:
+      thread.join()
+
+    for url in urls:
+      self.assertEqual(url, self.cache.Get(url).text)
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_uses_cache(self, mock_get):
+    mock_get.return_value = _MakeResponse(body='{"versions": ["8.24.1"]}')
+    riot_api_lib.SetResponseCache(self.cache)
+    self.addCleanup(riot_api_lib.SetResponseCache, None)
+    context = _MakeContext()
+
+    for _ in range(3):
+      riot_api_lib.CallRiot(context, 'lol/static-data/v3/versions', {},
+                            summoner_pb2.Summoner())
+    riot_api_lib.CallRiot(context, 'lol/static-data/v3/versions',
+                          {'locale': 'ko_KR'}, summoner_pb2.Summoner())
+    riot_api_lib.CallRiot(context, 'lol/summoner/v4/summoners/abc', {},
+                          summoner_pb2.Summoner())
+    riot_api_lib.CallRiot(context, 'lol/summoner/v4/summoners/abc', {},
+                          summoner_pb2.Summoner())
+
+    # One fetch per distinct static data URL, plus every non-static request.
+    self.assertEqual(4, mock_get.call_count)
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_does_not_cache_errors(self, mock_get):
+    mock_get.return_value = _MakeResponse(status_code=503)
+    riot_api_lib.SetResponseCache(self.cache)
+    self.addCleanup(riot_api_lib.SetResponseCache, None)
+
+    for _ in range(2):
+      with self.assertRaises(riot_api_lib.RiotAPIError):
+        riot_api_lib.CallRiot(_MakeContext(), 'lol/static-data/v3/versions', {},
+                              summoner_pb2.Summoner())
+    self.assertEqual(2, mock_get.call_count)
+
+
+class ETagTest(unittest.TestCase):
+
+  def setUp(self):
+    super(ETagTest, self).setUp()
+    riot_api_lib.SetETagStore(riot_api_lib.InMemoryETagStore())
+    self.addCleanup(riot_api_lib.SetETagStore, None)
+    patcher = mock.patch.object(requests, 'get')
+    self.mock_get = patcher.start()
+    self.addCleanup(patcher.stop)
+
+  def test_not_modified_returns_previous_body(self):
+    self.mock_get.side_effect = [
+        _MakeResponse(body='{"name": "Tester"}', headers={'ETag': '"abc"'}),
+        _MakeResponse(status_code=304, body=''),
+    ]
+    context = _MakeContext()
+
+    first = riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                                  summoner_pb2.Summoner())
+    second = riot_api_lib.CallRiot(context, 'lol/summoner', {},
+                                   summoner_pb2.Summoner())
+
+    first_headers = self.mock_get.call_args_list[0][1]['headers']
+    second_headers = self.mock_get.call_args_list[1][1]['headers']
+    self.assertNotIn('If-None-Match', first_headers)
+    self.assertEqual('"abc"', second_headers['If-None-Match'])
+    self.assertEqual('Tester', first.name)
+    self.assertEqual(first, second)
+
+  def test_etags_are_per_url(self):
+    self.mock_get.return_value = _MakeResponse(headers={'ETag': '"abc"'})
+    context = _MakeContext()
+
+    riot_api_lib.CallRiot(context, 'lol/summoner', {'a': 1},
+                          summoner_pb2.Summoner())
+    riot_api_lib.CallRiot(context, 'lol/summoner', {'a': 2},
+                          summoner_pb2.Summoner())
+
+    self.assertNotIn('If-None-Match', self.mock_get.call_args[1]['headers'])
+
+  def test_unexpected_not_modified_is_an_error(self):
+    self.mock_get.return_value = _MakeResponse(status_code=304, body='')
+
+    with self.assertRaises(riot_api_lib.RiotAPIError):
+      riot_api_lib.CallRiot(_MakeContext(), 'lol/summoner', {},
+                            summoner_pb2.Summoner())
+
+  def test_in_memory_store_evicts_oldest(self):
+    store = riot_api_lib.InMemoryETagStore(max_entries=2)
+    store.Put('a', '"1"', 'body a')
+    store.Put('b', '"2"', 'body b')
+    store.Put('a', '"3"', 'new body a')
+    store.Put('c', '"4"', 'body c')
+
+    self.assertIsNone(store.Get('b'))
+    self.assertEqual(('"3"', 'new body a'), store.Get('a'))
+    self.assertEqual(('"4"', 'body c'), store.Get('c'))
+
+
+class MetricsTest(unittest.TestCase):
+
+  def setUp(self):
+    super(MetricsTest, self).setUp()
+    riot_metrics_lib.SetRpcMethod('/hypebot.riot.v4.MetricsTest/GetThing')
+    self.addCleanup(riot_metrics_lib.SetRpcMethod, None)
+
+  def _GetSample(self, name, http_status):
+    return prometheus_client.REGISTRY.get_sample_value(
+        name, {
+            'service': 'hypebot.riot.v4.MetricsTest',
+            'method': 'GetThing',
+            'platform': 'kr',
+            'http_status': http_status,
+        }) or 0
+
+  @mock.patch.object(requests, 'get')
+  def test_call_riot_records_requests(self, mock_get):
+    mock_get.side_effect = [
+        _MakeResponse(),
+        _MakeResponse(status_code=429),
+        requests.ConnectionError(),
+    ]
+    before = {
+        status: self._GetSample('riot_api_requests_total', status)
+        for status in ('200', '429', 'error')
+    }
+    before_latency_count = self._GetSample(
+        'riot_api_request_latency_seconds_count', '429')
+
+    riot_api_lib.CallRiot(
+        _MakeContext('KR'), 'lol/summoner', {}, summoner_pb2.Summoner())
+    with self.assertRaises(riot_api_lib.RiotAPIError):
+      riot_api_lib.CallRiot(
+          _MakeContext('KR'), 'lol/summoner', {}, summoner_pb2.Summoner())
+    with self.assertRaises(riot_api_lib.UnavailableError):
+      riot_api_lib.CallRiot(
+          _MakeContext('KR'), 'lol/summoner', {}, summoner_pb2.Summoner())
+
+    for status, count in before.items():
+      self.assertEqual(count + 1,
+                       self._GetSample('riot_api_requests_total', status),
+                       status)
+    self.assertEqual(
+        before_latency_count + 1,
+        self._GetSample('riot_api_request_latency_seconds_count', '429'))
+
+
+class TracingTest(unittest.TestCase):
+
+  def setUp(self):
+    super(TracingTest, self).setUp()
+    self.exporter = in_memory_span_exporter.InMemorySpanExporter()
+    tracer_provider = sdk_trace.TracerProvider()
+    tracer_provider.add_span_processor(
+        trace_export.SimpleSpanProcessor(self.exporter))
+    self.tracer = tracer_provider.get_tracer(__name__)
+    patcher = mock.patch.object(riot_api_lib, '_tracer', self.tracer)
+    patcher.start()
+    self.addCleanup(patcher.stop)
+
+  @mock.patch.object(requests, 'get')
+  def test_span_per_request(self, mock_get):
+    mock_get.return_value = _MakeResponse(status_code=404)
+
+    with self.tracer.start_as_current_span('GetSummoner') as parent:
+      with self.assertRaises(riot_api_lib.RiotAPIError):
+        riot_api_lib.CallRiot(
+            _MakeContext('EUW1'), 'lol/summoner/v4/summoners/abc', {},
+            summoner_pb2.Summoner())
+
+    span, parent_span = self.exporter.get_finished_spans()
+    self.assertEqual('GetSummoner', parent_span.name)
+    self.assertEqual('/lol/summoner/v4/summoners/abc', span.name)
+    self.assertEqual(trace.SpanKind.CLIENT, span.kind)
+    self.assertEqual(parent.get_span_context().span_id, span.parent.span_id)
+    self.assertEqual(
+        'https://euw1.api.riotgames.com/lol/summoner/v4/summoners/abc',
+        span.attributes['http.url'])
+    self.assertEqual('euw1', span.attributes['riot.route'])
+    self.assertEqual(404, span.attributes['http.status_code'])
+    self.assertEqual(trace.StatusCode.ERROR, span.status.status_code)
+
+
+class FanOutTest(unittest.TestCase):
+
+  def test_results_in_order(self):
+    results = riot_api_lib.FanOut(riottest.FakeContext(), lambda x: x * 2,
+                                  range(20))
+
+    self.assertEqual([x * 2 for x in range(20)], results)
+
+  def test_concurrency_is_capped(self):
+    lock = threading.Lock()
+    in_flight = [0]
+    max_in_flight = [0]
+
+    def _Call(unused_item):
+      with lock:
+        in_flight[0] += 1
+        max_in_flight[0] = max(max_in_flight[0], in_flight[0])
+      time.sleep(0.01)
+      with lock:
+        in_flight[0] -= 1
+
+    riot_api_lib.FanOut(
+        riottest.FakeContext(), _Call, range(20), max_concurrency=3)
+
+    self.assertLessEqual(max_in_flight[0], 3)
+    self.assertGreater(max_in_flight[0], 1)
+
+  def test_cancellation_stops_fan_out(self):
+    context = riottest.FakeContext()
+    started = []
+    release = threading.Event()
+
+    def _Call(item):
+      started.append(item)
+      if item == 0:
+        context.Cancel()
+      release.wait(1)
+
+    threading.Timer(0.1, release.set).start()
+    with self.assertRaises(riot_api_lib.CancelledError):
+      riot_api_lib.FanOut(context, _Call, range(20), max_concurrency=2)
+
+    self.assertLessEqual(len(started), 2)
+
+  def test_first_error_is_raised(self):
+
+    def _Call(item):
+      if item in (3, 5):
+        raise riot_api_lib.RiotAPIError(404, 'item %d' % item)
+      return item
+
+    with self.assertRaisesRegex(riot_api_lib.RiotAPIError, 'item 3'):
+      riot_api_lib.FanOut(riottest.FakeContext(), _Call, range(10))
+
+  def test_attributes_requests_to_caller(self):
+    riot_metrics_lib.SetRpcMethod('/hypebot.riot.v4.MatchService/GetMatches')
+    self.addCleanup(riot_metrics_lib.SetRpcMethod, None)
+
+    rpc_methods = riot_api_lib.FanOut(
+        riottest.FakeContext(), lambda unused_item: riot_metrics_lib
+        .GetRpcMethod(), range(3))
+
+    self.assertEqual(['/hypebot.riot.v4.MatchService/GetMatches'] * 3,
+                     rpc_methods)
+
+
+class FanOutStreamTest(unittest.TestCase):
+
+  def test_results_in_order(self):
+    results = riot_api_lib.FanOutStream(
+        riottest.FakeContext(), lambda x: x * 2, iter(range(20)),
+        max_concurrency=3)
+
+    self.assertEqual([x * 2 for x in range(20)], list(results))
+
+  def test_items_are_taken_as_consumed(self):
+    taken = []
+
+    def _Items():
+      for item in range(20):
+        taken.append(item)
+        yield item
+
+    results = riot_api_lib.FanOutStream(
+        riottest.FakeContext(), lambda x: x, _Items(), max_concurrency=3)
+
+    self.assertEqual(0, next(results))
+    # Only max_concurrency items are taken ahead of the consumer.
+    self.assertEqual([0, 1, 2], taken)
+    self.assertEqual(1, next(results))
+    self.assertEqual([0, 1, 2, 3], taken)
+    results.close()
+
+  def test_error_is_raised_in_order(self):
+
+    def _Call(item):
+      if item == 3:
+        raise riot_api_lib.RiotAPIError(404, 'item 3')
+      return item
+
+    results = riot_api_lib.FanOutStream(riottest.FakeContext(), _Call,
+                                        range(10))
+
+    self.assertEqual([0, 1, 2], [next(results) for _ in range(3)])
+    with self.assertRaisesRegex(riot_api_lib.RiotAPIError, 'item 3'):
+      next(results)
+
+  def test_stopping_early_cancels_pending_calls(self):
+    release = threading.Event()
+    called = []
+
+    def _Call(item):
+      called.append(item)
+      release.wait(1)
+      return item
+
+    results = riot_api_lib.FanOutStream(
+        riottest.FakeContext(), _Call, range(20), max_concurrency=2)
+    threading.Timer(0.1, release.set).start()
+    self.assertEqual(0, next(results))
+    results.close()
+    time.sleep(0.2)
+
+    self.assertLessEqual(len(called), 3)
+
+  def test_cancellation_stops_fan_out(self):
+    context = riottest.FakeContext()
+    context.Cancel()
+
+    with self.assertRaises(riot_api_lib.CancelledError):
+      list(riot_api_lib.FanOutStream(context, lambda x: x, range(5)))
+
+
+if __name__ == '__main__':
+  unittest.main()
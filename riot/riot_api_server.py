@@ -19,181 +19,1908 @@ from __future__ import division
 from __future__ import print_function
 
 import concurrent
+import contextlib
+import itertools
 import os
+import signal
+import threading
+import time
+from urllib import parse
 
 from absl import app
 from absl import flags
 from absl import logging
-from google.protobuf import json_format
 import grpc
-import requests
+from grpc_health.v1 import health
+from grpc_health.v1 import health_pb2
+from grpc_health.v1 import health_pb2_grpc
+from grpc_reflection.v1alpha import reflection
+from opentelemetry import trace
+from opentelemetry.exporter.otlp.proto.grpc import trace_exporter
+from opentelemetry.instrumentation import grpc as otel_grpc
+from opentelemetry.sdk import resources
+from opentelemetry.sdk import trace as sdk_trace
+from opentelemetry.sdk.trace import export as trace_export
 
+from hypebot.protos.riot import platform_pb2
+from hypebot.protos.riot.v1 import account_pb2
+from hypebot.protos.riot.v1 import account_pb2_grpc
+from hypebot.protos.riot.v1 import clash_pb2
+from hypebot.protos.riot.v1 import clash_pb2_grpc
+from hypebot.protos.riot.v3 import champion_pb2
+from hypebot.protos.riot.v3 import champion_pb2_grpc
+from hypebot.protos.riot.v3 import lol_status_pb2
+from hypebot.protos.riot.v3 import lol_status_pb2_grpc
+from hypebot.protos.riot.v3 import static_data_pb2
+from hypebot.protos.riot.v3 import static_data_pb2_grpc
+from hypebot.protos.riot.v3 import third_party_code_pb2
+from hypebot.protos.riot.v3 import third_party_code_pb2_grpc
+from hypebot.protos.riot.v3 import tournament_pb2
+from hypebot.protos.riot.v3 import tournament_pb2_grpc
+from hypebot.protos.riot.v3 import tournament_stub_pb2
+from hypebot.protos.riot.v3 import tournament_stub_pb2_grpc
 from hypebot.protos.riot.v4 import champion_mastery_pb2
 from hypebot.protos.riot.v4 import champion_mastery_pb2_grpc
+from hypebot.protos.riot.v4 import constants_pb2
 from hypebot.protos.riot.v4 import league_pb2
 from hypebot.protos.riot.v4 import league_pb2_grpc
 from hypebot.protos.riot.v4 import match_pb2
 from hypebot.protos.riot.v4 import match_pb2_grpc
+from hypebot.protos.riot.v4 import spectator_pb2
+from hypebot.protos.riot.v4 import spectator_pb2_grpc
 from hypebot.protos.riot.v4 import summoner_pb2
 from hypebot.protos.riot.v4 import summoner_pb2_grpc
+from riot import riot_api_lib
+from riot import riot_gateway_lib
+from riot import riot_metrics_lib
 
 FLAGS = flags.FLAGS
 
 flags.DEFINE_string('host', 'localhost', 'Which host to use.')
 flags.DEFINE_integer('port', 50051, 'Which port to bind to.')
+flags.DEFINE_enum(
+    'rate_limit_mode', 'block', ['block', 'fail_fast', 'off'],
+    'How to handle requests exceeding the app rate limit advertised by Riot. '
+    '"block" waits for quota, "fail_fast" returns RESOURCE_EXHAUSTED.')
+flags.DEFINE_enum(
+    'default_platform', 'NA1', [
+        name for name in platform_pb2.PlatformId.keys()
+        if name != 'INVALID_PLATFORM_ID'
+    ], 'Platform to call for gRPC calls without platform-id metadata. Useful '
+    'for servers dedicated to one region.')
+flags.DEFINE_enum(
+    'key_tier', 'development', ['development', 'production'],
+    'Tier of the Riot API keys. Until Riot\'s rate limit headers have been '
+    'seen for a platform, requests to it are limited to the tier\'s default '
+    'app rate limits: 20 per second and 100 per 2 minutes for development '
+    'keys, or 500 per 10 seconds and 30,000 per 10 minutes for production '
+    'keys.')
+flags.DEFINE_multi_string(
+    'riot_api_key', None,
+    'Riot API key to use for calls which do not specify one in their api-key '
+    'metadata. Repeat to rotate between several keys. Defaults to the comma '
+    'separated keys in the RIOT_API_KEY environment variable.')
+flags.DEFINE_string(
+    'user_agent', 'hypebot-riot-api-server',
+    'User-Agent header identifying this application in requests to Riot.')
+flags.DEFINE_string(
+    'tls_cert', None,
+    'PEM encoded certificate chain to serve TLS with. Requires --tls_key. The '
+    'server uses plaintext if unset.')
+flags.DEFINE_string('tls_key', None,
+                    'PEM encoded private key for --tls_cert.')
+flags.DEFINE_string(
+    'client_ca', None,
+    'PEM encoded CA certificates. If set, clients must present a certificate '
+    'signed by one of them (mTLS). Requires --tls_cert.')
+flags.DEFINE_boolean(
+    'enable_reflection', False,
+    'Whether to serve the gRPC reflection service, for use with tools such as '
+    'grpcurl.')
+flags.DEFINE_integer(
+    'max_recv_msg_size', 4 * 1024 * 1024,
+    'Largest gRPC request the server accepts, in bytes. -1 means no limit.')
+flags.DEFINE_integer(
+    'max_send_msg_size', 32 * 1024 * 1024,
+    'Largest gRPC response the server sends, in bytes. -1 means no limit. '
+    'Match timelines and full static data commonly exceed gRPC\'s default '
+    '4MB, so clients requesting them need to raise their receive limit too.')
+flags.DEFINE_float(
+    'shutdown_grace_secs', 5,
+    'Seconds to let in-flight calls finish after receiving SIGTERM.')
+flags.DEFINE_float(
+    'riot_timeout', 10,
+    'Seconds to wait for Riot to respond to a request, unless the gRPC call\'s '
+    'deadline is sooner. 0 waits until the call\'s deadline, if any.')
+flags.DEFINE_multi_string(
+    'method_timeout', None,
+    'Overrides --riot_timeout for the Riot requests of a gRPC method, as '
+    'method=seconds, e.g., GetMatch=30. The method may also be a full name, '
+    'e.g., /hypebot.riot.v4.MatchService/GetMatch. 0 waits until the call\'s '
+    'deadline. Repeat for several methods.')
+flags.DEFINE_float(
+    'connect_timeout', 3,
+    'Seconds to wait for a connection to Riot, including the TLS handshake. '
+    '0 uses --riot_timeout.')
+flags.DEFINE_integer(
+    'max_idle_conns_per_host', 80,
+    'Connections to keep open to each Riot host for reuse. Requests are spread '
+    'over a handful of hosts, so this should cover the concurrent requests to '
+    'one host: up to 10 calls, each making --fan_out_concurrency requests.')
+flags.DEFINE_integer(
+    'server_error_max_attempts', 3,
+    'Maximum number of times to send a request which fails with a 5xx error, '
+    'including the first. Retries back off exponentially.')
+flags.DEFINE_float('server_error_base_delay_secs', 0.5,
+                   'Delay before retrying a request which failed with a 5xx '
+                   'error. Doubles with each retry.')
+flags.DEFINE_integer(
+    'retry_budget_max_tokens', 10,
+    'Size of the budget shared by all retries. Each rate limited or 5xx '
+    'response uses a token, and retries stop once half of them are used, so '
+    'an outage at Riot is not amplified by retries. 0 disables the budget.')
+flags.DEFINE_float(
+    'retry_budget_token_ratio', 0.1,
+    'Retry budget tokens returned by each successful request.')
+flags.DEFINE_integer(
+    'static_data_cache_ttl_secs', 3600,
+    'How long to cache static data responses which do not specify their own '
+    'lifetime via Cache-Control or Expires. 0 disables caching.')
+flags.DEFINE_integer(
+    'summoner_cache_ttl_secs', 60,
+    'How long to remember summoners returned by SummonerService.GetSummoner. '
+    'A summoner is remembered by its ID, account ID, PUUID and name, so a '
+    'lookup by any of them is served from the cache. 0 disables caching.')
+flags.DEFINE_integer(
+    'fan_out_concurrency', 8,
+    'Maximum number of concurrent Riot requests made by a single call which '
+    'needs many, e.g., GetMatches.')
+flags.DEFINE_integer(
+    'max_response_bytes', 4 * 1024 * 1024,
+    'Largest Riot response to read. Larger responses fail the call.')
+flags.DEFINE_integer(
+    'max_large_response_bytes', 32 * 1024 * 1024,
+    'Largest Riot response to read from endpoints known to return large '
+    'responses, i.e., match timelines and static data.')
+flags.DEFINE_boolean(
+    'strict_response_parsing', False,
+    'Whether Riot responses with fields missing from our protos fail the call '
+    'with INTERNAL. Meant for canaries, to detect when Riot\'s schema has '
+    'changed. By default, unknown fields are ignored.')
+flags.DEFINE_integer(
+    'etag_store_size', 1000,
+    'Number of response ETags to remember for conditional requests to Riot. '
+    '0 disables conditional requests.')
+flags.DEFINE_enum(
+    'trace_exporter', 'none', ['none', 'otlp'],
+    'Where to export trace spans for gRPC calls and the Riot requests they '
+    'make. Tracing is disabled by default.')
+flags.DEFINE_string('otlp_endpoint', 'localhost:4317',
+                    'OTLP collector to export spans to.')
+flags.DEFINE_boolean(
+    'enable_tournament_stub', False,
+    'Whether to serve TournamentStubService, which calls Riot\'s tournament '
+    'stub API instead of the real one.')
+flags.DEFINE_float(
+    'riot_health_check_interval_secs', 0,
+    'If positive, the gRPC health service reports NOT_SERVING while a cheap '
+    'call to Riot fails, e.g., because Riot is unreachable or the API key is '
+    'invalid. Riot is called at startup and then this often, which uses rate '
+    'limit quota. Requires --riot_api_key. 0 always reports SERVING.')
+flags.DEFINE_string(
+    'gateway_addr', None,
+    'Loopback address, e.g., localhost:8080, on which to serve '
+    'SummonerService and MatchService over REST/JSON. The gateway serves '
+    'plaintext HTTP without authentication and spends the server\'s own Riot '
+    'API keys, so other addresses are refused. The gateway is not served if '
+    'unset.')
+flags.DEFINE_float(
+    'gateway_deadline_secs', 30,
+    'Deadline of each REST gateway call, like the deadline of a gRPC call. 0 '
+    'for no deadline.')
+flags.DEFINE_string(
+    'metrics_addr', None,
+    'Address, e.g., localhost:9090, on which to serve Prometheus metrics at '
+    '/metrics and the client-side rate limit state at /debug/ratelimits. '
+    'Neither is served if unset.')
 
+# Shortest interval at which WatchFeaturedGames polls Riot. The featured games
+# change every few minutes, so polling faster only wastes rate limit.
+_MIN_FEATURED_GAMES_POLL_SECS = 10
 
-def _convert_metadata_to_dict(metadata):
-  metadata_dict = {}
-  for key, value in metadata:
-    metadata_dict[key] = value
-  return metadata_dict
+# Threads serving gRPC calls. A streaming call holds one for as long as it runs.
+_SERVER_WORKERS = 10
 
+# Most WatchFeaturedGames calls which may run at once, so that watchers can't
+# hold every server worker and starve other calls.
+_MAX_FEATURED_GAMES_WATCHERS = 4
+
+# Match calls are commonly made in bulk, so they retry when rate limited.
+_RATE_LIMITED_MAX_ATTEMPTS = 3
+
+# Queues with ranked leagues. Riot rejects league requests for other queues.
+_RANKED_QUEUES = frozenset([
+    constants_pb2.QueueType.RANKED_SOLO_5x5,
+    constants_pb2.QueueType.RANKED_FLEX_SR,
+    constants_pb2.QueueType.RANKED_FLEX_TT,
+])
+
+# The most matches Riot will return in a single matchlist call.
+_MAX_MATCHES_PER_PAGE = 100
+
+
+def _call_riot(endpoint,
+               params,
+               message,
+               context,
+               body_transform=None,
+               max_attempts=1,
+               route_fn=riot_api_lib.GetValidatedPlatformId,
+               request_body=None,
+               empty_on_not_found=False):
+  """Calls the Riot API, aborting the gRPC call if the request fails.
+
+  See riot_api_lib.CallRiotWithRetry for a description of the arguments.
+  Methods opt in to retrying rate limited requests by passing max_attempts > 1,
+  and to returning the empty message for 404s by passing empty_on_not_found.
+  """
+  try:
+    return riot_api_lib.CallRiotWithRetry(
+        context,
+        endpoint,
+        params,
+        message,
+        body_transform=body_transform,
+        max_attempts=max_attempts,
+        route_fn=route_fn,
+        request_body=request_body)
+  except riot_api_lib.Error as e:
+    if empty_on_not_found and e.code == grpc.StatusCode.NOT_FOUND:
+      return message
+    context.abort(e.code, str(e))
+
+
+def _RequireFields(request, context, *field_names):
+  """Aborts the call with INVALID_ARGUMENT unless all field_names are set.
+
+  Riot responds to requests for e.g. "by-account/" with a confusing 404, so it's
+  better to not send them.
+  """
+  missing = [name for name in field_names if not getattr(request, name)]
+  if missing:
+    context.abort(
+        grpc.StatusCode.INVALID_ARGUMENT,
+        '%s is missing required fields: %s' %
+        (type(request).__name__, ', '.join(missing)))
+
+
+def _RequireRankedQueue(queue, context):
+  """Aborts the call with INVALID_ARGUMENT unless queue has ranked leagues."""
+  if queue not in _RANKED_QUEUES:
+    context.abort(
+        grpc.StatusCode.INVALID_ARGUMENT,
+        'Unsupported queue %s, must be one of: %s' %
+        (constants_pb2.QueueType.Enum.Name(queue), ', '.join(
+            sorted(constants_pb2.QueueType.Enum.Name(q)
+                   for q in _RANKED_QUEUES))))
+
+
+def _RedactMetadata(metadata):
+  """Returns metadata as a dict, with secrets replaced."""
+  redacted = riot_api_lib.ConvertMetadataToDict(metadata or ())
+  if 'api-key' in redacted:
+    redacted['api-key'] = 'REDACTED'
+  return redacted
+
+
+def _InterceptBehavior(handler, scope):
+  """Returns handler with its unary-request behavior run inside scope.
 
-def _call_riot(endpoint, params, message, metadata, body_transform=None):
-  """Helper function to call rito API.
   Args:
-    endpoint: relative path to endpoint within Riot API.
-    params: Additional params to pass to the web request.
-    message: Proto message into which to write response. Note: this is an actual
-      message object and not simply the type. E.g., match_pb2.Match() not
-      match_pb2.Match.
-    metadata: Invocation_metadata from gRPC.
-    body_transform: Optional function to apply to raw response body prior to
-      parsing. JSON supports lists as the base object in the response, but
-      protos do not, so we sometimes need to add a wrapper Dict around the
-      response.
+    handler: grpc.RpcMethodHandler to wrap, or None for unknown methods.
+      Handlers of request-streaming methods are returned unchanged.
+    scope: Function taking the call's context, returning a context manager
+      entered for the whole call. For unary-stream calls, that's until the last
+      response is sent or the stream is closed.
+
   Returns:
-    The input message with fields set based on the call.
-  Raises:
-    RuntimeError: If request fails.
+    The wrapped grpc.RpcMethodHandler.
   """
-  metadata = _convert_metadata_to_dict(metadata)
+  if not handler:
+    return handler
+  if handler.unary_unary:
+    behavior = handler.unary_unary
+
+    def _Call(request, context):
+      with scope(context):
+        return behavior(request, context)
+
+    return grpc.unary_unary_rpc_method_handler(
+        _Call,
+        request_deserializer=handler.request_deserializer,
+        response_serializer=handler.response_serializer)
+  if handler.unary_stream:
+    behavior = handler.unary_stream
+
+    def _Stream(request, context):
+      # gRPC sends every response of a stream from the same thread, so state
+      # set by scope stays in place between responses.
+      with scope(context):
+        yield from behavior(request, context)
+
+    return grpc.unary_stream_rpc_method_handler(
+        _Stream,
+        request_deserializer=handler.request_deserializer,
+        response_serializer=handler.response_serializer)
+  return handler
+
+
+class LoggingInterceptor(grpc.ServerInterceptor):
+  """Logs the method, metadata, latency and status of every unary-request call.
+
+  Calls are logged at verbosity 1, so run the server with -v=1 to see them.
+  """
+
+  def intercept_service(self, continuation, handler_call_details):
+    method = handler_call_details.method
+    metadata = _RedactMetadata(handler_call_details.invocation_metadata)
+
+    @contextlib.contextmanager
+    def _Logged(context):
+      start_time = time.monotonic()
+      code = grpc.StatusCode.OK
+      try:
+        yield
+      except GeneratorExit:
+        # The client stopped reading a stream.
+        code = grpc.StatusCode.CANCELLED
+        raise
+      except Exception:
+        # context.abort raises after recording the status code.
+        code = context.code() or grpc.StatusCode.UNKNOWN
+        raise
+      finally:
+        logging.vlog(
+            1, '%s platform=%s code=%s latency=%.1fms request_id=%s '
+            'metadata=%s', method, metadata.get('platform-id'), code.name,
+            (time.monotonic() - start_time) * 1000,
+            riot_api_lib.GetRequestId(), metadata)
+
+    return _InterceptBehavior(continuation(handler_call_details), _Logged)
+
+
+class RequestIdInterceptor(grpc.ServerInterceptor):
+  """Tags each unary-request call with an ID correlating it across systems.
+
+  The ID is taken from the call's x-request-id metadata, or generated if the
+  client didn't send a valid one. It's logged by LoggingInterceptor, sent to
+  Riot in the X-Request-Id header of every request made by the call, and
+  returned to the client in the call's initial metadata. It must come before
+  LoggingInterceptor.
+  """
+
+  def intercept_service(self, continuation, handler_call_details):
+    metadata = riot_api_lib.ConvertMetadataToDict(
+        handler_call_details.invocation_metadata or ())
+
+    @contextlib.contextmanager
+    def _Tagged(context):
+      request_id = riot_api_lib.NewRequestId(
+          metadata.get(riot_api_lib.REQUEST_ID_METADATA_KEY))
+      context.send_initial_metadata(
+          ((riot_api_lib.REQUEST_ID_METADATA_KEY, request_id),))
+      riot_api_lib.SetRequestId(request_id)
+      try:
+        yield
+      finally:
+        riot_api_lib.SetRequestId(None)
+
+    return _InterceptBehavior(continuation(handler_call_details), _Tagged)
 
-  url = os.path.join(
-      'https://%s.api.riotgames.com' % metadata.get('platform-id', 'na1'),
-      endpoint)
-  headers = {'X-Riot-Token': metadata['api-key']}
-  response = requests.get(url, params=params, headers=headers)
-  if response.status_code != requests.codes.ok:
-    raise RuntimeError('Failed request for: %s' % url)
-  body = response.text
-  if body_transform:
-    body = body_transform(body)
-  return json_format.Parse(body, message, ignore_unknown_fields=True)
+
+class MetricsInterceptor(grpc.ServerInterceptor):
+  """Attributes the Riot requests made by each unary-request call to it."""
+
+  def intercept_service(self, continuation, handler_call_details):
+
+    @contextlib.contextmanager
+    def _Attributed(unused_context):
+      riot_metrics_lib.SetRpcMethod(handler_call_details.method)
+      try:
+        yield
+      finally:
+        riot_metrics_lib.SetRpcMethod(None)
+
+    return _InterceptBehavior(continuation(handler_call_details), _Attributed)
+
+
+class AccountService(account_pb2_grpc.AccountServiceServicer):
+  """Account API."""
+
+  def GetAccountByRiotId(self, request, context):
+    _RequireFields(request, context, 'game_name', 'tag_line')
+    endpoint = 'riot/account/v1/accounts/by-riot-id/%s/%s' % (parse.quote(
+        request.game_name, safe=''), parse.quote(request.tag_line, safe=''))
+    return _call_riot(
+        endpoint, {},
+        account_pb2.Account(),
+        context,
+        route_fn=riot_api_lib.GetRegionalRoute)
+
+  def GetAccountByPuuid(self, request, context):
+    _RequireFields(request, context, 'puuid')
+    endpoint = 'riot/account/v1/accounts/by-puuid/%s' % parse.quote(
+        request.puuid, safe='')
+    return _call_riot(
+        endpoint, {},
+        account_pb2.Account(),
+        context,
+        route_fn=riot_api_lib.GetRegionalRoute)
+
+
+class ChampionService(champion_pb2_grpc.ChampionServiceServicer):
+  """Champion API."""
+
+  def GetChampionRotations(self, request, context):
+    return _call_riot('lol/platform/v3/champion-rotations', {},
+                      champion_pb2.ChampionRotations(), context)
 
 
 class ChampionMasteryService(
     champion_mastery_pb2_grpc.ChampionMasteryServiceServicer):
   """Champion Mastery API."""
 
+  def __init__(self, static_data_service=None):
+    """Constructor.
+
+    Args:
+      static_data_service: StaticDataService used to look up champion names.
+        Defaults to a new StaticDataService.
+    """
+    self._static_data_service = static_data_service or StaticDataService()
+    self._lock = threading.Lock()
+    # Platform ID -> {champion ID: champion name}.
+    self._champion_names = {}
+
+  def _GetChampionNames(self, champion_ids, context):
+    """Returns champion names by ID, fetching them if any ID is unknown.
+
+    Names are refetched when a champion is missing, e.g., after a new champion
+    is released, rather than after a fixed TTL.
+
+    Args:
+      champion_ids: IDs of the champions which need names.
+      context: gRPC context of the current call.
+
+    Returns:
+      Dict of champion ID to name for the caller's platform.
+    """
+    platform_id = riot_api_lib.GetPlatformId(context)
+    with self._lock:
+      names = self._champion_names.get(platform_id, {})
+    if all(champion_id in names for champion_id in champion_ids):
+      return names
+    champions = self._static_data_service.ListChampions(
+        static_data_pb2.ListChampionsRequest(data_by_id=True), context)
+    names = {
+        champion.id: champion.name for champion in champions.data.values()
+    }
+    with self._lock:
+      self._champion_names[platform_id] = names
+    return names
+
   def ListChampionMasteries(self, request, context):
-    return _call_riot(
+    _RequireFields(request, context, 'encrypted_summoner_id')
+    if request.top_n < 0:
+      context.abort(grpc.StatusCode.INVALID_ARGUMENT,
+                    'top_n must not be negative')
+    response = _call_riot(
         'lol/champion-mastery/v4/champion-masteries/by-summoner/%s' %
         request.encrypted_summoner_id, {},
         champion_mastery_pb2.ListChampionMasteriesResponse(),
-        context.invocation_metadata(),
-        body_transform=lambda x: '{"championMasteries": %s }' % x)
+        context,
+        body_transform=lambda x: '{"championMasteries": %s }' % x,
+        empty_on_not_found=request.treat_404_as_empty)
+    if request.top_n:
+      masteries = sorted(
+          response.champion_masteries,
+          key=lambda mastery: mastery.champion_points,
+          reverse=True)[:request.top_n]
+      del response.champion_masteries[:]
+      response.champion_masteries.extend(masteries)
+    if request.include_champion_names:
+      names = self._GetChampionNames(
+          [mastery.champion_id for mastery in response.champion_masteries],
+          context)
+      for mastery in response.champion_masteries:
+        mastery.champion_name = names.get(mastery.champion_id, '')
+    return response
 
   def GetChampionMastery(self, request, context):
+    _RequireFields(request, context, 'encrypted_summoner_id', 'champion_id')
     endpoint = ('lol/champion-mastery/v4/champion-masteries/by-summoner/%s/'
                 'by-champion/%s' %
                 (request.encrypted_summoner_id, request.champion_id))
     return _call_riot(endpoint, {}, champion_mastery_pb2.ChampionMastery(),
-                      context.invocation_metadata())
+                      context)
 
   def GetChampionMasteryScore(self, request, context):
+    _RequireFields(request, context, 'encrypted_summoner_id')
     return _call_riot(
         'lol/champion-mastery/v4/scores/by-summoner/%s' %
         request.encrypted_summoner_id, {},
         champion_mastery_pb2.ChampionMasteryScore(),
-        context.invocation_metadata(),
+        context,
         body_transform=lambda x: '{"score": %s }' % x)
 
 
+class ClashService(clash_pb2_grpc.ClashServiceServicer):
+  """Clash API."""
+
+  def ListPlayers(self, request, context):
+    _RequireFields(request, context, 'encrypted_summoner_id')
+    endpoint = 'lol/clash/v1/players/by-summoner/%s' % parse.quote(
+        request.encrypted_summoner_id, safe='')
+    return _call_riot(
+        endpoint, {},
+        clash_pb2.ListPlayersResponse(),
+        context,
+        body_transform=lambda x: '{"players": %s }' % x)
+
+  def GetTeam(self, request, context):
+    _RequireFields(request, context, 'team_id')
+    endpoint = 'lol/clash/v1/teams/%s' % parse.quote(request.team_id, safe='')
+    return _call_riot(endpoint, {}, clash_pb2.Team(), context)
+
+  def ListTournaments(self, request, context):
+    return _call_riot(
+        'lol/clash/v1/tournaments', {},
+        clash_pb2.ListTournamentsResponse(),
+        context,
+        body_transform=lambda x: '{"tournaments": %s }' % x)
+
+  def GetTournamentByTeam(self, request, context):
+    _RequireFields(request, context, 'team_id')
+    endpoint = 'lol/clash/v1/tournaments/by-team/%s' % parse.quote(
+        request.team_id, safe='')
+    return _call_riot(endpoint, {}, clash_pb2.Tournament(), context)
+
+  def GetTournament(self, request, context):
+    _RequireFields(request, context, 'tournament_id')
+    endpoint = 'lol/clash/v1/tournaments/%d' % request.tournament_id
+    return _call_riot(endpoint, {}, clash_pb2.Tournament(), context)
+
+
+class LoLStatusService(lol_status_pb2_grpc.LoLStatusServiceServicer):
+  """LoL Status API.
+
+  Clients can use GetShardData to confirm maintenance when another call fails
+  with UNAVAILABLE and a "Riot maintenance or outage" message.
+  """
+
+  def GetShardData(self, request, context):
+    return _call_riot('lol/status/v3/shard-data', {},
+                      lol_status_pb2.ShardStatus(), context)
+
+
+# Lanes which Riot reports under two names.
+_LANE_ALIASES = {
+    constants_pb2.Lane.MID: constants_pb2.Lane.MIDDLE,
+    constants_pb2.Lane.MIDDLE: constants_pb2.Lane.MID,
+    constants_pb2.Lane.BOT: constants_pb2.Lane.BOTTOM,
+    constants_pb2.Lane.BOTTOM: constants_pb2.Lane.BOT,
+}
+
+
+def _MatchFilter(request):
+  """Returns whether a MatchReference is in request's roles and lanes.
+
+  Args:
+    request: ListMatchesRequest with the roles and lanes to keep. Empty means
+      all are kept.
+  """
+  roles = set(request.roles)
+  lanes = set(request.lanes)
+  lanes.update([_LANE_ALIASES[lane] for lane in lanes if lane in _LANE_ALIASES])
+  return lambda match: ((not roles or match.role in roles) and
+                        (not lanes or match.lane in lanes))
+
+
+def _MatchlistPageRequest(request):
+  """Returns the ListMatchesRequest for paging through request's matchlist.
+
+  Pages must be full to tell when the last one was reached, so roles and lanes
+  are removed, to be filtered after each page is fetched.
+
+  Args:
+    request: ListMatchesRequest with the matchlist's filters.
+  """
+  page_request = match_pb2.ListMatchesRequest()
+  page_request.CopyFrom(request)
+  del page_request.roles[:]
+  del page_request.lanes[:]
+  page_request.ClearField('count')
+  return page_request
+
+
+def _FilterMatches(response, request):
+  """Removes matches not in request's roles and lanes from response.
+
+  The paging fields are left as Riot returned them, so they still describe the
+  position in the unfiltered matchlist.
+
+  Args:
+    response: ListMatchesResponse to filter in place.
+    request: ListMatchesRequest with the roles and lanes to keep.
+  """
+  matches = list(filter(_MatchFilter(request), response.matches))
+  del response.matches[:]
+  response.matches.extend(matches)
+
+
+def _FilterTimeline(timeline, request):
+  """Removes events and participants not requested from timeline.
+
+  Args:
+    timeline: MatchTimeline to filter in place.
+    request: GetMatchTimelineRequest with the event types and participants to
+      keep.
+  """
+  event_types = set(request.event_types)
+  participant_ids = set(request.participant_ids)
+
+  def _KeepEvent(event):
+    if event_types and event.type not in event_types:
+      return False
+    if not participant_ids:
+      return True
+    involved = {
+        event.participant_id, event.creator_id, event.killer_id,
+        event.victim_id
+    }
+    involved.update(event.assisting_participant_ids)
+    return bool(involved & participant_ids)
+
+  for frame in timeline.frames:
+    events = list(filter(_KeepEvent, frame.events))
+    del frame.events[:]
+    frame.events.extend(events)
+    if participant_ids:
+      for key in list(frame.participant_frames):
+        if frame.participant_frames[key].participant_id not in participant_ids:
+          del frame.participant_frames[key]
+
+
+def GetMatchParticipantByAccount(match, encrypted_id):
+  """Returns the Participant of match played by an account or summoner.
+
+  Riot reports who played in participant_identities and how they played in
+  participants, which are correlated by participant_id.
+
+  Args:
+    match: Match returned by MatchService.GetMatch.
+    encrypted_id: Encrypted account or summoner ID of the player. The account
+      the match was played on and the player's current account both match.
+
+  Returns:
+    The player's Participant, or None if they didn't play in match.
+  """
+  if not encrypted_id:
+    return None
+  for identity in match.participant_identities:
+    player = identity.player
+    if encrypted_id in (player.account_id, player.current_account_id,
+                        player.summoner_id):
+      participant_id = identity.participant_id
+      break
+  else:
+    return None
+  for participant in match.participants:
+    if participant.participant_id == participant_id:
+      return participant
+  return None
+
+
 class MatchService(match_pb2_grpc.MatchServiceServicer):
   """Match API."""
 
   def ListMatches(self, request, context):
+    _RequireFields(request, context, 'encrypted_account_id')
     params = {}
     if request.queues:
       params['queue'] = [int(q) for q in request.queues]
     if request.seasons:
       params['season'] = [int(s) for s in request.seasons]
     if request.champions:
-      params['champions'] = request.seasons
+      params['champion'] = list(request.champions)
+    # Each bound is sent on its own, so setting only one isn't ignored.
     if request.begin_time_ms:
       params['beginTime'] = request.begin_time_ms
+    if request.end_time_ms:
       params['endTime'] = request.end_time_ms
     if request.begin_index:
       params['beginIndex'] = request.begin_index
+    if request.end_index:
       params['endIndex'] = request.end_index
+    if request.count:
+      if request.count < 0 or request.end_index:
+        context.abort(
+            grpc.StatusCode.INVALID_ARGUMENT,
+            'count must be positive and can\'t be used with end_index')
+      count = min(request.count, _MAX_MATCHES_PER_PAGE)
+      params['endIndex'] = request.begin_index + count
 
-    return _call_riot(
-        'lol/match/v4/matchlists/by-account/%s' % request.encrypted_account_id,
-        params, match_pb2.ListMatchesResponse(), context.invocation_metadata())
+    response = _call_riot(
+        'lol/match/v4/matchlists/by-account/%s' %
+        parse.quote(request.encrypted_account_id, safe=''),
+        params,
+        match_pb2.ListMatchesResponse(),
+        context,
+        max_attempts=_RATE_LIMITED_MAX_ATTEMPTS)
+    if request.count:
+      # Riot should honor endIndex, but don't rely on it.
+      del response.matches[count:]
+    _FilterMatches(response, request)
+    return response
+
+  def ListMatchesByQueueAndTimeRange(self, request, context):
+    _RequireFields(request, context, 'encrypted_account_id')
+    for begin_field, end_field in (('begin_time_ms', 'end_time_ms'),
+                                   ('begin_index', 'end_index')):
+      begin = getattr(request, begin_field)
+      end = getattr(request, end_field)
+      if end and begin >= end:
+        context.abort(
+            grpc.StatusCode.INVALID_ARGUMENT, '%s (%d) must be before %s (%d)' %
+            (begin_field, begin, end_field, end))
+    return self.ListMatches(
+        match_pb2.ListMatchesRequest(
+            encrypted_account_id=request.encrypted_account_id,
+            queues=request.queues,
+            begin_time_ms=request.begin_time_ms,
+            end_time_ms=request.end_time_ms,
+            begin_index=request.begin_index,
+            end_index=request.end_index), context)
+
+  def ListAllMatches(self, request, context):
+    """Lists matches, transparently paging through Riot's matchlist.
+
+    Each page costs one Riot call, so listing a player's full history costs
+    ceil(total_games / 100) calls against the rate limit. Set limit to bound
+    the cost.
+
+    Args:
+      request: ListAllMatchesRequest.
+      context: gRPC context of the current call.
+
+    Returns:
+      ListMatchesResponse with the concatenated matches of all pages. Its
+      end_index is the begin_index from which to continue listing.
+    """
+    page_request = _MatchlistPageRequest(request.request)
+    keep = _MatchFilter(request.request)
+    response = match_pb2.ListMatchesResponse(
+        start_index=page_request.begin_index,
+        end_index=page_request.begin_index)
+    while not request.limit or len(response.matches) < request.limit:
+      if not context.is_active():
+        break
+      page_request.end_index = page_request.begin_index + _MAX_MATCHES_PER_PAGE
+      page = self.ListMatches(page_request, context)
+      response.total_games = page.total_games
+      for index, match in enumerate(page.matches, page_request.begin_index):
+        if request.limit and len(response.matches) >= request.limit:
+          break
+        if keep(match):
+          response.matches.add().CopyFrom(match)
+        # Matches which were filtered out don't need to be listed again.
+        response.end_index = index + 1
+      if len(page.matches) < _MAX_MATCHES_PER_PAGE:
+        break
+      page_request.begin_index += _MAX_MATCHES_PER_PAGE
+    return response
 
   def ListTournamentMatchIds(self, request, context):
+    _RequireFields(request, context, 'tournament_code')
     return _call_riot(
         'lol/match/v4/matches/by-tournament-code/%s/ids' %
         request.tournament_code, {}, match_pb2.ListTournamentMatchIdsResponse(),
-        context.invocation_metadata())
+        context)
 
-  def GetMatch(self, request, context):
+  def _GetMatchEndpoint(self, request):
     endpoint = 'lol/match/v4/matches/%s' % request.game_id
     if request.tournament_code:
       endpoint += '/by-tournament-code/%s' % request.tournament_code
-    return _call_riot(endpoint, {}, match_pb2.Match(),
-                      context.invocation_metadata())
+    return endpoint
+
+  def GetMatch(self, request, context):
+    _RequireFields(request, context, 'game_id')
+    return _call_riot(
+        self._GetMatchEndpoint(request), {},
+        match_pb2.Match(),
+        context,
+        max_attempts=_RATE_LIMITED_MAX_ATTEMPTS)
+
+  def GetMatches(self, request, context):
+
+    def _GetMatchOrError(game_id):
+      if not game_id:
+        return match_pb2.Match(), match_pb2.MatchError(
+            code=grpc.StatusCode.INVALID_ARGUMENT.value[0],
+            message='game_id must be set')
+      try:
+        return riot_api_lib.CallRiotWithRetry(
+            context,
+            self._GetMatchEndpoint(match_pb2.GetMatchRequest(game_id=game_id)),
+            {},
+            match_pb2.Match(),
+            max_attempts=_RATE_LIMITED_MAX_ATTEMPTS), match_pb2.MatchError()
+      except riot_api_lib.Error as e:
+        return match_pb2.Match(), match_pb2.MatchError(
+            code=e.code.value[0], message=str(e))
+
+    try:
+      results = riot_api_lib.FanOut(context, _GetMatchOrError,
+                                    request.game_ids)
+    except riot_api_lib.Error as e:
+      context.abort(e.code, str(e))
+    response = match_pb2.GetMatchesResponse()
+    for match, error in results:
+      response.matches.add().CopyFrom(match)
+      response.errors.add().CopyFrom(error)
+    return response
+
+  def GetMatchTimeline(self, request, context):
+    _RequireFields(request, context, 'game_id')
+    timeline = _call_riot(
+        'lol/match/v4/timelines/by-match/%s' % request.game_id, {},
+        match_pb2.MatchTimeline(),
+        context,
+        max_attempts=_RATE_LIMITED_MAX_ATTEMPTS)
+    _FilterTimeline(timeline, request)
+    return timeline
+
+  def _IterMatchReferences(self, request, context):
+    """Yields the MatchReferences in a matchlist, fetching pages as needed.
+
+    Args:
+      request: ListMatchesRequest with the matchlist's filters. Paging starts
+        from its begin_index.
+      context: gRPC context of the current call.
+    """
+    page_request = _MatchlistPageRequest(request)
+    keep = _MatchFilter(request)
+    while context.is_active():
+      page_request.end_index = page_request.begin_index + _MAX_MATCHES_PER_PAGE
+      page = self.ListMatches(page_request, context)
+      for match in page.matches:
+        if keep(match):
+          yield match
+      if len(page.matches) < _MAX_MATCHES_PER_PAGE:
+        return
+      page_request.begin_index += _MAX_MATCHES_PER_PAGE
+
+  def StreamAccountMatches(self, request, context):
+    """Streams the full matches in a player's matchlist.
+
+    Matches are fetched up to --fan_out_concurrency at a time, ahead of the
+    client. Pages of the matchlist are only fetched once the client has caught
+    up to them, so a slow client doesn't hold matches in memory.
+
+    Args:
+      request: StreamAccountMatchesRequest.
+      context: gRPC context of the current call.
+
+    Yields:
+      Match for each match in the matchlist.
+    """
+    _RequireFields(request.request, context, 'encrypted_account_id')
+    match_references = self._IterMatchReferences(request.request, context)
+    if request.limit:
+      match_references = itertools.islice(match_references, request.limit)
+
+    def _GetMatch(match_reference):
+      return riot_api_lib.CallRiotWithRetry(
+          context,
+          self._GetMatchEndpoint(
+              match_pb2.GetMatchRequest(game_id=match_reference.game_id)),
+          {},
+          match_pb2.Match(),
+          max_attempts=_RATE_LIMITED_MAX_ATTEMPTS)
+
+    try:
+      for match in riot_api_lib.FanOutStream(context, _GetMatch,
+                                             match_references):
+        yield match
+    except riot_api_lib.Error as e:
+      context.abort(e.code, str(e))
+
+
+class SpectatorService(spectator_pb2_grpc.SpectatorServiceServicer):
+  """Spectator API."""
+
+  def __init__(self,
+               summoner_service=None,
+               max_watchers=_MAX_FEATURED_GAMES_WATCHERS):
+    """Constructor.
+
+    Args:
+      summoner_service: SummonerService used to look up summoners by name.
+        Defaults to a new SummonerService.
+      max_watchers: Most WatchFeaturedGames calls which may run at once.
+    """
+    self._summoner_service = summoner_service or SummonerService()
+    self._max_watchers = max_watchers
+    self._watchers = threading.BoundedSemaphore(max_watchers)
+
+  def GetActiveGame(self, request, context):
+    return self._GetActiveGame(request.encrypted_summoner_id,
+                               request.encrypted_summoner_id, context)
+
+  def GetActiveGameByName(self, request, context):
+    _RequireFields(request, context, 'summoner_name')
+    summoner = self._summoner_service.GetSummoner(
+        summoner_pb2.GetSummonerRequest(summoner_name=request.summoner_name),
+        context)
+    return self._GetActiveGame(summoner.id, request.summoner_name, context)
+
+  def GetActiveGameParticipant(self, request, context):
+    key_type = request.WhichOneof('summoner')
+    if not key_type:
+      context.abort(grpc.StatusCode.INVALID_ARGUMENT,
+                    'GetActiveGameParticipant: no summoner specified')
+    _RequireFields(request, context, key_type)
+    summoner_id = request.encrypted_summoner_id
+    if key_type == 'summoner_name':
+      summoner_id = self._summoner_service.GetSummoner(
+          summoner_pb2.GetSummonerRequest(summoner_name=request.summoner_name),
+          context).id
+    summoner_description = getattr(request, key_type)
+    game = self._GetActiveGame(summoner_id, summoner_description, context)
+    for participant in game.participants:
+      if participant.summoner_id == summoner_id:
+        return participant
+    context.abort(
+        grpc.StatusCode.NOT_FOUND,
+        'Summoner %s is not a participant of game %d' %
+        (summoner_description, game.game_id))
+
+  def _GetActiveGame(self, encrypted_summoner_id, summoner_description,
+                     context):
+    """Gets the active game, aborting with a clear message if there's none."""
+    endpoint = ('lol/spectator/v4/active-games/by-summoner/%s' %
+                encrypted_summoner_id)
+    try:
+      return riot_api_lib.CallRiot(context, endpoint, {},
+                                   spectator_pb2.CurrentGameInfo())
+    except riot_api_lib.Error as e:
+      if e.code == grpc.StatusCode.NOT_FOUND:
+        context.abort(
+            e.code,
+            'Summoner %s is not in an active game' % summoner_description)
+      context.abort(e.code, str(e))
+
+  def ListFeaturedGames(self, request, context):
+    return _call_riot('lol/spectator/v4/featured-games', {},
+                      spectator_pb2.ListFeaturedGamesResponse(), context)
+
+  def WatchFeaturedGames(self, request, context):
+    """Streams the featured games which started or ended since the last poll.
+
+    Args:
+      request: WatchFeaturedGamesRequest.
+      context: gRPC context of the current call.
+
+    Yields:
+      FeaturedGamesDelta for each poll which found changes.
+    """
+    # Each watcher holds a server worker until it ends.
+    if not self._watchers.acquire(blocking=False):
+      context.abort(
+          grpc.StatusCode.RESOURCE_EXHAUSTED,
+          'At most %d WatchFeaturedGames calls may run at once' %
+          self._max_watchers)
+    featured_game_ids = set()
+    try:
+      while True:
+        games = self.ListFeaturedGames(spectator_pb2.ListFeaturedGamesRequest(),
+                                       context)
+        game_ids = set(game.game_id for game in games.game_list)
+        delta = spectator_pb2.FeaturedGamesDelta(
+            started=[
+                game for game in games.game_list
+                if game.game_id not in featured_game_ids
+            ],
+            ended_game_ids=sorted(featured_game_ids - game_ids))
+        if delta.started or delta.ended_game_ids:
+          yield delta
+        featured_game_ids = game_ids
+        poll_interval_secs = max(
+            request.poll_interval_secs or games.client_refresh_interval,
+            _MIN_FEATURED_GAMES_POLL_SECS)
+        if not riot_api_lib.SleepWhileActive(context, poll_interval_secs):
+          return
+    finally:
+      self._watchers.release()
+
+
+# Locale used for static data requests which don't specify one, by the
+# platform they're sent to.
+_DEFAULT_LOCALES = {
+    'BR1': 'pt_BR',
+    'EUN1': 'en_GB',
+    'EUW1': 'en_GB',
+    'JP1': 'ja_JP',
+    'KR': 'ko_KR',
+    'LA1': 'es_MX',
+    'LA2': 'es_AR',
+    'NA1': 'en_US',
+    'OC1': 'en_AU',
+    'PBE1': 'en_US',
+    'RU': 'ru_RU',
+    'TR1': 'tr_TR',
+}
+
+# Data Dragon serves static data images from here, unless a realm says
+# otherwise.
+_DATA_DRAGON_CDN = 'https://ddragon.leagueoflegends.com/cdn'
+
+# Realm.n keys of the data type versions for image groups whose names differ.
+# Other groups use their own name.
+_IMAGE_GROUP_DATA_TYPES = {
+    'passive': 'champion',
+    'spell': 'summoner',
+}
+
+
+def _static_data_params(request, context):
+  """Builds the query params shared by static data endpoints.
+
+  Copies whichever of locale, version and tags the request has, as not every
+  static data request has all three. Unset version and tags are left out, while
+  an empty locale is replaced by the default locale of the call's platform.
+
+  Args:
+    request: Any static data request, e.g., ListChampionsRequest.
+    context: gRPC context of the current call.
+
+  Returns:
+    Dict of query params.
+  """
+  params = {}
+  locale = getattr(request, 'locale', None)
+  if locale is not None:
+    params['locale'] = locale or _DEFAULT_LOCALES.get(
+        riot_api_lib.GetPlatformId(context).upper(), 'en_US')
+  if getattr(request, 'version', None):
+    params['version'] = request.version
+  if getattr(request, 'tags', None):
+    params['tags'] = list(request.tags)
+  if getattr(request, 'data_by_id', False):
+    params['dataById'] = 'true'
+  return params
+
+
+class StaticDataService(static_data_pb2_grpc.StaticDataServiceServicer):
+  """Static Data API."""
+
+  def BuildAssetUrl(self, version, group, full, cdn=_DATA_DRAGON_CDN):
+    """Returns the Data Dragon URL of a static data image.
+
+    Args:
+      version: Data Dragon version, e.g., "9.1.1".
+      group: Image.group, e.g., "champion", "item" or "spell".
+      full: Image.full, the image's file name, e.g., "Aatrox.png".
+      cdn: Base URL of Data Dragon.
+
+    Returns:
+      The image's URL.
+    """
+    return '%s/%s/img/%s/%s' % (cdn.rstrip('/'), version, group,
+                                parse.quote(full))
+
+  def BuildRealmAssetUrl(self, realm, image):
+    """Returns the URL of image on a realm's CDN at the realm's version.
+
+    Args:
+      realm: Realm returned by GetRealms.
+      image: Image of a champion, item, summoner spell, etc.
+
+    Returns:
+      The image's URL.
+    """
+    data_type = _IMAGE_GROUP_DATA_TYPES.get(image.group, image.group)
+    version = realm.n.get(data_type) or realm.v
+    return self.BuildAssetUrl(version, image.group, image.full,
+                              realm.cdn or _DATA_DRAGON_CDN)
+
+  def ListChampions(self, request, context):
+    return _call_riot('lol/static-data/v3/champions',
+                      _static_data_params(request, context),
+                      static_data_pb2.ListChampionsResponse(), context)
+
+  def GetChampion(self, request, context):
+    return _call_riot('lol/static-data/v3/champions/%s' % request.id,
+                      _static_data_params(request, context),
+                      static_data_pb2.Champion(), context)
+
+  def ListItems(self, request, context):
+    return _call_riot('lol/static-data/v3/items',
+                      _static_data_params(request, context),
+                      static_data_pb2.ListItemsResponse(), context)
+
+  def GetItem(self, request, context):
+    # Riot's 404 for unknown item IDs is surfaced as NOT_FOUND by _call_riot.
+    return _call_riot('lol/static-data/v3/items/%s' % request.id,
+                      _static_data_params(request, context),
+                      static_data_pb2.Item(), context)
+
+  def ListLanguageStrings(self, request, context):
+    return _call_riot('lol/static-data/v3/language-strings',
+                      _static_data_params(request, context),
+                      static_data_pb2.ListLanguageStringsResponse(), context)
+
+  def ListLanguages(self, request, context):
+    return _call_riot(
+        'lol/static-data/v3/languages', {},
+        static_data_pb2.ListLanguagesResponse(),
+        context,
+        body_transform=lambda x: '{"languages": %s }' % x)
+
+  def ListMaps(self, request, context):
+    return _call_riot('lol/static-data/v3/maps',
+                      _static_data_params(request, context),
+                      static_data_pb2.ListMapsResponse(), context)
+
+  def ListMasteries(self, request, context):
+    return _call_riot('lol/static-data/v3/masteries',
+                      _static_data_params(request, context),
+                      static_data_pb2.ListMasteriesResponse(), context)
+
+  def GetMastery(self, request, context):
+    return _call_riot('lol/static-data/v3/masteries/%s' % request.id,
+                      _static_data_params(request, context),
+                      static_data_pb2.Mastery(), context)
+
+  def ListProfileIcons(self, request, context):
+    # Icons are keyed by ID under "data", which maps directly onto the proto's
+    # map field, so unlike ListReforgedRunePaths no body transform is needed.
+    return _call_riot('lol/static-data/v3/profile-icons',
+                      _static_data_params(request, context),
+                      static_data_pb2.ListProfileIconsResponse(), context)
+
+  def GetRealms(self, request, context):
+    return _call_riot('lol/static-data/v3/realms', {}, static_data_pb2.Realm(),
+                      context)
+
+  def ListReforgedRunePaths(self, request, context):
+    return _call_riot(
+        'lol/static-data/v3/reforged-rune-paths',
+        _static_data_params(request, context),
+        static_data_pb2.ListReforgedRunePathsResponse(),
+        context,
+        body_transform=lambda x: '{"paths": %s }' % x)
+
+  def GetReforgedRune(self, request, context):
+    return _call_riot('lol/static-data/v3/reforged-runes/%s' % request.id,
+                      _static_data_params(request, context),
+                      static_data_pb2.ReforgedRune(), context)
+
+  def ListSummonerSpells(self, request, context):
+    return _call_riot('lol/static-data/v3/summoner-spells',
+                      _static_data_params(request, context),
+                      static_data_pb2.ListSummonerSpellsResponse(), context)
+
+  def GetSummonerSpell(self, request, context):
+    return _call_riot('lol/static-data/v3/summoner-spells/%s' % request.id,
+                      _static_data_params(request, context),
+                      static_data_pb2.SummonerSpell(), context)
+
+  def ListVersions(self, request, context):
+    return _call_riot(
+        'lol/static-data/v3/versions', {},
+        static_data_pb2.ListVersionsResponse(),
+        context,
+        body_transform=lambda x: '{"versions": %s }' % x)
+
+  def GetCurrentPatchVersion(self, request, context):
+    versions = self.ListVersions(static_data_pb2.ListVersionsRequest(),
+                                 context).versions
+    if not versions:
+      context.abort(grpc.StatusCode.NOT_FOUND, 'Riot returned no versions')
+    return static_data_pb2.GetCurrentPatchVersionResponse(version=versions[0])
+
+
+class SummonerCache(object):
+  """In-memory cache of summoners, by every key they can be looked up by.
+
+  Entries are only invalidated by their TTL, so a renamed summoner may still be
+  found by their old name until it expires. Encrypted IDs differ between API
+  keys, so summoners are cached separately for each key. Calls made with a
+  rotating ApiKeyPool aren't cached, since their key isn't known in advance.
+  """
+
+  def __init__(self, ttl_secs, clock=time.monotonic):
+    """Constructor.
+
+    Args:
+      ttl_secs: How long summoners are cached.
+      clock: Function returning the current time in seconds.
+    """
+    self._ttl_secs = ttl_secs
+    self._clock = clock
+    self._lock = threading.Lock()
+    # (scope, key type, key) -> (expiration time, Summoner)
+    self._entries = {}
+    self._next_sweep = clock() + ttl_secs
+
+  @staticmethod
+  def _Scope(context):
+    """Returns the scope of context's cache entries, or None to not cache."""
+    api_key = riot_api_lib.GetFixedApiKey(context)
+    if not api_key:
+      return None
+    return riot_api_lib.GetPlatformId(context), api_key
+
+  @staticmethod
+  def _Copy(summoner):
+    # Callers may modify the summoners they're given.
+    copy = summoner_pb2.Summoner()
+    copy.CopyFrom(summoner)
+    return copy
+
+  @staticmethod
+  def _Key(key_type, key):
+    if key_type == 'summoner_name':
+      key = riot_api_lib.NormalizeSummonerName(key)
+    return key_type, key
+
+  def Get(self, request, context):
+    """Returns the cached summoner for a GetSummonerRequest, or None."""
+    scope = self._Scope(context)
+    if not scope:
+      return None
+    key_type = request.WhichOneof('key')
+    entry_key = (scope,) + self._Key(key_type, getattr(request, key_type))
+    with self._lock:
+      expiration, summoner = self._entries.get(entry_key, (0, None))
+      if not summoner:
+        return None
+      if expiration <= self._clock():
+        del self._entries[entry_key]
+        return None
+    return self._Copy(summoner)
+
+  def Put(self, summoner, context):
+    """Caches summoner under each of its keys."""
+    scope = self._Scope(context)
+    if not scope:
+      return
+    keys = [
+        self._Key('encrypted_summoner_id', summoner.id),
+        self._Key('encrypted_account_id', summoner.account_id),
+        self._Key('encrypted_puuid', summoner.puuid),
+        self._Key('summoner_name', summoner.name),
+    ]
+    summoner = self._Copy(summoner)
+    now = self._clock()
+    with self._lock:
+      if now >= self._next_sweep:
+        self._entries = {
+            key: entry
+            for key, entry in self._entries.items()
+            if entry[0] > now
+        }
+        self._next_sweep = now + self._ttl_secs
+      for key_type, key in keys:
+        if key:
+          self._entries[(scope, key_type, key)] = (now + self._ttl_secs,
+                                                   summoner)
 
 
 class SummonerService(summoner_pb2_grpc.SummonerServiceServicer):
   """Summoner API."""
 
-  def GetSummoner(self, request, context):
+  def __init__(self, cache=None):
+    """Constructor.
+
+    Args:
+      cache: SummonerCache for GetSummoner and ListSummoners. Summoners are
+        never cached if None.
+    """
+    self._cache = cache
+
+  def _GetSummonerEndpoint(self, request):
+    """Returns the Riot endpoint for a GetSummonerRequest.
+
+    Raises:
+      riot_api_lib.InvalidRequestError: If request has no key.
+    """
     endpoint = 'lol/summoner/v4/summoners'
     key_type = request.WhichOneof('key')
+    if not key_type:
+      raise riot_api_lib.InvalidRequestError('GetSummoner: no key specified')
+    key = getattr(request, key_type)
+    if key_type == 'summoner_name':
+      key = riot_api_lib.NormalizeSummonerName(key)
+    if not key:
+      raise riot_api_lib.InvalidRequestError(
+          'GetSummonerRequest is missing required fields: %s' % key_type)
     if key_type == 'encrypted_summoner_id':
       endpoint += '/%s' % request.encrypted_summoner_id
     elif key_type == 'encrypted_account_id':
       endpoint += '/by-account/%s' % request.encrypted_account_id
     elif key_type == 'summoner_name':
-      endpoint += '/by-name/%s' % request.summoner_name
+      endpoint += '/by-name/%s' % parse.quote(key, safe='')
     elif key_type == 'encrypted_puuid':
-      endpoint += '/by-puuid/%s' % request.encrypted_puuid
-    else:
-      raise ValueError('GetSummoner: no key specified')
-    return _call_riot(endpoint, {}, summoner_pb2.Summoner(),
-                      context.invocation_metadata())
+      endpoint += '/by-puuid/%s' % parse.quote(request.encrypted_puuid, safe='')
+    return endpoint
+
+  def _GetCachedSummoner(self, request, context, fetch):
+    """Returns the summoner for request from the cache, else from fetch.
+
+    Args:
+      request: A valid GetSummonerRequest.
+      context: gRPC context of the current call.
+      fetch: Function returning the summoner from Riot.
+    """
+    if self._cache:
+      summoner = self._cache.Get(request, context)
+      if summoner:
+        return summoner
+    summoner = fetch()
+    if self._cache:
+      self._cache.Put(summoner, context)
+    return summoner
+
+  def GetSummoner(self, request, context):
+    try:
+      endpoint = self._GetSummonerEndpoint(request)
+    except riot_api_lib.Error as e:
+      context.abort(e.code, str(e))
+    return self._GetCachedSummoner(
+        request, context,
+        lambda: _call_riot(endpoint, {}, summoner_pb2.Summoner(), context))
+
+  def ListSummoners(self, request, context):
+
+    def _GetSummonerOrError(key):
+      try:
+        endpoint = self._GetSummonerEndpoint(key)
+        summoner = self._GetCachedSummoner(
+            key, context, lambda: riot_api_lib.CallRiotWithRetry(
+                context,
+                endpoint,
+                {},
+                summoner_pb2.Summoner(),
+                max_attempts=_RATE_LIMITED_MAX_ATTEMPTS))
+        return summoner, summoner_pb2.SummonerError()
+      except riot_api_lib.Error as e:
+        return summoner_pb2.Summoner(), summoner_pb2.SummonerError(
+            code=e.code.value[0], message=str(e))
+
+    try:
+      results = riot_api_lib.FanOut(context, _GetSummonerOrError, request.keys)
+    except riot_api_lib.Error as e:
+      context.abort(e.code, str(e))
+    response = summoner_pb2.ListSummonersResponse()
+    for summoner, error in results:
+      response.summoners.add().CopyFrom(summoner)
+      response.errors.add().CopyFrom(error)
+    return response
+
+  def TranslateLegacyId(self, request, context):
+    legacy_id = request.WhichOneof('legacy_id')
+    if not legacy_id:
+      context.abort(grpc.StatusCode.INVALID_ARGUMENT,
+                    'TranslateLegacyId: no legacy ID specified')
+    response = summoner_pb2.TranslateLegacyIdResponse(
+        summoner=self.GetSummoner(request.lookup, context))
+    setattr(response, legacy_id, getattr(request, legacy_id))
+    return response
 
 
 class LeagueService(league_pb2_grpc.LeagueServiceServicer):
   """League API."""
 
   def ListLeaguePositions(self, request, context):
-    endpoint = ('lol/league/v4/entries/by-summoner/%s' %
-                request.encrypted_summoner_id)
+    _RequireFields(request, context, 'encrypted_summoner_id')
+    endpoint = 'lol/league/v4/entries/by-summoner/%s' % parse.quote(
+        request.encrypted_summoner_id, safe='')
     return _call_riot(
         endpoint, {},
         league_pb2.ListLeaguePositionsResponse(),
-        context.invocation_metadata(),
-        body_transform=lambda x: '{"positions": %s }' % x)
+        context,
+        body_transform=lambda x: '{"positions": %s }' % x,
+        empty_on_not_found=request.treat_404_as_empty)
+
+  def _GetLeagueEndpoint(self, league_id):
+    return 'lol/league/v4/leagues/%s' % league_id
+
+  def GetLeague(self, request, context):
+    _RequireFields(request, context, 'league_id')
+    return _call_riot(
+        self._GetLeagueEndpoint(request.league_id), {},
+        league_pb2.LeagueList(), context)
+
+  def GetLeagueEntriesBySummoner(self, request, context):
+    _RequireFields(request, context, 'encrypted_summoner_id')
+    positions = self.ListLeaguePositions(
+        league_pb2.ListLeaguePositionsRequest(
+            encrypted_summoner_id=request.encrypted_summoner_id), context)
+    response = league_pb2.GetLeagueEntriesBySummonerResponse()
+    for position in positions.positions:
+      response.entries.add(position=position)
+    if request.hydrate_leagues:
+      hydrated_entries = [
+          entry for entry in response.entries if entry.position.league_id
+      ]
+
+      # Workers can't abort the call, so failures are returned to abort here.
+      def _GetLeagueOrError(entry):
+        try:
+          return riot_api_lib.CallRiotWithRetry(
+              context, self._GetLeagueEndpoint(entry.position.league_id), {},
+              league_pb2.LeagueList()), None
+        except riot_api_lib.Error as e:
+          return None, e
+
+      try:
+        results = riot_api_lib.FanOut(context, _GetLeagueOrError,
+                                      hydrated_entries)
+      except riot_api_lib.Error as e:
+        context.abort(e.code, str(e))
+      for entry, (league, error) in zip(hydrated_entries, results):
+        if error:
+          context.abort(error.code, str(error))
+        entry.league.CopyFrom(league)
+    return response
+
+  def _GetApexLeague(self, tier, request, context):
+    _RequireRankedQueue(request.queue, context)
+    endpoint = 'lol/league/v4/%sleagues/by-queue/%s' % (
+        tier, constants_pb2.QueueType.Enum.Name(request.queue))
+    return _call_riot(endpoint, {}, league_pb2.LeagueList(), context)
+
+  def GetChallengerLeague(self, request, context):
+    return self._GetApexLeague('challenger', request, context)
+
+  def GetGrandmasterLeague(self, request, context):
+    return self._GetApexLeague('grandmaster', request, context)
+
+  def GetMasterLeague(self, request, context):
+    return self._GetApexLeague('master', request, context)
+
+  def StreamLeagueEntries(self, request, context):
+    """Streams the entries of each apex league, one league at a time.
+
+    Apex leagues hold thousands of entries, so streaming them avoids building
+    one huge response.
+
+    Args:
+      request: GetApexLeagueRequest.
+      context: gRPC context of the current call.
+
+    Yields:
+      LeagueItems of the challenger, grandmaster and master leagues.
+    """
+    for tier in ('challenger', 'grandmaster', 'master'):
+      if not context.is_active():
+        return
+      league = self._GetApexLeague(tier, request, context)
+      for entry in league.entries:
+        yield entry
+
+
+class ThirdPartyCodeService(
+    third_party_code_pb2_grpc.ThirdPartyCodeServiceServicer):
+  """Third Party Code API."""
+
+  def GetThirdPartyCode(self, request, context):
+    endpoint = ('lol/platform/v3/third-party-code/by-summoner/%s' %
+                request.summoner_id)
+    # The code is returned as a bare JSON string.
+    return _call_riot(
+        endpoint, {},
+        third_party_code_pb2.ThirdPartyCode(),
+        context,
+        body_transform=lambda x: '{"code": %s }' % x)
+
+
+def _TournamentRoute(unused_context):
+  """The tournament API is only served from the americas cluster."""
+  return 'americas'
+
+
+class _TournamentMethods(object):
+  """RPCs shared by the tournament API and its stub.
+
+  Subclasses set _ENDPOINT_PREFIX to the API's path.
+  """
+  _ENDPOINT_PREFIX = None
+
+  def _CallTournament(self, path, params, message, context, **kwargs):
+    return _call_riot(
+        '%s/%s' % (self._ENDPOINT_PREFIX, path),
+        params,
+        message,
+        context,
+        route_fn=_TournamentRoute,
+        **kwargs)
+
+  def RegisterProvider(self, request, context):
+    return self._CallTournament(
+        'providers', {},
+        tournament_pb2.RegisterProviderResponse(),
+        context,
+        body_transform=lambda x: '{"providerId": %s }' % x,
+        request_body=request)
+
+  def RegisterTournament(self, request, context):
+    return self._CallTournament(
+        'tournaments', {},
+        tournament_pb2.RegisterTournamentResponse(),
+        context,
+        body_transform=lambda x: '{"tournamentId": %s }' % x,
+        request_body=request)
+
+  def CreateTournamentCodes(self, request, context):
+    params = {'tournamentId': request.tournament_id}
+    if request.count:
+      params['count'] = request.count
+    return self._CallTournament(
+        'codes',
+        params,
+        tournament_pb2.CreateTournamentCodesResponse(),
+        context,
+        body_transform=lambda x: '{"codes": %s }' % x,
+        request_body=request.parameters)
+
+
+class TournamentService(_TournamentMethods,
+                        tournament_pb2_grpc.TournamentServiceServicer):
+  """Tournament API."""
+  _ENDPOINT_PREFIX = 'lol/tournament/v3'
+
+
+class TournamentStubService(
+    _TournamentMethods, tournament_stub_pb2_grpc.TournamentStubServiceServicer):
+  """Tournament stub API, for development without a tournament API key."""
+  _ENDPOINT_PREFIX = 'lol/tournament-stub/v3'
+
+  def ListLobbyEvents(self, request, context):
+    return self._CallTournament(
+        'lobby-events/by-code/%s' %
+        parse.quote(request.tournament_code, safe=''), {},
+        tournament_stub_pb2.LobbyEvents(), context)
+
+
+# (pb2 module, service name) of every Riot service served.
+_SERVICES = (
+    (account_pb2, 'AccountService'),
+    (champion_pb2, 'ChampionService'),
+    (champion_mastery_pb2, 'ChampionMasteryService'),
+    (clash_pb2, 'ClashService'),
+    (league_pb2, 'LeagueService'),
+    (lol_status_pb2, 'LoLStatusService'),
+    (match_pb2, 'MatchService'),
+    (spectator_pb2, 'SpectatorService'),
+    (static_data_pb2, 'StaticDataService'),
+    (summoner_pb2, 'SummonerService'),
+    (third_party_code_pb2, 'ThirdPartyCodeService'),
+    (tournament_pb2, 'TournamentService'),
+)
+
+
+def _ReadFile(path):
+  with open(path, 'rb') as f:
+    return f.read()
+
+
+class RiotHealthCheck(object):
+  """Sets the health of the server's services by calling Riot.
+
+  Riot is probed with LoLStatusService.GetShardData, which is cheap and, unlike
+  static data, is never cached, so each probe reaches Riot.
+  """
+
+  def __init__(self, health_servicer, service_names, lol_status_service=None):
+    """Constructor.
+
+    Args:
+      health_servicer: grpc_health HealthServicer to set statuses on.
+      service_names: Full names of the services whose status is set.
+      lol_status_service: LoLStatusService used to probe Riot. Defaults to a
+        new LoLStatusService.
+    """
+    self._health_servicer = health_servicer
+    self._service_names = service_names
+    self._lol_status_service = lol_status_service or LoLStatusService()
+
+  def Check(self):
+    """Probes Riot and sets every service's status accordingly.
+
+    Returns:
+      Whether Riot was reachable with the server's API key.
+    """
+    try:
+      self._lol_status_service.GetShardData(
+          lol_status_pb2.GetShardDataRequest(),
+          riot_api_lib.BackgroundContext())
+      healthy = True
+    except riot_api_lib.Error as e:
+      logging.warning('Riot health check failed: %s', e)
+      healthy = False
+    status = (
+        health_pb2.HealthCheckResponse.SERVING
+        if healthy else health_pb2.HealthCheckResponse.NOT_SERVING)
+    for service_name in self._service_names:
+      self._health_servicer.set(service_name, status)
+    return healthy
+
+  def Start(self, interval_secs):
+    """Checks Riot every interval_secs in the background."""
+
+    def _Run():
+      while True:
+        time.sleep(interval_secs)
+        try:
+          self.Check()
+        except Exception:  # pylint: disable=broad-except
+          # Keep probing rather than leave the status stuck at its last value.
+          logging.exception('Riot health check raised')
+
+    threading.Thread(target=_Run, daemon=True).start()
+
+
+def GetServerCredentials(cert_path, key_path, client_ca_path):
+  """Builds TLS credentials for the server.
+
+  Args:
+    cert_path: Path to the PEM encoded certificate chain, or None.
+    key_path: Path to the PEM encoded private key, or None.
+    client_ca_path: Path to PEM encoded CA certificates used to verify client
+      certificates, or None to not require client certificates.
+
+  Returns:
+    grpc.ServerCredentials, or None if no certificate was given, in which case
+    the server should use plaintext.
+
+  Raises:
+    app.UsageError: If only some of the required paths are given.
+  """
+  if not cert_path and not key_path:
+    if client_ca_path:
+      raise app.UsageError('--client_ca requires --tls_cert and --tls_key.')
+    return None
+  if not cert_path or not key_path:
+    raise app.UsageError('--tls_cert and --tls_key must be set together.')
+  root_certificates = _ReadFile(client_ca_path) if client_ca_path else None
+  return grpc.ssl_server_credentials(
+      [(_ReadFile(key_path), _ReadFile(cert_path))],
+      root_certificates=root_certificates,
+      require_client_auth=root_certificates is not None)
+
+
+def GetServerOptions(max_recv_msg_size, max_send_msg_size):
+  """Returns the grpc.server options for the message size limits.
+
+  Args:
+    max_recv_msg_size: Largest request to accept, in bytes. -1 means no limit.
+    max_send_msg_size: Largest response to send, in bytes. -1 means no limit.
+  """
+  return [
+      ('grpc.max_receive_message_length', max_recv_msg_size),
+      ('grpc.max_send_message_length', max_send_msg_size),
+  ]
+
+
+def ParseMethodTimeouts(values):
+  """Parses --method_timeout values into a dict for SetMethodTimeouts.
+
+  Args:
+    values: List of method=seconds strings.
+
+  Returns:
+    Dict from method name to timeout in seconds, or None for 0.
+
+  Raises:
+    app.UsageError: If a value is malformed.
+  """
+  method_timeouts = {}
+  for value in values or []:
+    method, _, timeout_secs = value.partition('=')
+    try:
+      timeout_secs = float(timeout_secs)
+    except ValueError:
+      timeout_secs = -1
+    if not method or timeout_secs < 0:
+      raise app.UsageError(
+          '--method_timeout must be method=seconds, got: %s' % value)
+    method_timeouts[method] = timeout_secs or None
+  return method_timeouts
+
+
+def _LoadApiKeys(flag_keys, required):
+  """Returns the server's own Riot API keys, for its ApiKeyPool.
+
+  Args:
+    flag_keys: --riot_api_key values. If set, RIOT_API_KEY is ignored.
+    required: Whether it's an error for there to be no keys.
+
+  Returns:
+    List of keys, from flag_keys or the comma separated RIOT_API_KEY environment
+    variable, without empty entries. Empty if neither has a key.
+
+  Raises:
+    app.UsageError: If required, but no key was found.
+  """
+  api_keys = [
+      key for key in flag_keys or os.environ.get('RIOT_API_KEY', '').split(',')
+      if key
+  ]
+  if required and not api_keys:
+    raise app.UsageError(
+        '--riot_health_check_interval_secs requires the server\'s own Riot API '
+        'key, from --riot_api_key or RIOT_API_KEY.')
+  return api_keys
+
+
+def _ConfigureTracing():
+  tracer_provider = sdk_trace.TracerProvider(
+      resource=resources.Resource.create({'service.name': 'riot_api_server'}))
+  tracer_provider.add_span_processor(
+      trace_export.BatchSpanProcessor(
+          trace_exporter.OTLPSpanExporter(endpoint=FLAGS.otlp_endpoint)))
+  trace.set_tracer_provider(tracer_provider)
 
 
 def main(argv):
   if len(argv) > 1:
     raise app.UsageError('Too many command-line arguments.')
-  server = grpc.server(concurrent.futures.ThreadPoolExecutor(max_workers=10))
+  credentials = GetServerCredentials(FLAGS.tls_cert, FLAGS.tls_key,
+                                     FLAGS.client_ca)
+  if (FLAGS.gateway_addr and
+      not riot_gateway_lib.IsLoopbackAddress(FLAGS.gateway_addr)):
+    raise app.UsageError(
+        '--gateway_addr must be a loopback address, e.g., localhost:8080, as '
+        'the gateway has no TLS or authentication.')
+  if FLAGS.rate_limit_mode != 'off':
+    riot_api_lib.SetRateLimiter(
+        riot_api_lib.RateLimiter(
+            block=FLAGS.rate_limit_mode == 'block',
+            default_windows=riot_api_lib.KEY_TIER_RATE_LIMITS[FLAGS.key_tier]))
+  api_keys = _LoadApiKeys(FLAGS.riot_api_key,
+                          FLAGS.riot_health_check_interval_secs > 0)
+  if api_keys:
+    riot_api_lib.SetApiKeyPool(riot_api_lib.ApiKeyPool(api_keys))
+  riot_api_lib.SetDefaultPlatformId(
+      platform_pb2.PlatformId.Value(FLAGS.default_platform))
+  riot_api_lib.SetUserAgent(FLAGS.user_agent)
+  riot_api_lib.SetStrictParsing(FLAGS.strict_response_parsing)
+  if FLAGS.server_error_max_attempts > 1:
+    riot_api_lib.SetRetryPolicy(
+        riot_api_lib.RetryPolicy(
+            max_attempts=FLAGS.server_error_max_attempts,
+            base_delay_secs=FLAGS.server_error_base_delay_secs))
+  if FLAGS.retry_budget_max_tokens > 0:
+    riot_api_lib.SetRetryBudget(
+        riot_api_lib.RetryBudget(FLAGS.retry_budget_max_tokens,
+                                 FLAGS.retry_budget_token_ratio))
+  if FLAGS.riot_timeout > 0:
+    riot_api_lib.SetRequestTimeout(FLAGS.riot_timeout)
+  riot_api_lib.SetMethodTimeouts(ParseMethodTimeouts(FLAGS.method_timeout))
+  if FLAGS.connect_timeout > 0:
+    riot_api_lib.SetConnectTimeout(FLAGS.connect_timeout)
+  # Middleware wrapping every request to Riot, outermost first, e.g., for
+  # logging or fault injection. Retries, rate limiting and caching are done by
+  # riot_api_lib before a request reaches the session, so none is needed here.
+  middlewares = []
+  riot_api_lib.SetHttpSession(
+      riot_api_lib.NewHttpSession(FLAGS.max_idle_conns_per_host, middlewares))
+  riot_api_lib.SetMaxResponseBytes(FLAGS.max_response_bytes,
+                                   FLAGS.max_large_response_bytes)
+  riot_api_lib.SetFanOutConcurrency(FLAGS.fan_out_concurrency)
+  if FLAGS.static_data_cache_ttl_secs > 0:
+    riot_api_lib.SetResponseCache(
+        riot_api_lib.ResponseCache(FLAGS.static_data_cache_ttl_secs))
+  if FLAGS.etag_store_size > 0:
+    riot_api_lib.SetETagStore(
+        riot_api_lib.InMemoryETagStore(FLAGS.etag_store_size))
+  if FLAGS.trace_exporter == 'otlp':
+    _ConfigureTracing()
+  # Shared with the REST gateway, whose calls have no gRPC context to trace.
+  interceptors = [
+      RequestIdInterceptor(),
+      LoggingInterceptor(),
+      MetricsInterceptor(),
+  ]
+  server = grpc.server(
+      concurrent.futures.ThreadPoolExecutor(max_workers=_SERVER_WORKERS),
+      interceptors=[otel_grpc.server_interceptor()] + interceptors,
+      options=GetServerOptions(FLAGS.max_recv_msg_size,
+                               FLAGS.max_send_msg_size))
+  # Shared with the REST gateway and other services.
+  match_service = MatchService()
+  static_data_service = StaticDataService()
+  summoner_cache = None
+  if FLAGS.summoner_cache_ttl_secs > 0:
+    summoner_cache = SummonerCache(FLAGS.summoner_cache_ttl_secs)
+  summoner_service = SummonerService(summoner_cache)
+  account_pb2_grpc.add_AccountServiceServicer_to_server(AccountService(),
+                                                        server)
+  champion_pb2_grpc.add_ChampionServiceServicer_to_server(
+      ChampionService(), server)
   champion_mastery_pb2_grpc.add_ChampionMasteryServiceServicer_to_server(
-      ChampionMasteryService(), server)
+      ChampionMasteryService(static_data_service), server)
+  clash_pb2_grpc.add_ClashServiceServicer_to_server(ClashService(), server)
   league_pb2_grpc.add_LeagueServiceServicer_to_server(LeagueService(), server)
-  match_pb2_grpc.add_MatchServiceServicer_to_server(MatchService(), server)
+  lol_status_pb2_grpc.add_LoLStatusServiceServicer_to_server(
+      LoLStatusService(), server)
+  match_pb2_grpc.add_MatchServiceServicer_to_server(match_service, server)
+  spectator_pb2_grpc.add_SpectatorServiceServicer_to_server(
+      SpectatorService(summoner_service), server)
+  static_data_pb2_grpc.add_StaticDataServiceServicer_to_server(
+      static_data_service, server)
   summoner_pb2_grpc.add_SummonerServiceServicer_to_server(
-      SummonerService(), server)
+      summoner_service, server)
+  third_party_code_pb2_grpc.add_ThirdPartyCodeServiceServicer_to_server(
+      ThirdPartyCodeService(), server)
+  tournament_pb2_grpc.add_TournamentServiceServicer_to_server(
+      TournamentService(), server)
+  services = list(_SERVICES)
+  if FLAGS.enable_tournament_stub:
+    tournament_stub_pb2_grpc.add_TournamentStubServiceServicer_to_server(
+        TournamentStubService(), server)
+    services.append((tournament_stub_pb2, 'TournamentStubService'))
+  service_names = [
+      pb2.DESCRIPTOR.services_by_name[name].full_name for pb2, name in services
+  ]
+  health_servicer = health.HealthServicer()
+  health_pb2_grpc.add_HealthServicer_to_server(health_servicer, server)
+  if FLAGS.enable_reflection:
+    reflection.enable_server_reflection(
+        service_names + [health.SERVICE_NAME, reflection.SERVICE_NAME], server)
+  if FLAGS.metrics_addr:
+    logging.info('Serving metrics at %s', FLAGS.metrics_addr)
+    riot_metrics_lib.StartServer(
+        FLAGS.metrics_addr,
+        debug_handlers={'/debug/ratelimits': riot_api_lib.GetRateLimitState})
+  if FLAGS.gateway_addr:
+    logging.info('Serving REST gateway at %s', FLAGS.gateway_addr)
+    riot_gateway_lib.StartServer(
+        FLAGS.gateway_addr,
+        riot_gateway_lib.Gateway(
+            riot_gateway_lib.SummonerRoutes(summoner_service) +
+            riot_gateway_lib.MatchRoutes(match_service),
+            interceptors=interceptors,
+            deadline_secs=FLAGS.gateway_deadline_secs or None))
   authority = '%s:%s' % (FLAGS.host, FLAGS.port)
-  logging.info('Starting server at %s', authority)
-  server.add_insecure_port(authority)
+  if credentials:
+    logging.info('Starting server at %s with TLS%s', authority,
+                  ' and client authentication' if FLAGS.client_ca else '')
+    server.add_secure_port(authority, credentials)
+  else:
+    logging.info('Starting server at %s', authority)
+    server.add_insecure_port(authority)
   server.start()
+  if FLAGS.riot_health_check_interval_secs > 0:
+    health_check = RiotHealthCheck(health_servicer,
+                                   service_names + [health.OVERALL_HEALTH])
+    if not health_check.Check():
+      logging.error('Riot can\'t be called; check the Riot API key')
+    health_check.Start(FLAGS.riot_health_check_interval_secs)
+  else:
+    for service_name in service_names + [health.OVERALL_HEALTH]:
+      health_servicer.set(service_name, health_pb2.HealthCheckResponse.SERVING)
+
+  def _Shutdown(signum, unused_frame):
+    logging.info('Received signal %d, shutting down', signum)
+    # Tell load balancers to stop sending traffic while in-flight calls finish.
+    health_servicer.enter_graceful_shutdown()
+    server.stop(FLAGS.shutdown_grace_secs)
+
+  signal.signal(signal.SIGTERM, _Shutdown)
   server.wait_for_termination()
 
 
@@ -0,0 +1,2959 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Tests for riot_api_server."""
+
+from concurrent import futures
+from http import server as http_server
+import json
+import os
+import tempfile
+import threading
+import unittest
+from unittest import mock
+from urllib import parse
+
+from absl import app
+import grpc
+from grpc_health.v1 import health_pb2
+import prometheus_client
+import requests
+
+from hypebot.protos.riot.v1 import account_pb2
+from hypebot.protos.riot.v1 import clash_pb2
+from hypebot.protos.riot.v3 import champion_pb2
+from hypebot.protos.riot.v3 import lol_status_pb2
+from hypebot.protos.riot.v3 import static_data_pb2
+from hypebot.protos.riot.v3 import third_party_code_pb2
+from hypebot.protos.riot.v3 import tournament_pb2
+from hypebot.protos.riot.v3 import tournament_stub_pb2
+from hypebot.protos.riot.v4 import champion_mastery_pb2
+from hypebot.protos.riot.v4 import constants_pb2
+from hypebot.protos.riot.v4 import league_pb2
+from hypebot.protos.riot.v4 import match_pb2
+from hypebot.protos.riot.v4 import match_pb2_grpc
+from hypebot.protos.riot.v4 import spectator_pb2
+from hypebot.protos.riot.v4 import summoner_pb2
+from riot import riot_api_lib
+from riot import riot_api_server
+from riot import riot_metrics_lib
+from riot import riottest
+
+
+class GetServerCredentialsTest(unittest.TestCase):
+
+  def setUp(self):
+    super(GetServerCredentialsTest, self).setUp()
+    tmp_dir = tempfile.TemporaryDirectory()
+    self.addCleanup(tmp_dir.cleanup)
+    self.paths = {}
+    for name in ('cert', 'key', 'ca'):
+      self.paths[name] = os.path.join(tmp_dir.name, name + '.pem')
+      with open(self.paths[name], 'w') as f:
+        f.write(name)
+
+  @mock.patch.object(grpc, 'ssl_server_credentials')
+  def test_tls(self, mock_credentials):
+    riot_api_server.GetServerCredentials(self.paths['cert'], self.paths['key'],
+                                         None)
+    mock_credentials.assert_called_once_with([(b'key', b'cert')],
+                                             root_certificates=None,
+                                             require_client_auth=False)
+
+  @mock.patch.object(grpc, 'ssl_server_credentials')
+  def test_mtls(self, mock_credentials):
+    riot_api_server.GetServerCredentials(self.paths['cert'], self.paths['key'],
+                                         self.paths['ca'])
+    mock_credentials.assert_called_once_with([(b'key', b'cert')],
+                                             root_certificates=b'ca',
+                                             require_client_auth=True)
+
+  def test_plaintext(self):
+    self.assertIsNone(riot_api_server.GetServerCredentials(None, None, None))
+
+  def test_incomplete_flags(self):
+    for cert, key, ca in ((self.paths['cert'], None, None),
+                          (None, self.paths['key'], None),
+                          (None, None, self.paths['ca'])):
+      with self.assertRaises(app.UsageError):
+        riot_api_server.GetServerCredentials(cert, key, ca)
+
+
+class ParseMethodTimeoutsTest(unittest.TestCase):
+
+  def test_parse(self):
+    self.assertEqual(
+        {
+            'GetMatch': 30,
+            '/hypebot.riot.v4.SummonerService/GetSummoner': 1.5,
+            'ListChampions': None,
+        },
+        riot_api_server.ParseMethodTimeouts([
+            'GetMatch=30', '/hypebot.riot.v4.SummonerService/GetSummoner=1.5',
+            'ListChampions=0'
+        ]))
+    self.assertEqual({}, riot_api_server.ParseMethodTimeouts(None))
+
+  def test_malformed(self):
+    for value in ('GetMatch', 'GetMatch=', '=30', 'GetMatch=30s',
+                  'GetMatch=-1'):
+      with self.subTest(value=value):
+        with self.assertRaises(app.UsageError):
+          riot_api_server.ParseMethodTimeouts([value])
+
+
+class LoadApiKeysTest(unittest.TestCase):
+
+  def setUp(self):
+    super(LoadApiKeysTest, self).setUp()
+    patcher = mock.patch.dict(os.environ, {'RIOT_API_KEY': 'env-1,,env-2,'})
+    patcher.start()
+    self.addCleanup(patcher.stop)
+
+  def test_flag_over_env(self):
+    self.assertEqual(['flag-1', 'flag-2'],
+                     riot_api_server._LoadApiKeys(['flag-1', '', 'flag-2'],
+                                                  True))
+
+  def test_env_is_comma_separated(self):
+    self.assertEqual(['env-1', 'env-2'],
+                     riot_api_server._LoadApiKeys(None, True))
+
+  def test_no_key(self):
+    os.environ['RIOT_API_KEY'] = ','
+
+    self.assertEqual([], riot_api_server._LoadApiKeys(None, False))
+    with self.assertRaises(app.UsageError):
+      riot_api_server._LoadApiKeys([''], True)
+
+
+class MessageSizeTest(unittest.TestCase):
+  """Serves a match larger than gRPC's default 4MB limit over a real channel."""
+
+  def setUp(self):
+    super(MessageSizeTest, self).setUp()
+    # Long enough that the match is about 6MB.
+    riottest.PatchRequestsGet(
+        self, {
+            '/lol/match/v4/matches/1':
+                riottest.Response({
+                    'gameId': 1,
+                    'participantIdentities': [{
+                        'participantId': i,
+                        'player': {
+                            'matchHistoryUri': '/%d/' % i + 'x' * 100000
+                        }
+                    } for i in range(60)]
+                })
+        })
+    riot_api_lib.SetMaxResponseBytes(64 * 1024 * 1024, 64 * 1024 * 1024)
+    self.addCleanup(riot_api_lib.SetMaxResponseBytes, 4 * 1024 * 1024,
+                    32 * 1024 * 1024)
+
+  def _GetMatch(self, max_send_msg_size):
+    server = grpc.server(
+        futures.ThreadPoolExecutor(max_workers=1),
+        options=riot_api_server.GetServerOptions(4 * 1024 * 1024,
+                                                 max_send_msg_size))
+    match_pb2_grpc.add_MatchServiceServicer_to_server(
+        riot_api_server.MatchService(), server)
+    port = server.add_insecure_port('localhost:0')
+    server.start()
+    self.addCleanup(server.stop, None)
+    channel = grpc.insecure_channel(
+        'localhost:%d' % port,
+        options=[('grpc.max_receive_message_length', -1)])
+    self.addCleanup(channel.close)
+    return match_pb2_grpc.MatchServiceStub(channel).GetMatch(
+        match_pb2.GetMatchRequest(game_id=1),
+        metadata=(('api-key', 'test-key'),))
+
+  def test_large_match(self):
+    match = self._GetMatch(max_send_msg_size=16 * 1024 * 1024)
+
+    self.assertGreater(match.ByteSize(), 4 * 1024 * 1024)
+    self.assertEqual(60, len(match.participant_identities))
+
+  def test_match_over_send_limit(self):
+    with self.assertRaises(grpc.RpcError) as cm:
+      self._GetMatch(max_send_msg_size=4 * 1024 * 1024)
+    self.assertEqual(grpc.StatusCode.RESOURCE_EXHAUSTED, cm.exception.code())
+
+
+class CassetteTest(unittest.TestCase):
+  """Replays responses recorded from Riot by riottest.UseCassette."""
+
+  def test_get_summoner(self):
+    context = riottest.UseCassette(self, 'get_summoner')
+
+    summoner = riot_api_server.SummonerService().GetSummoner(
+        summoner_pb2.GetSummonerRequest(summoner_name='Hype Bot'), context)
+
+    self.assertEqual('Hype Bot', summoner.name)
+    self.assertEqual(127, summoner.summoner_level)
+    self.assertEqual(4568, summoner.profile_icon_id)
+    self.assertTrue(summoner.puuid)
+
+
+class LeagueServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(LeagueServiceTest, self).setUp()
+    self.service = riot_api_server.LeagueService()
+    self.context = riottest.FakeContext()
+    patcher = mock.patch.object(requests, 'get')
+    self.mock_get = patcher.start()
+    self.addCleanup(patcher.stop)
+
+  def _LeagueListJson(self, tier):
+    return {
+        'leagueId': 'league-id',
+        'tier': tier,
+        'queue': 'RANKED_SOLO_5x5',
+        'name': "Nunu's Nightblades",
+        'entries': [{
+            'summonerId': 'summoner-id',
+            'summonerName': 'Hide on bush',
+            'leaguePoints': 1234,
+            'rank': 'I',
+            'wins': 100,
+            'losses': 50,
+            'hotStreak': True,
+        }],
+    }
+
+  def _AssertApexLeague(self, method, tier, expected_tier):
+    self.mock_get.return_value = riottest.MakeResponse(
+        self._LeagueListJson(tier))
+    request = league_pb2.GetApexLeagueRequest(
+        queue=constants_pb2.QueueType.RANKED_SOLO_5x5)
+
+    league = method(request, self.context)
+
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/league/v4/%sleagues/by-queue/'
+        'RANKED_SOLO_5x5' % tier.lower(), self.mock_get.call_args[0][0])
+    self.assertEqual(expected_tier, league.tier)
+    self.assertEqual(1, len(league.entries))
+    self.assertEqual('Hide on bush', league.entries[0].summoner_name)
+    self.assertEqual(1234, league.entries[0].league_points)
+    self.assertEqual(league_pb2.TierRank.I, league.entries[0].rank)
+
+  def test_get_challenger_league(self):
+    self._AssertApexLeague(self.service.GetChallengerLeague, 'CHALLENGER',
+                           constants_pb2.Tier.CHALLENGER)
+
+  def test_get_grandmaster_league(self):
+    self._AssertApexLeague(self.service.GetGrandmasterLeague, 'GRANDMASTER',
+                           constants_pb2.Tier.GRANDMASTER)
+
+  def test_get_master_league(self):
+    self._AssertApexLeague(self.service.GetMasterLeague, 'MASTER',
+                           constants_pb2.Tier.MASTER)
+
+  def test_list_league_positions_not_found(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        {'status': {
+            'message': 'Data not found',
+            'status_code': 404
+        }}, status_code=404)
+
+    with self.assertRaises(riottest.AbortError):
+      self.service.ListLeaguePositions(
+          league_pb2.ListLeaguePositionsRequest(
+              encrypted_summoner_id='summoner-id'), self.context)
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+  def test_list_league_positions_treat_404_as_empty(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        {'status': {
+            'message': 'Data not found',
+            'status_code': 404
+        }}, status_code=404)
+
+    response = self.service.ListLeaguePositions(
+        league_pb2.ListLeaguePositionsRequest(
+            encrypted_summoner_id='summoner-id', treat_404_as_empty=True),
+        self.context)
+
+    self.assertEqual(league_pb2.ListLeaguePositionsResponse(), response)
+    self.assertIsNone(self.context.code)
+
+  def test_list_league_positions_treat_404_as_empty_other_errors(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        {'status': {
+            'message': 'Forbidden',
+            'status_code': 403
+        }}, status_code=403)
+
+    with self.assertRaises(riottest.AbortError):
+      self.service.ListLeaguePositions(
+          league_pb2.ListLeaguePositionsRequest(
+              encrypted_summoner_id='summoner-id', treat_404_as_empty=True),
+          self.context)
+    self.assertEqual(grpc.StatusCode.PERMISSION_DENIED, self.context.code)
+
+  def test_apex_league_error_aborts(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        {'status': {
+            'message': 'Forbidden',
+            'status_code': 403
+        }}, status_code=403)
+
+    with self.assertRaises(riottest.AbortError):
+      self.service.GetChallengerLeague(
+          league_pb2.GetApexLeagueRequest(
+              queue=constants_pb2.QueueType.RANKED_SOLO_5x5), self.context)
+    self.assertEqual(grpc.StatusCode.PERMISSION_DENIED, self.context.code)
+
+  def test_apex_league_queues(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        self._LeagueListJson('CHALLENGER'))
+    for queue in ('RANKED_SOLO_5x5', 'RANKED_FLEX_SR', 'RANKED_FLEX_TT'):
+      with self.subTest(queue=queue):
+        self.service.GetChallengerLeague(
+            league_pb2.GetApexLeagueRequest(
+                queue=constants_pb2.QueueType.Enum.Value(queue)), self.context)
+
+        self.assertTrue(self.mock_get.call_args[0][0].endswith(queue))
+    self.mock_get.reset_mock()
+    for queue in ('CUSTOM', 'NORMAL_5x5_DRAFT', 'RANKED_TEAM_5x5'):
+      with self.subTest(queue=queue):
+        context = riottest.FakeContext()
+
+        with self.assertRaisesRegex(riottest.AbortError, 'Unsupported queue'):
+          self.service.GetMasterLeague(
+              league_pb2.GetApexLeagueRequest(
+                  queue=constants_pb2.QueueType.Enum.Value(queue)), context)
+
+        self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, context.code)
+    self.mock_get.assert_not_called()
+
+  def _RespondWithApexLeagues(self):
+    leagues = {}
+    for tier in ('CHALLENGER', 'GRANDMASTER', 'MASTER'):
+      league = self._LeagueListJson(tier)
+      league['entries'] = [
+          dict(league['entries'][0], summonerName='%s %d' % (tier, i))
+          for i in range(2)
+      ]
+      leagues['/lol/league/v4/%sleagues/by-queue/RANKED_SOLO_5x5' %
+              tier.lower()] = riottest.Response(league)
+    self.mock_get.side_effect = riottest.FakeRequestsGet(leagues)
+
+  def test_stream_league_entries(self):
+    self._RespondWithApexLeagues()
+    request = league_pb2.GetApexLeagueRequest(
+        queue=constants_pb2.QueueType.RANKED_SOLO_5x5)
+
+    entries = self.service.StreamLeagueEntries(request, self.context)
+
+    self.assertEqual([
+        'CHALLENGER 0', 'CHALLENGER 1', 'GRANDMASTER 0', 'GRANDMASTER 1',
+        'MASTER 0', 'MASTER 1'
+    ], [entry.summoner_name for entry in entries])
+
+  def test_stream_league_entries_stops_when_cancelled(self):
+    self._RespondWithApexLeagues()
+    request = league_pb2.GetApexLeagueRequest(
+        queue=constants_pb2.QueueType.RANKED_SOLO_5x5)
+
+    entries = self.service.StreamLeagueEntries(request, self.context)
+    first_entry = next(entries)
+    self.context.Cancel()
+
+    self.assertEqual('CHALLENGER 0', first_entry.summoner_name)
+    self.assertEqual(['CHALLENGER 1'],
+                     [entry.summoner_name for entry in entries])
+    self.assertEqual(1, self.mock_get.call_count)
+
+  def test_stream_league_entries_error_aborts(self):
+    self.mock_get.side_effect = riottest.FakeRequestsGet({})
+
+    with self.assertRaises(riottest.AbortError):
+      list(
+          self.service.StreamLeagueEntries(
+              league_pb2.GetApexLeagueRequest(
+                  queue=constants_pb2.QueueType.RANKED_SOLO_5x5),
+              self.context))
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+
+class LeagueEntriesTest(unittest.TestCase):
+
+  def setUp(self):
+    super(LeagueEntriesTest, self).setUp()
+    self.service = riot_api_server.LeagueService()
+    self.context = riottest.FakeContext()
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/league/v4/entries/by-summoner/summoner-id':
+                riottest.Response([{
+                    'leagueId': 'solo-league',
+                    'queueType': 'RANKED_SOLO_5x5',
+                    'tier': 'GOLD',
+                    'rank': 'II',
+                    'leaguePoints': 42,
+                }, {
+                    'leagueId': 'flex-league',
+                    'queueType': 'RANKED_FLEX_SR',
+                    'tier': 'SILVER',
+                    'rank': 'I',
+                    'leaguePoints': 7,
+                }]),
+            '/lol/league/v4/leagues/solo-league':
+                riottest.Response({
+                    'leagueId': 'solo-league',
+                    'name': "Nunu's Nightblades",
+                    'queue': 'RANKED_SOLO_5x5',
+                    'entries': [{
+                        'summonerName': 'Peer'
+                    }]
+                }),
+            '/lol/league/v4/leagues/flex-league':
+                riottest.Response({
+                    'leagueId': 'flex-league',
+                    'name': "Teemo's Scouts",
+                    'queue': 'RANKED_FLEX_SR',
+                }),
+        })
+
+  def test_without_hydration(self):
+    response = self.service.GetLeagueEntriesBySummoner(
+        league_pb2.GetLeagueEntriesBySummonerRequest(
+            encrypted_summoner_id='summoner-id'), self.context)
+
+    self.assertEqual([42, 7], [
+        entry.position.league_points for entry in response.entries
+    ])
+    self.assertEqual(constants_pb2.Tier.GOLD, response.entries[0].position.tier)
+    for entry in response.entries:
+      self.assertFalse(entry.HasField('league'))
+    self.assertEqual(1, len(self.fake_get.calls))
+
+  def test_with_hydration(self):
+    response = self.service.GetLeagueEntriesBySummoner(
+        league_pb2.GetLeagueEntriesBySummonerRequest(
+            encrypted_summoner_id='summoner-id', hydrate_leagues=True),
+        self.context)
+
+    self.assertEqual(["Nunu's Nightblades", "Teemo's Scouts"],
+                     [entry.league.name for entry in response.entries])
+    self.assertEqual(constants_pb2.QueueType.RANKED_FLEX_SR,
+                     response.entries[1].league.queue)
+    self.assertEqual('Peer',
+                     response.entries[0].league.entries[0].summoner_name)
+    self.assertEqual(3, len(self.fake_get.calls))
+
+  def test_hydration_partial_failure(self):
+    del self.fake_get.responses['/lol/league/v4/leagues/solo-league']
+
+    with self.assertRaisesRegex(riottest.AbortError, 'solo-league'):
+      self.service.GetLeagueEntriesBySummoner(
+          league_pb2.GetLeagueEntriesBySummonerRequest(
+              encrypted_summoner_id='summoner-id', hydrate_leagues=True),
+          self.context)
+
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+    # The other league is still fetched, rather than abandoned mid-call.
+    self.assertEqual(3, len(self.fake_get.calls))
+
+
+class StaticDataParamsTest(unittest.TestCase):
+
+  def test_query_strings(self):
+    test_cases = [
+        (static_data_pb2.ListChampionsRequest(
+            locale='en_US', version='8.1.1', tags=['info', 'stats'],
+            data_by_id=True),
+         'locale=en_US&version=8.1.1&tags=info&tags=stats&dataById=true'),
+        (static_data_pb2.ListItemsRequest(tags=['gold']),
+         'locale=en_US&tags=gold'),
+        (static_data_pb2.ListSummonerSpellsRequest(data_by_id=False),
+         'locale=en_US'),
+        (static_data_pb2.ListMapsRequest(locale='ko_KR', version='8.1.1'),
+         'locale=ko_KR&version=8.1.1'),
+        (static_data_pb2.GetReforgedRuneRequest(id=8005, version='8.1.1'),
+         'locale=en_US&version=8.1.1'),
+        (static_data_pb2.ListVersionsRequest(), ''),
+    ]
+    for request, expected_query in test_cases:
+      with self.subTest(request=type(request).__name__):
+        params = riot_api_server._static_data_params(request,
+                                                     riottest.FakeContext())
+
+        prepared = requests.Request(
+            'GET', 'https://riot', params=params).prepare()
+        self.assertEqual(expected_query, parse.urlparse(prepared.url).query)
+
+
+  def test_default_locale_by_platform(self):
+    test_cases = [
+        ('NA1', 'en_US'),
+        ('KR', 'ko_KR'),
+        ('BR1', 'pt_BR'),
+        ('JP1', 'ja_JP'),
+        ('EUW1', 'en_GB'),
+        ('euw1', 'en_GB'),
+        ('unknown', 'en_US'),
+    ]
+    for platform_id, expected_locale in test_cases:
+      with self.subTest(platform_id=platform_id):
+        params = riot_api_server._static_data_params(
+            static_data_pb2.ListChampionsRequest(),
+            riottest.FakeContext(platform_id=platform_id))
+
+        self.assertEqual(expected_locale, params['locale'])
+
+  def test_explicit_locale_overrides_platform(self):
+    params = riot_api_server._static_data_params(
+        static_data_pb2.ListChampionsRequest(locale='en_US'),
+        riottest.FakeContext(platform_id='KR'))
+
+    self.assertEqual('en_US', params['locale'])
+
+
+class StaticDataServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(StaticDataServiceTest, self).setUp()
+    self.service = riot_api_server.StaticDataService()
+    self.context = riottest.FakeContext()
+    patcher = mock.patch.object(requests, 'get')
+    self.mock_get = patcher.start()
+    self.addCleanup(patcher.stop)
+
+  def test_build_asset_url(self):
+    test_cases = [
+        ('champion', 'Aatrox.png',
+         'https://ddragon.leagueoflegends.com/cdn/9.1.1/img/champion/'
+         'Aatrox.png'),
+        ('item', '1001.png',
+         'https://ddragon.leagueoflegends.com/cdn/9.1.1/img/item/1001.png'),
+        ('spell', 'SummonerFlash.png',
+         'https://ddragon.leagueoflegends.com/cdn/9.1.1/img/spell/'
+         'SummonerFlash.png'),
+    ]
+    for group, full, expected_url in test_cases:
+      with self.subTest(group=group):
+        self.assertEqual(expected_url,
+                         self.service.BuildAssetUrl('9.1.1', group, full))
+
+  def test_build_realm_asset_url(self):
+    realm = static_data_pb2.Realm(
+        cdn='https://ddragon.example.com/cdn/',
+        v='9.2.1',
+        n={
+            'champion': '9.2.1',
+            'item': '9.2.2',
+            'summoner': '9.1.1'
+        })
+    test_cases = [
+        ('champion', 'Aatrox.png',
+         'https://ddragon.example.com/cdn/9.2.1/img/champion/Aatrox.png'),
+        ('item', '1001.png',
+         'https://ddragon.example.com/cdn/9.2.2/img/item/1001.png'),
+        # Summoner spells are versioned as "summoner" data.
+        ('spell', 'SummonerFlash.png',
+         'https://ddragon.example.com/cdn/9.1.1/img/spell/SummonerFlash.png'),
+        # Groups without their own version use the realm's.
+        ('profileicon', '588.png',
+         'https://ddragon.example.com/cdn/9.2.1/img/profileicon/588.png'),
+    ]
+    for group, full, expected_url in test_cases:
+      with self.subTest(group=group):
+        image = static_data_pb2.Image(group=group, full=full)
+
+        self.assertEqual(expected_url,
+                         self.service.BuildRealmAssetUrl(realm, image))
+
+  def test_build_realm_asset_url_default_cdn(self):
+    realm = static_data_pb2.Realm(v='9.1.1')
+    image = static_data_pb2.Image(group='item', full='1001.png')
+
+    self.assertEqual(
+        'https://ddragon.leagueoflegends.com/cdn/9.1.1/img/item/1001.png',
+        self.service.BuildRealmAssetUrl(realm, image))
+
+  def test_list_languages(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        ['en_US', 'ko_KR', 'pt_BR'])
+
+    response = self.service.ListLanguages(
+        static_data_pb2.ListLanguagesRequest(), self.context)
+
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/static-data/v3/languages',
+        self.mock_get.call_args[0][0])
+    self.assertEqual(['en_US', 'ko_KR', 'pt_BR'], list(response.languages))
+
+  def test_list_languages_empty_array(self):
+    self.mock_get.return_value = riottest.MakeResponse([])
+
+    response = self.service.ListLanguages(
+        static_data_pb2.ListLanguagesRequest(), self.context)
+
+    self.assertEqual(static_data_pb2.ListLanguagesResponse(), response)
+
+  def test_list_language_strings(self):
+    self.mock_get.return_value = riottest.MakeResponse({
+        'type': 'language',
+        'version': '8.24.1',
+        'data': {
+            'Back': 'Back',
+            'Continue': 'Continue',
+        },
+    })
+
+    response = self.service.ListLanguageStrings(
+        static_data_pb2.ListLanguageStringsRequest(locale='en_US'),
+        self.context)
+
+    self.assertEqual({'locale': 'en_US'}, self.mock_get.call_args[1]['params'])
+    self.assertEqual({'Back': 'Back', 'Continue': 'Continue'}, response.data)
+
+  def test_list_maps(self):
+    self.mock_get.return_value = riottest.MakeResponse({
+        'type': 'map',
+        'version': '8.24.1',
+        'data': {
+            '11': {
+                'mapName': "Summoner's Rift",
+                'mapId': 11,
+                'image': {
+                    'full': 'map11.png',
+                    'group': 'map',
+                },
+                'unpurchasableItemList': [3632, 3634],
+            },
+            '12': {
+                'mapName': 'Howling Abyss',
+                'mapId': 12,
+            },
+        },
+    })
+
+    response = self.service.ListMaps(
+        static_data_pb2.ListMapsRequest(locale='en_US', version='8.24.1'),
+        self.context)
+
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/static-data/v3/maps',
+        self.mock_get.call_args[0][0])
+    self.assertEqual({
+        'locale': 'en_US',
+        'version': '8.24.1'
+    }, self.mock_get.call_args[1]['params'])
+    self.assertCountEqual(['11', '12'], response.data.keys())
+    self.assertEqual("Summoner's Rift", response.data['11'].map_name)
+    self.assertEqual('map11.png', response.data['11'].image.full)
+    self.assertEqual([3632, 3634],
+                     list(response.data['11'].unpurchasable_item_list))
+
+  def test_get_mastery(self):
+    self.mock_get.return_value = riottest.MakeResponse({
+        'id': 6121,
+        'name': 'Fresh Blood',
+        'ranks': 1,
+        'description': ['Your first basic attack against a champion deals '
+                        'bonus damage.'],
+    })
+
+    mastery = self.service.GetMastery(
+        static_data_pb2.GetMasteryRequest(
+            id=6121, locale='en_US', version='7.23.1'), self.context)
+
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/static-data/v3/masteries/6121',
+        self.mock_get.call_args[0][0])
+    self.assertEqual({
+        'locale': 'en_US',
+        'version': '7.23.1'
+    }, self.mock_get.call_args[1]['params'])
+    self.assertEqual('Fresh Blood', mastery.name)
+
+  def test_get_mastery_not_found(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        {'status': {
+            'message': 'Data not found',
+            'status_code': 404
+        }}, status_code=404)
+
+    with self.assertRaises(riottest.AbortError):
+      self.service.GetMastery(static_data_pb2.GetMasteryRequest(id=1),
+                              self.context)
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+  def test_get_reforged_rune(self):
+    self.mock_get.return_value = riottest.MakeResponse({
+        'id': 8112,
+        'key': 'Electrocute',
+        'name': 'Electrocute',
+        'runePathId': 8100,
+        'runePathName': 'Domination',
+        'icon': 'perk-images/Styles/Domination/Electrocute/Electrocute.png',
+    })
+
+    rune = self.service.GetReforgedRune(
+        static_data_pb2.GetReforgedRuneRequest(id=8112, locale='ko_KR'),
+        self.context)
+
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/static-data/v3/reforged-runes/8112',
+        self.mock_get.call_args[0][0])
+    self.assertEqual({'locale': 'ko_KR'}, self.mock_get.call_args[1]['params'])
+    self.assertEqual('Electrocute', rune.name)
+    self.assertEqual(8100, rune.rune_path_id)
+
+  def test_get_reforged_rune_not_found(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        {'status': {
+            'message': 'Data not found',
+            'status_code': 404
+        }}, status_code=404)
+
+    with self.assertRaises(riottest.AbortError):
+      self.service.GetReforgedRune(
+          static_data_pb2.GetReforgedRuneRequest(id=1), self.context)
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+  def test_list_profile_icons(self):
+    self.mock_get.return_value = riottest.MakeResponse({
+        'type': 'profileicon',
+        'version': '8.24.1',
+        'data': {
+            '0': {
+                'id': 0,
+                'image': {
+                    'full': '0.png',
+                    'group': 'profileicon',
+                },
+            },
+            '3379': {
+                'id': 3379,
+                'image': {
+                    'full': '3379.png',
+                    'group': 'profileicon',
+                },
+            },
+        },
+    })
+
+    response = self.service.ListProfileIcons(
+        static_data_pb2.ListProfileIconsRequest(), self.context)
+
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/static-data/v3/profile-icons',
+        self.mock_get.call_args[0][0])
+    self.assertEqual({'locale': 'en_US'}, self.mock_get.call_args[1]['params'])
+    self.assertCountEqual(['0', '3379'], response.data.keys())
+    self.assertEqual(3379, response.data['3379'].id)
+    self.assertEqual('3379.png', response.data['3379'].image.full)
+
+  def test_data_by_id(self):
+    test_cases = [
+        (self.service.ListChampions, static_data_pb2.ListChampionsRequest),
+        (self.service.ListItems, static_data_pb2.ListItemsRequest),
+        (self.service.ListMasteries, static_data_pb2.ListMasteriesRequest),
+        (self.service.ListProfileIcons,
+         static_data_pb2.ListProfileIconsRequest),
+        (self.service.ListSummonerSpells,
+         static_data_pb2.ListSummonerSpellsRequest),
+    ]
+    params_cases = [
+        (False, 'Hype', {'locale': 'en_US'}),
+        (True, '4005', {'locale': 'en_US', 'dataById': 'true'}),
+    ]
+    for method, request_type in test_cases:
+      for data_by_id, key, expected_params in params_cases:
+        with self.subTest(method=method.__name__, data_by_id=data_by_id):
+          self.mock_get.return_value = riottest.MakeResponse(
+              {'data': {
+                  key: {
+                      'image': {
+                          'full': 'hype.png'
+                      }
+                  }
+              }})
+
+          response = method(request_type(data_by_id=data_by_id), self.context)
+
+          self.assertEqual(expected_params,
+                           self.mock_get.call_args[1]['params'])
+          self.assertEqual('hype.png', response.data[key].image.full)
+
+  def test_accepted_params(self):
+    # Riot's query params for each endpoint. Every request field Riot accepts
+    # is set, so any param not listed here would be sent to Riot.
+    test_cases = [
+        ('ListChampions', {}, ['locale', 'version', 'tags', 'dataById']),
+        ('GetChampion', {}, ['locale', 'version', 'tags']),
+        ('ListItems', {}, ['locale', 'version', 'tags', 'dataById']),
+        ('GetItem', {}, ['locale', 'version', 'tags']),
+        ('ListLanguageStrings', {}, ['locale', 'version']),
+        ('ListLanguages', [], []),
+        ('ListMaps', {}, ['locale', 'version']),
+        ('ListMasteries', {}, ['locale', 'version', 'tags', 'dataById']),
+        ('GetMastery', {}, ['locale', 'version', 'tags']),
+        ('ListProfileIcons', {}, ['locale', 'version', 'dataById']),
+        ('GetRealms', {}, []),
+        ('ListReforgedRunePaths', [], ['locale', 'version']),
+        ('GetReforgedRune', {}, ['locale', 'version']),
+        ('ListSummonerSpells', {}, ['locale', 'version', 'tags', 'dataById']),
+        ('GetSummonerSpell', {}, ['locale', 'version', 'tags']),
+        ('ListVersions', ['9.1.1'], []),
+        ('GetCurrentPatchVersion', ['9.1.1'], []),
+    ]
+    all_fields = {
+        'id': 1,
+        'locale': 'en_US',
+        'version': '9.1.1',
+        'tags': ['image'],
+        'data_by_id': True,
+    }
+    for method_name, body, expected_params in test_cases:
+      with self.subTest(method=method_name):
+        method = getattr(self.service, method_name)
+        request_class = getattr(static_data_pb2, '%sRequest' % method_name)
+        fields = request_class.DESCRIPTOR.fields_by_name
+        request = request_class(
+            **{name: value for name, value in all_fields.items()
+               if name in fields})
+        self.mock_get.return_value = riottest.MakeResponse(body)
+
+        method(request, self.context)
+
+        self.assertCountEqual(expected_params,
+                              self.mock_get.call_args[1]['params'].keys())
+
+  def test_get_realms(self):
+    self.mock_get.return_value = riottest.MakeResponse({
+        'lg': '8.24.1',
+        'dd': '8.24.1',
+        'l': 'en_US',
+        'n': {
+            'item': '8.24.1',
+            'rune': '7.23.1',
+            'mastery': '7.23.1',
+            'summoner': '8.24.1',
+            'champion': '8.24.1',
+            'profileicon': '8.24.1',
+            'map': '8.24.1',
+            'language': '8.24.1',
+            'sticker': '8.24.1',
+        },
+        'profileiconmax': 28,
+        'v': '8.24.1',
+        'cdn': 'https://ddragon.leagueoflegends.com/cdn',
+        'css': '8.24.1',
+    })
+
+    realm = self.service.GetRealms(static_data_pb2.GetRealmsRequest(),
+                                   self.context)
+
+    self.assertEqual('https://na1.api.riotgames.com/lol/static-data/v3/realms',
+                     self.mock_get.call_args[0][0])
+    self.assertEqual('https://ddragon.leagueoflegends.com/cdn', realm.cdn)
+    self.assertEqual('8.24.1', realm.dd)
+    self.assertEqual('en_US', realm.l)
+    self.assertEqual('7.23.1', realm.n['rune'])
+    self.assertEqual(28, realm.profileiconmax)
+
+  def test_list_versions(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        ['9.1.1', '8.24.1', '8.23.1', '8.22.1', 'lolpatch_7.20', '0.151.2'])
+
+    response = self.service.ListVersions(static_data_pb2.ListVersionsRequest(),
+                                         self.context)
+
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/static-data/v3/versions',
+        self.mock_get.call_args[0][0])
+    self.assertEqual(6, len(response.versions))
+    self.assertEqual('9.1.1', response.versions[0])
+    self.assertEqual('0.151.2', response.versions[-1])
+
+  def test_get_current_patch_version(self):
+    self.mock_get.return_value = riottest.MakeResponse(
+        ['9.1.1', '8.24.1', '8.23.1'])
+
+    response = self.service.GetCurrentPatchVersion(
+        static_data_pb2.GetCurrentPatchVersionRequest(), self.context)
+
+    self.assertEqual('9.1.1', response.version)
+
+  def test_get_current_patch_version_cached(self):
+    self.mock_get.return_value = riottest.MakeResponse(['9.1.1', '8.24.1'])
+    riot_api_lib.SetResponseCache(riot_api_lib.ResponseCache(60))
+    self.addCleanup(riot_api_lib.SetResponseCache, None)
+
+    for _ in range(2):
+      response = self.service.GetCurrentPatchVersion(
+          static_data_pb2.GetCurrentPatchVersionRequest(), self.context)
+
+    self.assertEqual('9.1.1', response.version)
+    self.assertEqual(1, self.mock_get.call_count)
+
+  def test_get_current_patch_version_no_versions(self):
+    self.mock_get.return_value = riottest.MakeResponse([])
+
+    with self.assertRaises(riottest.AbortError):
+      self.service.GetCurrentPatchVersion(
+          static_data_pb2.GetCurrentPatchVersionRequest(), self.context)
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+
+_CLASH_PLAYER = {
+    'summonerId': 'summoner-1',
+    'teamId': 'team-1',
+    'position': 'MIDDLE',
+    'role': 'CAPTAIN'
+}
+_CLASH_TOURNAMENT = {
+    'id': 2001,
+    'themeId': 12,
+    'nameKey': 'bilgewater',
+    'nameKeySecondary': 'day_1',
+    'schedule': [{
+        'id': 3001,
+        'registrationTime': 1600000000000,
+        'startTime': 1600010000000,
+        'cancelled': False
+    }]
+}
+
+
+class ClashServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(ClashServiceTest, self).setUp()
+    self.service = riot_api_server.ClashService()
+    self.context = riottest.FakeContext()
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/clash/v1/players/by-summoner/summoner-1':
+                riottest.Response([_CLASH_PLAYER]),
+            '/lol/clash/v1/teams/team-1':
+                riottest.Response({
+                    'id': 'team-1',
+                    'tournamentId': 2001,
+                    'name': 'Hype Squad',
+                    'iconId': 7,
+                    'tier': 2,
+                    'captain': 'summoner-1',
+                    'abbreviation': 'HYPE',
+                    'players': [_CLASH_PLAYER]
+                }),
+            '/lol/clash/v1/tournaments':
+                riottest.Response([_CLASH_TOURNAMENT]),
+            '/lol/clash/v1/tournaments/by-team/team-1':
+                riottest.Response(_CLASH_TOURNAMENT),
+            '/lol/clash/v1/tournaments/2001':
+                riottest.Response(_CLASH_TOURNAMENT),
+        })
+    self.expected_player = clash_pb2.Player(
+        summoner_id='summoner-1',
+        team_id='team-1',
+        position=clash_pb2.Player.MIDDLE,
+        role=clash_pb2.Player.CAPTAIN)
+    self.expected_tournament = clash_pb2.Tournament(
+        id=2001,
+        theme_id=12,
+        name_key='bilgewater',
+        name_key_secondary='day_1',
+        schedule=[
+            clash_pb2.TournamentPhase(
+                id=3001,
+                registration_time=1600000000000,
+                start_time=1600010000000)
+        ])
+
+  def test_list_players(self):
+    response = self.service.ListPlayers(
+        clash_pb2.ListPlayersRequest(encrypted_summoner_id='summoner-1'),
+        self.context)
+
+    self.assertEqual([self.expected_player], list(response.players))
+
+  def test_get_team(self):
+    team = self.service.GetTeam(
+        clash_pb2.GetTeamRequest(team_id='team-1'), self.context)
+
+    self.assertEqual(
+        clash_pb2.Team(
+            id='team-1',
+            tournament_id=2001,
+            name='Hype Squad',
+            icon_id=7,
+            tier=2,
+            captain='summoner-1',
+            abbreviation='HYPE',
+            players=[self.expected_player]), team)
+
+  def test_ids_are_quoted(self):
+    self.fake_get.responses.update({
+        '/lol/clash/v1/teams/..%2Ftournaments':
+            riottest.Response({'id': '../tournaments'}),
+        '/lol/clash/v1/tournaments/by-team/team%201':
+            riottest.Response(_CLASH_TOURNAMENT),
+    })
+
+    team = self.service.GetTeam(
+        clash_pb2.GetTeamRequest(team_id='../tournaments'), self.context)
+    tournament = self.service.GetTournamentByTeam(
+        clash_pb2.GetTournamentByTeamRequest(team_id='team 1'), self.context)
+
+    self.assertEqual('../tournaments', team.id)
+    self.assertEqual(self.expected_tournament, tournament)
+
+  def test_list_tournaments(self):
+    response = self.service.ListTournaments(
+        clash_pb2.ListTournamentsRequest(), self.context)
+
+    self.assertEqual([self.expected_tournament], list(response.tournaments))
+
+  def test_get_tournament_by_team(self):
+    tournament = self.service.GetTournamentByTeam(
+        clash_pb2.GetTournamentByTeamRequest(team_id='team-1'), self.context)
+
+    self.assertEqual(self.expected_tournament, tournament)
+
+  def test_get_tournament(self):
+    tournament = self.service.GetTournament(
+        clash_pb2.GetTournamentRequest(tournament_id=2001), self.context)
+
+    self.assertEqual(self.expected_tournament, tournament)
+
+
+class LoggingInterceptorTest(unittest.TestCase):
+
+  def setUp(self):
+    super(LoggingInterceptorTest, self).setUp()
+    self.interceptor = riot_api_server.LoggingInterceptor()
+    self.call_details = mock.Mock(
+        method='/hypebot.riot.v4.SummonerService/GetSummoner',
+        invocation_metadata=(('platform-id', 'KR'), ('api-key', 'secret')))
+    patcher = mock.patch.object(riot_api_server.logging, 'vlog')
+    self.mock_vlog = patcher.start()
+    self.addCleanup(patcher.stop)
+
+  def _Intercept(self, behavior):
+    handler = self.interceptor.intercept_service(
+        lambda unused_details: grpc.unary_unary_rpc_method_handler(behavior),
+        self.call_details)
+    return handler.unary_unary
+
+  def _LoggedMessage(self):
+    self.mock_vlog.assert_called_once()
+    args = self.mock_vlog.call_args[0]
+    return args[1] % args[2:]
+
+  def test_logs_successful_call(self):
+    call = self._Intercept(lambda request, context: 'response')
+
+    self.assertEqual('response', call('request', mock.Mock()))
+
+    message = self._LoggedMessage()
+    self.assertIn('/hypebot.riot.v4.SummonerService/GetSummoner', message)
+    self.assertIn('platform=KR', message)
+    self.assertIn('code=OK', message)
+    self.assertNotIn('secret', message)
+
+  def test_logs_aborted_call(self):
+    context = mock.Mock()
+    context.code.return_value = grpc.StatusCode.NOT_FOUND
+
+    def _Abort(unused_request, unused_context):
+      raise riottest.AbortError()
+
+    with self.assertRaises(riottest.AbortError):
+      self._Intercept(_Abort)('request', context)
+
+    self.assertIn('code=NOT_FOUND', self._LoggedMessage())
+
+  def test_logs_stream(self):
+    handler = self.interceptor.intercept_service(
+        lambda unused_details: grpc.unary_stream_rpc_method_handler(
+            lambda request, context: iter(['a', 'b'])), self.call_details)
+    responses = handler.unary_stream('request', mock.Mock())
+
+    self.assertEqual('a', next(responses))
+    self.mock_vlog.assert_not_called()
+    self.assertEqual(['b'], list(responses))
+    self.assertIn('code=OK', self._LoggedMessage())
+
+  def test_logs_closed_stream(self):
+    handler = self.interceptor.intercept_service(
+        lambda unused_details: grpc.unary_stream_rpc_method_handler(
+            lambda request, context: iter(['a', 'b'])), self.call_details)
+    responses = handler.unary_stream('request', mock.Mock())
+
+    next(responses)
+    responses.close()
+
+    self.assertIn('code=CANCELLED', self._LoggedMessage())
+
+  def test_ignores_unknown_methods(self):
+    self.assertIsNone(
+        self.interceptor.intercept_service(lambda unused_details: None,
+                                           self.call_details))
+
+
+class RequestIdInterceptorTest(unittest.TestCase):
+
+  def setUp(self):
+    super(RequestIdInterceptorTest, self).setUp()
+    summoner = riottest.Response({'id': 'summoner-id', 'name': 'Tester'})
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/summoner/v4/summoners/summoner-id': summoner,
+            '/lol/summoner/v4/summoners/by-puuid/puuid': summoner,
+        })
+    patcher = mock.patch.object(riot_api_server.logging, 'vlog')
+    self.mock_vlog = patcher.start()
+    self.addCleanup(patcher.stop)
+    self.context = riottest.FakeContext()
+    self.context.send_initial_metadata = mock.Mock()
+
+  def _Call(self, method, request, metadata, streaming=False):
+    """Calls method through the server's request ID and logging interceptors.
+
+    Args:
+      method: Servicer method to call.
+      request: Request to call method with.
+      metadata: Invocation metadata of the call.
+      streaming: Whether method is unary-stream. Its responses are returned as
+        a list.
+    """
+    call_details = mock.Mock(
+        method='/hypebot.riot.v4.SummonerService/Method',
+        invocation_metadata=metadata)
+    make_handler = (
+        grpc.unary_stream_rpc_method_handler
+        if streaming else grpc.unary_unary_rpc_method_handler)
+    logging_interceptor = riot_api_server.LoggingInterceptor()
+    handler = riot_api_server.RequestIdInterceptor().intercept_service(
+        lambda details: logging_interceptor.intercept_service(
+            lambda unused_details: make_handler(method), details),
+        call_details)
+    if streaming:
+      return list(handler.unary_stream(request, self.context))
+    return handler.unary_unary(request, self.context)
+
+  def _SentRequestIds(self):
+    return [
+        headers.get('X-Request-Id') for _, _, headers in self.fake_get.calls
+    ]
+
+  def _AssertRequestIdFlows(self, request_id):
+    self.context.send_initial_metadata.assert_called_once_with(
+        (('x-request-id', request_id),))
+    self.assertTrue(self._SentRequestIds())
+    self.assertEqual([request_id], list(set(self._SentRequestIds())))
+    args = self.mock_vlog.call_args[0]
+    self.assertIn('request_id=%s' % request_id, args[1] % args[2:])
+    # Requests made outside of the call don't have its ID.
+    self.assertIsNone(riot_api_lib.GetRequestId())
+
+  def test_client_request_id(self):
+    summoner = self._Call(
+        riot_api_server.SummonerService().GetSummoner,
+        summoner_pb2.GetSummonerRequest(encrypted_summoner_id='summoner-id'),
+        (('x-request-id', 'client-id-1'),))
+
+    self.assertEqual('Tester', summoner.name)
+    self._AssertRequestIdFlows('client-id-1')
+
+  def test_new_request_id(self):
+    test_cases = [
+        ('missing', ()),
+        ('invalid', (('x-request-id', 'bad\r\nid'),)),
+    ]
+    for name, metadata in test_cases:
+      with self.subTest(name=name):
+        self.context.send_initial_metadata.reset_mock()
+        self.fake_get.calls = []
+
+        self._Call(
+            riot_api_server.SummonerService().GetSummoner,
+            summoner_pb2.GetSummonerRequest(
+                encrypted_summoner_id='summoner-id'), metadata)
+
+        request_id = self.context.send_initial_metadata.call_args[0][0][0][1]
+        self.assertRegex(request_id, '^[0-9a-f]{32}$')
+        self._AssertRequestIdFlows(request_id)
+
+  def test_fan_out_requests_share_request_id(self):
+    self._Call(
+        riot_api_server.SummonerService().ListSummoners,
+        summoner_pb2.ListSummonersRequest(keys=[
+            summoner_pb2.GetSummonerRequest(
+                encrypted_summoner_id='summoner-id'),
+            summoner_pb2.GetSummonerRequest(encrypted_puuid='puuid'),
+        ]), (('x-request-id', 'client-id-2'),))
+
+    self.assertEqual(2, len(self.fake_get.calls))
+    self._AssertRequestIdFlows('client-id-2')
+
+  def test_stream(self):
+    self.fake_get.responses.update({
+        '/lol/match/v4/matchlists/by-account/account-1':
+            riottest.Response({
+                'matches': [{'gameId': 1}, {'gameId': 2}],
+                'totalGames': 2
+            }),
+        '/lol/match/v4/matches/1': riottest.Response({'gameId': 1}),
+        '/lol/match/v4/matches/2': riottest.Response({'gameId': 2}),
+    })
+
+    matches = self._Call(
+        riot_api_server.MatchService().StreamAccountMatches,
+        match_pb2.StreamAccountMatchesRequest(
+            request=match_pb2.ListMatchesRequest(
+                encrypted_account_id='account-1')),
+        (('x-request-id', 'client-id-3'),),
+        streaming=True)
+
+    self.assertEqual([1, 2], [match.game_id for match in matches])
+    self.assertEqual(3, len(self.fake_get.calls))
+    self._AssertRequestIdFlows('client-id-3')
+
+
+class MetricsInterceptorTest(unittest.TestCase):
+
+  def _GetRequestCount(self, service, method):
+    return prometheus_client.REGISTRY.get_sample_value(
+        'riot_api_requests_total', {
+            'service': service,
+            'method': method,
+            'platform': 'na1',
+            'http_status': '200',
+        }) or 0
+
+  def test_attributes_requests_to_method(self):
+    call_details = mock.Mock(method='/hypebot.riot.v4.MatchService/GetMatch')
+    handler = riot_api_server.MetricsInterceptor().intercept_service(
+        lambda unused_details: grpc.unary_unary_rpc_method_handler(
+            lambda request, context: riot_metrics_lib.RecordRequest(
+                'na1', 200, 0.1)), call_details)
+    before = self._GetRequestCount('hypebot.riot.v4.MatchService', 'GetMatch')
+
+    handler.unary_unary('request', mock.Mock())
+    # Requests made outside of a call are not attributed to it.
+    riot_metrics_lib.RecordRequest('na1', 200, 0.1)
+
+    self.assertEqual(
+        before + 1,
+        self._GetRequestCount('hypebot.riot.v4.MatchService', 'GetMatch'))
+
+  def test_attributes_stream_requests_to_method(self):
+    call_details = mock.Mock(
+        method='/hypebot.riot.v4.MatchService/StreamAccountMatches')
+
+    def _Stream(unused_request, unused_context):
+      for _ in range(2):
+        riot_metrics_lib.RecordRequest('na1', 200, 0.1)
+        yield 'response'
+
+    handler = riot_api_server.MetricsInterceptor().intercept_service(
+        lambda unused_details: grpc.unary_stream_rpc_method_handler(_Stream),
+        call_details)
+    before = self._GetRequestCount('hypebot.riot.v4.MatchService',
+                                   'StreamAccountMatches')
+
+    list(handler.unary_stream('request', mock.Mock()))
+
+    self.assertEqual(
+        before + 2,
+        self._GetRequestCount('hypebot.riot.v4.MatchService',
+                              'StreamAccountMatches'))
+
+
+class RiotHealthCheckTest(unittest.TestCase):
+
+  def setUp(self):
+    super(RiotHealthCheckTest, self).setUp()
+    riot_api_lib.SetApiKeyPool(riot_api_lib.ApiKeyPool(['server-key']))
+    self.addCleanup(riot_api_lib.SetApiKeyPool, None)
+    self.health_servicer = mock.Mock()
+    self.health_check = riot_api_server.RiotHealthCheck(
+        self.health_servicer, ['', 'hypebot.riot.v4.SummonerService'])
+
+  def _Statuses(self):
+    return {
+        args[0]: args[1] for args, _ in self.health_servicer.set.call_args_list
+    }
+
+  def test_serving(self):
+    fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/status/v3/shard-data': riottest.Response({'name': 'NA'}),
+        })
+
+    self.assertTrue(self.health_check.Check())
+    self.assertEqual(
+        {
+            '': health_pb2.HealthCheckResponse.SERVING,
+            'hypebot.riot.v4.SummonerService':
+                health_pb2.HealthCheckResponse.SERVING,
+        }, self._Statuses())
+    self.assertEqual(1, len(fake_get.calls))
+
+  def test_invalid_api_key(self):
+    riottest.PatchRequestsGet(
+        self, {
+            '/lol/status/v3/shard-data':
+                riottest.Response(
+                    {'status': {
+                        'message': 'Forbidden',
+                        'status_code': 403
+                    }}, 403),
+        })
+
+    self.assertFalse(self.health_check.Check())
+    self.assertEqual(
+        {
+            '': health_pb2.HealthCheckResponse.NOT_SERVING,
+            'hypebot.riot.v4.SummonerService':
+                health_pb2.HealthCheckResponse.NOT_SERVING,
+        }, self._Statuses())
+
+  @mock.patch.object(
+      requests, 'get', side_effect=requests.ConnectionError('DNS failed'))
+  def test_unreachable(self, unused_mock_get):
+    self.assertFalse(self.health_check.Check())
+    self.assertEqual(
+        {
+            '': health_pb2.HealthCheckResponse.NOT_SERVING,
+            'hypebot.riot.v4.SummonerService':
+                health_pb2.HealthCheckResponse.NOT_SERVING,
+        }, self._Statuses())
+
+
+class DebugHandlerTest(unittest.TestCase):
+
+  def test_rate_limit_state(self):
+    limiter = riot_api_lib.RateLimiter(block=False)
+    limiter.Update('na1', '20:1')
+    riot_api_lib.SetRateLimiter(limiter)
+    self.addCleanup(riot_api_lib.SetRateLimiter, None)
+    http_server = riot_metrics_lib.StartServer(
+        'localhost:0',
+        debug_handlers={'/debug/ratelimits': riot_api_lib.GetRateLimitState})
+    self.addCleanup(http_server.server_close)
+    self.addCleanup(http_server.shutdown)
+    url = 'http://localhost:%d' % http_server.server_address[1]
+
+    response = requests.get(url + '/debug/ratelimits')
+
+    self.assertEqual('application/json', response.headers['Content-Type'])
+    state = response.json()
+    self.assertEqual(['na1'], list(state))
+    self.assertEqual(20, state['na1'][0]['limit'])
+    self.assertEqual(1, state['na1'][0]['window_secs'])
+    self.assertLessEqual(state['na1'][0]['tokens'], 20)
+    self.assertEqual(200, requests.get(url + '/metrics').status_code)
+
+
+class SummonerServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(SummonerServiceTest, self).setUp()
+    self.service = riot_api_server.SummonerService()
+    self.context = riottest.FakeContext()
+    self.fake_get = riottest.PatchRequestsGet(self, {
+        '/lol/summoner/v4/summoners/summoner-id':
+            riottest.Response({'name': 'By ID'}),
+        '/lol/summoner/v4/summoners/by-account/account-id':
+            riottest.Response({'name': 'By account'}),
+        '/lol/summoner/v4/summoners/by-name/tester':
+            riottest.Response({
+                'id': 'summoner-id',
+                'accountId': 'account-id',
+                'puuid': 'puuid',
+                'name': 'Tester'
+            }),
+        '/lol/summoner/v4/summoners/by-puuid/abc%2F123%2B_-':
+            riottest.Response({'name': 'By PUUID'}),
+    })
+
+  def test_get_summoner(self):
+    test_cases = [
+        ('encrypted_summoner_id', 'summoner-id', 'By ID'),
+        ('encrypted_account_id', 'account-id', 'By account'),
+        ('summoner_name', 'Tester', 'Tester'),
+        # Riot ignores the case and whitespace of names.
+        ('summoner_name', ' tes TER ', 'Tester'),
+        # PUUIDs may contain characters which must be escaped in the path.
+        ('encrypted_puuid', 'abc/123+_-', 'By PUUID'),
+    ]
+    for key_type, key, expected_name in test_cases:
+      with self.subTest(key_type=key_type):
+        request = summoner_pb2.GetSummonerRequest(**{key_type: key})
+
+        summoner = self.service.GetSummoner(request, self.context)
+
+        self.assertEqual(expected_name, summoner.name)
+
+  def test_get_summoner_during_maintenance(self):
+    self.fake_get.responses['/lol/summoner/v4/summoners/summoner-id'] = (
+        riottest.Response(
+            '<html><body>Scheduled maintenance</body></html>',
+            status_code=503,
+            headers={'Content-Type': 'text/html'}))
+
+    with self.assertRaisesRegex(riottest.AbortError,
+                                'Riot maintenance or outage'):
+      self.service.GetSummoner(
+          summoner_pb2.GetSummonerRequest(encrypted_summoner_id='summoner-id'),
+          self.context)
+    self.assertEqual(grpc.StatusCode.UNAVAILABLE, self.context.code)
+
+  def test_get_summoner_no_key(self):
+    with self.assertRaisesRegex(riottest.AbortError, 'no key specified'):
+      self.service.GetSummoner(summoner_pb2.GetSummonerRequest(), self.context)
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_get_summoner_empty_key(self):
+    for summoner_name in ('', '  '):
+      with self.subTest(summoner_name=summoner_name):
+        with self.assertRaisesRegex(riottest.AbortError, 'summoner_name'):
+          self.service.GetSummoner(
+              summoner_pb2.GetSummonerRequest(summoner_name=summoner_name),
+              self.context)
+        self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_list_summoners(self):
+    request = summoner_pb2.ListSummonersRequest(keys=[
+        summoner_pb2.GetSummonerRequest(summoner_name='Tester'),
+        summoner_pb2.GetSummonerRequest(encrypted_summoner_id='summoner-id'),
+        summoner_pb2.GetSummonerRequest(summoner_name='Nobody'),
+        summoner_pb2.GetSummonerRequest(),
+        summoner_pb2.GetSummonerRequest(encrypted_account_id='account-id'),
+    ])
+
+    response = self.service.ListSummoners(request, self.context)
+
+    self.assertEqual(['Tester', 'By ID', '', '', 'By account'],
+                     [summoner.name for summoner in response.summoners])
+    self.assertEqual([
+        0, 0, grpc.StatusCode.NOT_FOUND.value[0],
+        grpc.StatusCode.INVALID_ARGUMENT.value[0], 0
+    ], [error.code for error in response.errors])
+    self.assertIn('no key specified', response.errors[3].message)
+    self.assertIsNone(self.context.code)
+    # The request without a key isn't sent.
+    self.assertEqual(4, len(self.fake_get.calls))
+
+  def test_list_summoners_reports_connection_errors_per_key(self):
+    fake_get = self.fake_get
+
+    def _Get(url, **kwargs):
+      if '/by-account/' in url:
+        raise requests.ConnectionError('connection reset')
+      return fake_get(url, **kwargs)
+
+    with mock.patch.object(requests, 'get', _Get):
+      response = self.service.ListSummoners(
+          summoner_pb2.ListSummonersRequest(keys=[
+              summoner_pb2.GetSummonerRequest(
+                  encrypted_account_id='account-id'),
+              summoner_pb2.GetSummonerRequest(
+                  encrypted_summoner_id='summoner-id'),
+          ]), self.context)
+
+    self.assertEqual(['', 'By ID'],
+                     [summoner.name for summoner in response.summoners])
+    self.assertEqual([grpc.StatusCode.UNAVAILABLE.value[0], 0],
+                     [error.code for error in response.errors])
+    self.assertIn('connection reset', response.errors[0].message)
+    self.assertIsNone(self.context.code)
+
+  def test_translate_legacy_id(self):
+    request = summoner_pb2.TranslateLegacyIdRequest(
+        summoner_id=12345,
+        lookup=summoner_pb2.GetSummonerRequest(summoner_name='Tester'))
+
+    response = self.service.TranslateLegacyId(request, self.context)
+
+    self.assertEqual(12345, response.summoner_id)
+    self.assertEqual('summoner-id', response.summoner.id)
+    self.assertEqual('account-id', response.summoner.account_id)
+    self.assertEqual('puuid', response.summoner.puuid)
+    self.assertEqual(1, len(self.fake_get.calls))
+
+  def test_translate_legacy_id_requires_legacy_id(self):
+    request = summoner_pb2.TranslateLegacyIdRequest(
+        lookup=summoner_pb2.GetSummonerRequest(summoner_name='Tester'))
+
+    with self.assertRaisesRegex(riottest.AbortError, 'no legacy ID'):
+      self.service.TranslateLegacyId(request, self.context)
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+
+class SummonerCacheTest(unittest.TestCase):
+
+  def setUp(self):
+    super(SummonerCacheTest, self).setUp()
+    self.now = 1000.0
+    self.service = riot_api_server.SummonerService(
+        riot_api_server.SummonerCache(60, clock=lambda: self.now))
+    self.context = riottest.FakeContext()
+    summoner = riottest.Response({
+        'id': 'summoner-id',
+        'accountId': 'account-id',
+        'puuid': 'puuid',
+        'name': 'Tester'
+    })
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/summoner/v4/summoners/summoner-id': summoner,
+            '/lol/summoner/v4/summoners/by-account/account-id': summoner,
+            '/lol/summoner/v4/summoners/by-name/tester': summoner,
+            '/lol/summoner/v4/summoners/by-puuid/puuid': summoner,
+        })
+
+  def _GetSummoner(self, context=None, **key):
+    return self.service.GetSummoner(
+        summoner_pb2.GetSummonerRequest(**key), context or self.context)
+
+  def test_hit(self):
+    self._GetSummoner(encrypted_summoner_id='summoner-id')
+
+    summoner = self._GetSummoner(encrypted_summoner_id='summoner-id')
+
+    self.assertEqual('Tester', summoner.name)
+    self.assertEqual(1, len(self.fake_get.calls))
+
+  def test_hit_by_other_keys(self):
+    self._GetSummoner(summoner_name='Tester')
+    test_cases = [
+        {'encrypted_summoner_id': 'summoner-id'},
+        {'encrypted_account_id': 'account-id'},
+        {'encrypted_puuid': 'puuid'},
+        # Names are cached normalized, like Riot compares them.
+        {'summoner_name': ' tes TER '},
+    ]
+    for key in test_cases:
+      with self.subTest(key=key):
+        self.assertEqual('summoner-id', self._GetSummoner(**key).id)
+    self.assertEqual(1, len(self.fake_get.calls))
+
+  def test_miss_after_ttl(self):
+    self._GetSummoner(encrypted_puuid='puuid')
+    self.now += 60
+
+    self._GetSummoner(encrypted_puuid='puuid')
+
+    self.assertEqual(2, len(self.fake_get.calls))
+
+  def test_miss_for_other_platform_or_api_key(self):
+    self._GetSummoner(encrypted_summoner_id='summoner-id')
+    test_cases = [
+        riottest.FakeContext(platform_id='EUW1'),
+        riottest.FakeContext(api_key='other-key'),
+    ]
+    for context in test_cases:
+      self._GetSummoner(context, encrypted_summoner_id='summoner-id')
+
+    self.assertEqual(3, len(self.fake_get.calls))
+
+  def test_pooled_api_keys(self):
+    context = riottest.FakeContext(api_key=None)
+    test_cases = [
+        # Which key a request will use isn't known, so nothing is cached.
+        (['key-a', 'key-b'], 2),
+        (['key-a'], 1),
+    ]
+    for keys, expected_calls in test_cases:
+      with self.subTest(keys=keys):
+        riot_api_lib.SetApiKeyPool(riot_api_lib.ApiKeyPool(keys))
+        self.addCleanup(riot_api_lib.SetApiKeyPool, None)
+        del self.fake_get.calls[:]
+
+        for _ in range(2):
+          self._GetSummoner(context, encrypted_summoner_id='summoner-id')
+
+        self.assertEqual(expected_calls, len(self.fake_get.calls))
+
+  def test_not_found_is_not_cached(self):
+    for _ in range(2):
+      with self.assertRaises(riottest.AbortError):
+        self._GetSummoner(summoner_name='Nobody')
+
+    self.assertEqual(2, len(self.fake_get.calls))
+
+  def test_modifying_result_does_not_change_cache(self):
+    self._GetSummoner(encrypted_summoner_id='summoner-id').name = 'Changed'
+
+    summoner = self._GetSummoner(encrypted_summoner_id='summoner-id')
+
+    self.assertEqual('Tester', summoner.name)
+
+  def test_list_summoners(self):
+    self._GetSummoner(summoner_name='Tester')
+
+    response = self.service.ListSummoners(
+        summoner_pb2.ListSummonersRequest(keys=[
+            summoner_pb2.GetSummonerRequest(encrypted_account_id='account-id'),
+            summoner_pb2.GetSummonerRequest(encrypted_puuid='puuid'),
+        ]), self.context)
+
+    self.assertEqual(['Tester', 'Tester'],
+                     [summoner.name for summoner in response.summoners])
+    self.assertEqual(1, len(self.fake_get.calls))
+
+
+class ChampionMasteryServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(ChampionMasteryServiceTest, self).setUp()
+    self.service = riot_api_server.ChampionMasteryService()
+    self.context = riottest.FakeContext()
+    # Riot orders masteries by champion level, then points, so points alone
+    # aren't sorted.
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/champion-mastery/v4/champion-masteries/by-summoner/'
+            'summoner-id':
+                riottest.Response([{
+                    'championId': champion_id,
+                    'championLevel': level,
+                    'championPoints': points
+                } for champion_id, level, points in [
+                    (412, 7, 150000),
+                    (64, 7, 400000),
+                    (4, 6, 60000),
+                    (86, 5, 90000),
+                    (1, 2, 1200),
+                ]]),
+            '/lol/static-data/v3/champions':
+                riottest.Response({
+                    'data': {
+                        str(champion_id): {
+                            'id': champion_id,
+                            'name': name
+                        } for champion_id, name in [
+                            (1, 'Annie'),
+                            (4, 'Twisted Fate'),
+                            (64, 'Lee Sin'),
+                            (86, 'Garen'),
+                            (412, 'Thresh'),
+                        ]
+                    }
+                }),
+        })
+
+  def _ListChampionIds(self, top_n):
+    response = self.service.ListChampionMasteries(
+        champion_mastery_pb2.ListChampionMasteriesRequest(
+            encrypted_summoner_id='summoner-id', top_n=top_n), self.context)
+    return [mastery.champion_id for mastery in response.champion_masteries]
+
+  def _ListChampionNames(self):
+    response = self.service.ListChampionMasteries(
+        champion_mastery_pb2.ListChampionMasteriesRequest(
+            encrypted_summoner_id='summoner-id', include_champion_names=True),
+        self.context)
+    return [mastery.champion_name for mastery in response.champion_masteries]
+
+  def _CountChampionListCalls(self):
+    return len([
+        url for url, _, _ in self.fake_get.calls
+        if url.endswith('/static-data/v3/champions')
+    ])
+
+  def test_list_champion_masteries(self):
+    self.assertEqual([412, 64, 4, 86, 1], self._ListChampionIds(top_n=0))
+    # Names are only looked up when requested.
+    self.assertEqual(1, len(self.fake_get.calls))
+
+  def test_include_champion_names(self):
+    self.assertEqual(['Thresh', 'Lee Sin', 'Twisted Fate', 'Garen', 'Annie'],
+                     self._ListChampionNames())
+    _, params, _ = self.fake_get.calls[-1]
+    self.assertEqual('true', params['dataById'])
+
+  def test_champion_names_are_cached(self):
+    self._ListChampionNames()
+    self._ListChampionNames()
+
+    self.assertEqual(1, self._CountChampionListCalls())
+
+  def test_unknown_champion_refetches_names(self):
+    self._ListChampionNames()
+    self.fake_get.responses[
+        '/lol/champion-mastery/v4/champion-masteries/by-summoner/'
+        'summoner-id'] = riottest.Response([{'championId': 555}])
+
+    self.assertEqual([''], self._ListChampionNames())
+    self.assertEqual(2, self._CountChampionListCalls())
+
+  def test_top_n(self):
+    test_cases = [
+        (1, [64]),
+        (3, [64, 412, 86]),
+        (5, [64, 412, 86, 4, 1]),
+        (10, [64, 412, 86, 4, 1]),
+    ]
+    for top_n, expected_champion_ids in test_cases:
+      with self.subTest(top_n=top_n):
+        self.assertEqual(expected_champion_ids, self._ListChampionIds(top_n))
+
+  def test_treat_404_as_empty(self):
+    response = self.service.ListChampionMasteries(
+        champion_mastery_pb2.ListChampionMasteriesRequest(
+            encrypted_summoner_id='unknown-id',
+            treat_404_as_empty=True,
+            include_champion_names=True), self.context)
+
+    self.assertEqual([], list(response.champion_masteries))
+
+  def test_negative_top_n(self):
+    with self.assertRaisesRegex(riottest.AbortError, 'top_n'):
+      self._ListChampionIds(top_n=-1)
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+
+class MatchServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(MatchServiceTest, self).setUp()
+    self.service = riot_api_server.MatchService()
+    self.context = riottest.FakeContext()
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/match/v4/matches/%d' % game_id:
+            riottest.Response({'gameId': game_id}) for game_id in range(1, 6)
+        })
+
+  def test_get_matches(self):
+    response = self.service.GetMatches(
+        match_pb2.GetMatchesRequest(game_ids=[5, 3, 1, 4, 2]), self.context)
+
+    self.assertEqual([5, 3, 1, 4, 2],
+                     [match.game_id for match in response.matches])
+    self.assertEqual([match_pb2.MatchError()] * 5, list(response.errors))
+    self.assertEqual(5, len(self.fake_get.calls))
+
+  def test_get_matches_reports_errors_per_match(self):
+    response = self.service.GetMatches(
+        match_pb2.GetMatchesRequest(game_ids=[1, 404, 0, 2]), self.context)
+
+    self.assertEqual([1, 0, 0, 2],
+                     [match.game_id for match in response.matches])
+    self.assertEqual([0, grpc.StatusCode.NOT_FOUND.value[0],
+                      grpc.StatusCode.INVALID_ARGUMENT.value[0], 0],
+                     [error.code for error in response.errors])
+    self.assertIn('Data not found', response.errors[1].message)
+    self.assertIsNone(self.context.code)
+
+  def test_get_matches_reports_connection_errors_per_match(self):
+    fake_get = self.fake_get
+
+    def _Get(url, **kwargs):
+      if url.endswith('/matches/3'):
+        raise requests.ConnectionError('connection reset')
+      return fake_get(url, **kwargs)
+
+    with mock.patch.object(requests, 'get', _Get):
+      response = self.service.GetMatches(
+          match_pb2.GetMatchesRequest(game_ids=[1, 3, 2]), self.context)
+
+    self.assertEqual([1, 0, 2], [match.game_id for match in response.matches])
+    self.assertEqual([0, grpc.StatusCode.UNAVAILABLE.value[0], 0],
+                     [error.code for error in response.errors])
+    self.assertIn('connection reset', response.errors[1].message)
+    self.assertIsNone(self.context.code)
+
+  def _SetMatchList(self, lanes_and_roles):
+    self.fake_get.responses[
+        '/lol/match/v4/matchlists/by-account/account-1'] = riottest.Response({
+            'matches': [{
+                'gameId': game_id,
+                'lane': lane,
+                'role': role
+            } for game_id, (lane, role) in enumerate(lanes_and_roles)],
+            'totalGames': len(lanes_and_roles)
+        })
+
+  def test_list_matches_filters_roles_and_lanes(self):
+    self._SetMatchList([
+        ('JUNGLE', 'NONE'),
+        ('MID', 'SOLO'),
+        ('MIDDLE', 'SOLO'),
+        ('BOTTOM', 'DUO_CARRY'),
+        ('BOTTOM', 'DUO_SUPPORT'),
+        ('TOP', 'SOLO'),
+    ])
+    test_cases = [
+        ('no filter', {}, [0, 1, 2, 3, 4, 5]),
+        ('lane', {'lanes': [constants_pb2.Lane.JUNGLE]}, [0]),
+        ('lane alias', {'lanes': [constants_pb2.Lane.MIDDLE]}, [1, 2]),
+        ('role', {'roles': [constants_pb2.Role.SOLO]}, [1, 2, 5]),
+        ('role and lane', {
+            'roles': [constants_pb2.Role.DUO_SUPPORT],
+            'lanes': [constants_pb2.Lane.BOT]
+        }, [4]),
+        ('several lanes', {
+            'lanes': [constants_pb2.Lane.TOP, constants_pb2.Lane.JUNGLE]
+        }, [0, 5]),
+    ]
+    for description, filters, expected_game_ids in test_cases:
+      with self.subTest(description):
+        response = self.service.ListMatches(
+            match_pb2.ListMatchesRequest(
+                encrypted_account_id='account-1', **filters), self.context)
+
+        self.assertEqual(expected_game_ids,
+                         [match.game_id for match in response.matches])
+        self.assertEqual(6, response.total_games)
+
+  def test_list_matches_paging_fields(self):
+    self.fake_get.responses[
+        '/lol/match/v4/matchlists/by-account/account-1'] = riottest.Response({
+            'matches': [{
+                'platformId': 'NA1',
+                'gameId': 3022471389,
+                'champion': 412,
+                'queue': 420,
+                'season': 13,
+                'timestamp': 1556060954474,
+                'role': 'DUO_SUPPORT',
+                'lane': 'BOTTOM'
+            }, {
+                'platformId': 'NA1',
+                'gameId': 3022428731,
+                'champion': 64,
+                'queue': 420,
+                'season': 13,
+                'timestamp': 1556057719128,
+                'role': 'NONE',
+                'lane': 'JUNGLE'
+            }],
+            'startIndex': 100,
+            'endIndex': 102,
+            'totalGames': 102
+        })
+
+    response = self.service.ListMatches(
+        match_pb2.ListMatchesRequest(
+            encrypted_account_id='account-1',
+            begin_index=100,
+            lanes=[constants_pb2.Lane.JUNGLE]), self.context)
+
+    self.assertEqual([3022428731],
+                     [match.game_id for match in response.matches])
+    # Filtering doesn't change the position in the matchlist.
+    self.assertEqual(102, response.total_games)
+    self.assertEqual(100, response.start_index)
+    self.assertEqual(102, response.end_index)
+
+  def test_list_matches_escapes_account_id(self):
+    self.fake_get.responses[
+        '/lol/match/v4/matchlists/by-account/abc%2F123%2B_-'] = (
+            riottest.Response({'matches': [{'gameId': 7}]}))
+
+    response = self.service.ListMatches(
+        match_pb2.ListMatchesRequest(encrypted_account_id='abc/123+_-'),
+        self.context)
+
+    self.assertEqual([7], [match.game_id for match in response.matches])
+
+  def test_list_matches_sends_bounds_independently(self):
+    self._SetMatchList([])
+
+    self.service.ListMatches(
+        match_pb2.ListMatchesRequest(
+            encrypted_account_id='account-1', end_time_ms=2000, end_index=50),
+        self.context)
+
+    _, params, _ = self.fake_get.calls[0]
+    self.assertEqual({'endTime': 2000, 'endIndex': 50}, params)
+
+  def test_list_matches_filter_params(self):
+    self._SetMatchList([])
+
+    self.service.ListMatches(
+        match_pb2.ListMatchesRequest(
+            encrypted_account_id='account-1',
+            queues=[constants_pb2.QueueType.RANKED_SOLO_5x5],
+            seasons=[constants_pb2.Season.SEASON2019],
+            champions=[412, 64]), self.context)
+
+    _, params, _ = self.fake_get.calls[0]
+    self.assertEqual({
+        'queue': [constants_pb2.QueueType.RANKED_SOLO_5x5],
+        'season': [constants_pb2.Season.SEASON2019],
+        'champion': [412, 64],
+    }, params)
+
+  def test_list_matches_count(self):
+    test_cases = [
+        ('count', {'count': 5}, {'endIndex': 5}),
+        ('after begin_index', {
+            'begin_index': 20,
+            'count': 5
+        }, {
+            'beginIndex': 20,
+            'endIndex': 25
+        }),
+        ('clamped', {'count': 500}, {'endIndex': 100}),
+        ('clamped after begin_index', {
+            'begin_index': 100,
+            'count': 101
+        }, {
+            'beginIndex': 100,
+            'endIndex': 200
+        }),
+    ]
+    for description, fields, expected_params in test_cases:
+      with self.subTest(description):
+        self._SetMatchList([('JUNGLE', 'NONE')])
+
+        self.service.ListMatches(
+            match_pb2.ListMatchesRequest(
+                encrypted_account_id='account-1', **fields), self.context)
+
+        _, params, _ = self.fake_get.calls[-1]
+        self.assertEqual(expected_params, params)
+
+  def test_list_matches_count_trims_response(self):
+    self._SetMatchList([('JUNGLE', 'NONE')] * 10)
+
+    response = self.service.ListMatches(
+        match_pb2.ListMatchesRequest(encrypted_account_id='account-1', count=3),
+        self.context)
+
+    self.assertEqual([0, 1, 2], [match.game_id for match in response.matches])
+
+  def test_list_matches_invalid_count(self):
+    for fields in ({'count': -1}, {'count': 5, 'end_index': 10}):
+      with self.subTest(fields=fields):
+        with self.assertRaisesRegex(riottest.AbortError, 'count'):
+          self.service.ListMatches(
+              match_pb2.ListMatchesRequest(
+                  encrypted_account_id='account-1', **fields), self.context)
+        self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_list_matches_by_queue_and_time_range(self):
+    self._SetMatchList([('JUNGLE', 'NONE')])
+
+    response = self.service.ListMatchesByQueueAndTimeRange(
+        match_pb2.ListMatchesByQueueAndTimeRangeRequest(
+            encrypted_account_id='account-1',
+            queues=[constants_pb2.QueueType.RANKED_SOLO_5x5],
+            begin_time_ms=1000,
+            end_time_ms=2000,
+            end_index=20), self.context)
+
+    self.assertEqual(1, len(response.matches))
+    _, params, _ = self.fake_get.calls[0]
+    self.assertEqual(
+        {
+            'queue': [constants_pb2.QueueType.RANKED_SOLO_5x5],
+            'beginTime': 1000,
+            'endTime': 2000,
+            'endIndex': 20
+        }, params)
+
+  def test_list_matches_by_queue_and_time_range_rejects_inverted_ranges(self):
+    test_cases = [
+        ('time', {'begin_time_ms': 2000, 'end_time_ms': 1000}),
+        ('empty time', {'begin_time_ms': 1000, 'end_time_ms': 1000}),
+        ('index', {'begin_index': 20, 'end_index': 10}),
+    ]
+    for description, ranges in test_cases:
+      with self.subTest(description):
+        context = riottest.FakeContext()
+
+        with self.assertRaisesRegex(riottest.AbortError, 'must be before'):
+          self.service.ListMatchesByQueueAndTimeRange(
+              match_pb2.ListMatchesByQueueAndTimeRangeRequest(
+                  encrypted_account_id='account-1', **ranges), context)
+
+        self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_list_all_matches_filters_after_paging(self):
+    # A full page, mostly filtered out, must not end paging early.
+    self._SetMatchList([('JUNGLE', 'NONE')] + [('TOP', 'SOLO')] * 99)
+    pages = []
+    list_matches = self.service.ListMatches
+
+    def _ListPage(request, context):
+      pages.append(request.begin_index)
+      if len(pages) > 1:
+        self._SetMatchList([('JUNGLE', 'NONE')])
+      return list_matches(request, context)
+
+    with mock.patch.object(self.service, 'ListMatches', _ListPage):
+      response = self.service.ListAllMatches(
+          match_pb2.ListAllMatchesRequest(
+              request=match_pb2.ListMatchesRequest(
+                  encrypted_account_id='account-1',
+                  lanes=[constants_pb2.Lane.JUNGLE])), self.context)
+
+    self.assertEqual([0, 100], pages)
+    self.assertEqual(2, len(response.matches))
+    self.assertEqual(0, response.start_index)
+    self.assertEqual(101, response.end_index)
+
+  def test_list_all_matches_end_index_with_limit(self):
+    self._SetMatchList([('TOP', 'SOLO'), ('JUNGLE', 'NONE'), ('TOP', 'SOLO'),
+                        ('JUNGLE', 'NONE'), ('JUNGLE', 'NONE')])
+
+    response = self.service.ListAllMatches(
+        match_pb2.ListAllMatchesRequest(
+            request=match_pb2.ListMatchesRequest(
+                encrypted_account_id='account-1',
+                lanes=[constants_pb2.Lane.JUNGLE]),
+            limit=2), self.context)
+
+    self.assertEqual([1, 3], [match.game_id for match in response.matches])
+    self.assertEqual(5, response.total_games)
+    # Listing continues after the last returned match.
+    self.assertEqual(4, response.end_index)
+
+  def _SetTimeline(self):
+    """Sets a timeline for game 1, trimmed to a few events of each kind."""
+    self.fake_get.responses['/lol/match/v4/timelines/by-match/1'] = (
+        riottest.Response({
+            'frameInterval': 60000,
+            'frames': [{
+                'timestamp': 0,
+                'participantFrames': {
+                    str(participant_id): {
+                        'participantId': participant_id,
+                        'position': {'x': 500, 'y': 500},
+                        'currentGold': 500,
+                        'totalGold': 500,
+                        'level': 1,
+                    } for participant_id in (1, 2, 6)
+                },
+                'events': [{
+                    'type': 'ITEM_PURCHASED',
+                    'timestamp': 1000,
+                    'participantId': 6,
+                    'itemId': 1055,
+                }, {
+                    'type': 'WARD_PLACED',
+                    'timestamp': 50000,
+                    'wardType': 'YELLOW_TRINKET',
+                    'creatorId': 1,
+                }],
+            }, {
+                'timestamp': 60000,
+                'participantFrames': {},
+                'events': [{
+                    'type': 'CHAMPION_KILL',
+                    'timestamp': 61000,
+                    'position': {'x': 7000, 'y': 7000},
+                    'killerId': 1,
+                    'victimId': 6,
+                    'assistingParticipantIds': [2],
+                }, {
+                    'type': 'ELITE_MONSTER_KILL',
+                    'timestamp': 62000,
+                    'killerId': 2,
+                    'monsterType': 'DRAGON',
+                    'monsterSubType': 'FIRE_DRAGON',
+                }, {
+                    'type': 'CHAMPION_KILL',
+                    'timestamp': 63000,
+                    'killerId': 7,
+                    'victimId': 1,
+                    'assistingParticipantIds': [],
+                }],
+            }],
+        }))
+
+  def _GetMatchTimeline(self, **filters):
+    return self.service.GetMatchTimeline(
+        match_pb2.GetMatchTimelineRequest(game_id=1, **filters), self.context)
+
+  def _EventTimestamps(self, timeline):
+    return [event.timestamp for frame in timeline.frames
+            for event in frame.events]
+
+  def test_get_match_timeline(self):
+    self._SetTimeline()
+    # The timeline must match Riot's schema.
+    riot_api_lib.SetStrictParsing(True)
+    self.addCleanup(riot_api_lib.SetStrictParsing, False)
+
+    timeline = self._GetMatchTimeline()
+
+    self.assertEqual(60000, timeline.frame_interval)
+    self.assertEqual([1000, 50000, 61000, 62000, 63000],
+                     self._EventTimestamps(timeline))
+    self.assertEqual(['1', '2', '6'],
+                     sorted(timeline.frames[0].participant_frames))
+    self.assertEqual([2],
+                     timeline.frames[1].events[0].assisting_participant_ids)
+
+  def test_get_match_timeline_champion_kills(self):
+    self._SetTimeline()
+
+    timeline = self._GetMatchTimeline(event_types=['CHAMPION_KILL'])
+
+    self.assertEqual([61000, 63000], self._EventTimestamps(timeline))
+    self.assertEqual(
+        ['CHAMPION_KILL'] * 2,
+        [event.type for frame in timeline.frames for event in frame.events])
+    # Frames are still returned, with every participant.
+    self.assertEqual(2, len(timeline.frames))
+    self.assertEqual(3, len(timeline.frames[0].participant_frames))
+
+  def test_get_match_timeline_participants(self):
+    self._SetTimeline()
+    test_cases = [
+        # Creator, killer and victim.
+        ([1], [50000, 61000, 63000]),
+        # Assisting and killing a monster.
+        ([2], [61000, 62000]),
+        ([2, 6], [1000, 61000, 62000]),
+    ]
+    for participant_ids, expected_timestamps in test_cases:
+      with self.subTest(participant_ids=participant_ids):
+        timeline = self._GetMatchTimeline(participant_ids=participant_ids)
+
+        self.assertEqual(expected_timestamps, self._EventTimestamps(timeline))
+        self.assertEqual([str(i) for i in participant_ids],
+                         sorted(timeline.frames[0].participant_frames))
+
+  def test_get_match_timeline_champion_kills_of_participant(self):
+    self._SetTimeline()
+
+    timeline = self._GetMatchTimeline(
+        event_types=['CHAMPION_KILL'], participant_ids=[6])
+
+    self.assertEqual([61000], self._EventTimestamps(timeline))
+
+  def test_get_match_timeline_requires_game_id(self):
+    with self.assertRaises(riottest.AbortError):
+      self.service.GetMatchTimeline(match_pb2.GetMatchTimelineRequest(),
+                                    self.context)
+
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+  def _StreamAccountMatches(self, limit=0, **kwargs):
+    return self.service.StreamAccountMatches(
+        match_pb2.StreamAccountMatchesRequest(
+            request=match_pb2.ListMatchesRequest(
+                encrypted_account_id='account-1', **kwargs),
+            limit=limit), self.context)
+
+  def _MatchCalls(self):
+    return [
+        url for url, _, _ in self.fake_get.calls
+        if '/lol/match/v4/matches/' in url
+    ]
+
+  def test_stream_account_matches(self):
+    self._SetMatchList([('JUNGLE', 'NONE'), ('TOP', 'SOLO'), ('JUNGLE', 'NONE'),
+                        ('TOP', 'SOLO'), ('JUNGLE', 'NONE'), ('TOP', 'SOLO')])
+    self.fake_get.responses['/lol/match/v4/matches/0'] = riottest.Response(
+        {'gameId': 0})
+
+    matches = self._StreamAccountMatches()
+
+    self.assertEqual([0, 1, 2, 3, 4, 5],
+                     [match.game_id for match in matches])
+
+  def test_stream_account_matches_filters_and_limits(self):
+    self._SetMatchList([('TOP', 'SOLO'), ('JUNGLE', 'NONE'), ('TOP', 'SOLO'),
+                        ('JUNGLE', 'NONE'), ('JUNGLE', 'NONE')])
+
+    matches = self._StreamAccountMatches(
+        limit=2, lanes=[constants_pb2.Lane.JUNGLE])
+
+    self.assertEqual([1, 3], [match.game_id for match in matches])
+    # Matches filtered out or past the limit aren't fetched.
+    self.assertCountEqual([
+        'https://na1.api.riotgames.com/lol/match/v4/matches/1',
+        'https://na1.api.riotgames.com/lol/match/v4/matches/3'
+    ], self._MatchCalls())
+
+  def test_stream_account_matches_pages_as_client_reads(self):
+    # A full page, so there may be more.
+    self._SetMatchList([('TOP', 'SOLO')] * 100)
+    for game_id in range(100):
+      self.fake_get.responses['/lol/match/v4/matches/%d' %
+                              game_id] = riottest.Response({'gameId': game_id})
+    riot_api_lib.SetFanOutConcurrency(2)
+    self.addCleanup(riot_api_lib.SetFanOutConcurrency, 8)
+
+    matches = self._StreamAccountMatches()
+    self.assertEqual(0, next(matches).game_id)
+
+    # Only the first page is listed, and matches are only fetched up to the
+    # concurrency limit ahead of the client.
+    urls = [url for url, _, _ in list(self.fake_get.calls)]
+    self.assertEqual(1, sum('/matchlists/' in url for url in urls))
+    self.assertLessEqual(sum('/matches/' in url for url in urls), 2)
+    matches.close()
+
+  def test_stream_account_matches_requires_account(self):
+    with self.assertRaises(riottest.AbortError):
+      list(
+          self.service.StreamAccountMatches(
+              match_pb2.StreamAccountMatchesRequest(), self.context))
+
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_stream_account_matches_aborts_on_error(self):
+    self._SetMatchList([('TOP', 'SOLO'), ('TOP', 'SOLO')])
+    self.fake_get.responses['/lol/match/v4/matches/0'] = riottest.Response(
+        {'gameId': 0})
+    self.fake_get.responses['/lol/match/v4/matches/1'] = riottest.Response(
+        {'status': {'status_code': 404}}, 404)
+    matches = self._StreamAccountMatches()
+
+    self.assertEqual(0, next(matches).game_id)
+    with self.assertRaises(riottest.AbortError):
+      next(matches)
+
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+
+class GetMatchParticipantByAccountTest(unittest.TestCase):
+
+  def setUp(self):
+    super(GetMatchParticipantByAccountTest, self).setUp()
+    # A match as returned by Riot, trimmed to four players. Identities and
+    # participants are listed in different orders to check the correlation.
+    players = [
+        (1, 'account-1', 'current-account-1', 'summoner-1', 'Top Laner', 86),
+        (2, 'account-2', 'account-2', 'summoner-2', 'Jungler', 64),
+        (6, 'account-6', 'account-6', 'summoner-6', 'Mid Laner', 4),
+        (7, 'account-7', 'account-7', 'summoner-7', 'Support', 412),
+    ]
+    riottest.PatchRequestsGet(
+        self, {
+            '/lol/match/v4/matches/3022428731':
+                riottest.Response({
+                    'gameId': 3022428731,
+                    'platformId': 'NA1',
+                    'queueId': 420,
+                    'participantIdentities': [{
+                        'participantId': participant_id,
+                        'player': {
+                            'platformId': 'NA1',
+                            'accountId': account_id,
+                            'currentPlatformId': 'NA1',
+                            'currentAccountId': current_account_id,
+                            'summonerId': summoner_id,
+                            'summonerName': name,
+                            'profileIcon': 3379
+                        }
+                    } for (participant_id, account_id, current_account_id,
+                           summoner_id, name, _) in players],
+                    'participants': [{
+                        'participantId': participant_id,
+                        'teamId': 100 if participant_id <= 5 else 200,
+                        'championId': champion_id,
+                        'stats': {
+                            'participantId': participant_id,
+                            'win': participant_id <= 5
+                        }
+                    } for participant_id, _, _, _, _, champion_id in reversed(
+                        players)],
+                })
+        })
+    self.match = riot_api_server.MatchService().GetMatch(
+        match_pb2.GetMatchRequest(game_id=3022428731), riottest.FakeContext())
+
+  def test_get_participant(self):
+    test_cases = [
+        ('account-2', 64),
+        ('account-6', 4),
+        ('summoner-7', 412),
+        # Players who transferred are found by either account.
+        ('account-1', 86),
+        ('current-account-1', 86),
+    ]
+    for encrypted_id, expected_champion_id in test_cases:
+      with self.subTest(encrypted_id=encrypted_id):
+        participant = riot_api_server.GetMatchParticipantByAccount(
+            self.match, encrypted_id)
+
+        self.assertEqual(expected_champion_id, participant.champion_id)
+
+  def test_participant_stats(self):
+    participant = riot_api_server.GetMatchParticipantByAccount(
+        self.match, 'account-7')
+
+    self.assertEqual(7, participant.participant_id)
+    self.assertEqual(200, participant.team_id)
+    self.assertFalse(participant.stats.win)
+
+  def test_not_found(self):
+    self.assertIsNone(
+        riot_api_server.GetMatchParticipantByAccount(self.match, 'account-3'))
+    self.match.participant_identities[0].player.ClearField('current_account_id')
+    self.assertIsNone(
+        riot_api_server.GetMatchParticipantByAccount(self.match, ''))
+
+  def test_identity_without_participant(self):
+    del self.match.participants[:]
+
+    self.assertIsNone(
+        riot_api_server.GetMatchParticipantByAccount(self.match, 'account-2'))
+
+
+class SpectatorServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(SpectatorServiceTest, self).setUp()
+    self.service = riot_api_server.SpectatorService()
+    self.context = riottest.FakeContext()
+    self.fake_get = riottest.PatchRequestsGet(self, {})
+
+  def _SetFeaturedGames(self, game_ids):
+    self.fake_get.responses['/lol/spectator/v4/featured-games'] = (
+        riottest.Response({
+            'gameList': [{
+                'gameId': game_id
+            } for game_id in game_ids],
+            'clientRefreshInterval': 300
+        }))
+
+  def test_get_active_game_by_name(self):
+    self.fake_get.responses.update({
+        '/lol/summoner/v4/summoners/by-name/ingame':
+            riottest.Response({'id': 'summoner-1'}),
+        '/lol/spectator/v4/active-games/by-summoner/summoner-1':
+            riottest.Response({'gameId': 123}),
+    })
+
+    game = self.service.GetActiveGameByName(
+        spectator_pb2.GetActiveGameByNameRequest(summoner_name='In Game'),
+        self.context)
+
+    self.assertEqual(123, game.game_id)
+
+  def test_get_active_game_by_name_not_in_game(self):
+    self.fake_get.responses[
+        '/lol/summoner/v4/summoners/by-name/idle'] = riottest.Response(
+            {'id': 'summoner-2'})
+
+    with self.assertRaisesRegex(riottest.AbortError,
+                                'Summoner Idle is not in an active game'):
+      self.service.GetActiveGameByName(
+          spectator_pb2.GetActiveGameByNameRequest(summoner_name='Idle'),
+          self.context)
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+  def _SetActiveGame(self, summoner_id, participants):
+    self.fake_get.responses[
+        '/lol/spectator/v4/active-games/by-summoner/' + summoner_id] = (
+            riottest.Response({
+                'gameId': 123,
+                'participants': participants
+            }))
+
+  def test_get_active_game_participant(self):
+    participants = [{
+        'summonerId': 'summoner-%d' % i,
+        'summonerName': 'Player %d' % i,
+        'championId': i,
+        'spell1Id': 4,
+        'spell2Id': 14,
+        'perks': {
+            'perkIds': [8112, 8143],
+            'perkStyle': 8100,
+            'perkSubStyle': 8300
+        }
+    } for i in range(1, 4)]
+    self._SetActiveGame('summoner-2', participants)
+    self.fake_get.responses[
+        '/lol/summoner/v4/summoners/by-name/player2'] = riottest.Response(
+            {'id': 'summoner-2'})
+    test_cases = [
+        ('id', {'encrypted_summoner_id': 'summoner-2'}),
+        ('name', {'summoner_name': 'Player 2'}),
+    ]
+    for key_type, fields in test_cases:
+      with self.subTest(key_type=key_type):
+        participant = self.service.GetActiveGameParticipant(
+            spectator_pb2.GetActiveGameParticipantRequest(**fields),
+            self.context)
+
+        self.assertEqual('summoner-2', participant.summoner_id)
+        self.assertEqual(2, participant.champion_id)
+        self.assertEqual(4, participant.spell1_id)
+        self.assertEqual(14, participant.spell2_id)
+        self.assertEqual(8100, participant.perks.perk_style)
+        self.assertEqual([8112, 8143], list(participant.perks.perk_ids))
+
+  def test_get_active_game_participant_not_in_game(self):
+    with self.assertRaisesRegex(riottest.AbortError,
+                                'Summoner summoner-4 is not in an active game'):
+      self.service.GetActiveGameParticipant(
+          spectator_pb2.GetActiveGameParticipantRequest(
+              encrypted_summoner_id='summoner-4'), self.context)
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+  def test_get_active_game_participant_missing_from_game(self):
+    self._SetActiveGame('summoner-5', [{'summonerId': 'summoner-1'}])
+
+    with self.assertRaisesRegex(riottest.AbortError,
+                                'summoner-5 is not a participant of game 123'):
+      self.service.GetActiveGameParticipant(
+          spectator_pb2.GetActiveGameParticipantRequest(
+              encrypted_summoner_id='summoner-5'), self.context)
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+  def test_get_active_game_participant_requires_summoner(self):
+    for request in (spectator_pb2.GetActiveGameParticipantRequest(),
+                    spectator_pb2.GetActiveGameParticipantRequest(
+                        summoner_name='')):
+      with self.subTest(request=request):
+        with self.assertRaises(riottest.AbortError):
+          self.service.GetActiveGameParticipant(request, self.context)
+        self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_get_active_game_by_name_uses_summoner_service(self):
+    summoner_service = mock.Mock()
+    summoner_service.GetSummoner.return_value = summoner_pb2.Summoner(
+        id='summoner-3')
+    self.fake_get.responses[
+        '/lol/spectator/v4/active-games/by-summoner/summoner-3'] = (
+            riottest.Response({'gameId': 456}))
+    service = riot_api_server.SpectatorService(summoner_service)
+
+    game = service.GetActiveGameByName(
+        spectator_pb2.GetActiveGameByNameRequest(summoner_name='Mocked'),
+        self.context)
+
+    self.assertEqual(456, game.game_id)
+    summoner_service.GetSummoner.assert_called_once_with(
+        summoner_pb2.GetSummonerRequest(summoner_name='Mocked'), self.context)
+
+  def test_watch_featured_games_streams_changes(self):
+    polls = [[1, 2], [1, 2], [2, 3]]
+    self._SetFeaturedGames(polls.pop(0))
+    sleeps = []
+
+    def _FakeSleep(unused_context, seconds):
+      sleeps.append(seconds)
+      if not polls:
+        return False
+      self._SetFeaturedGames(polls.pop(0))
+      return True
+
+    with mock.patch.object(riot_api_lib, 'SleepWhileActive', _FakeSleep):
+      deltas = list(
+          self.service.WatchFeaturedGames(
+              spectator_pb2.WatchFeaturedGamesRequest(), self.context))
+
+    # The unchanged second poll isn't streamed.
+    self.assertEqual(2, len(deltas))
+    self.assertEqual([1, 2], [game.game_id for game in deltas[0].started])
+    self.assertEqual([], list(deltas[0].ended_game_ids))
+    self.assertEqual([3], [game.game_id for game in deltas[1].started])
+    self.assertEqual([1], list(deltas[1].ended_game_ids))
+    self.assertEqual(3, len(self.fake_get.calls))
+    self.assertEqual([300, 300, 300], sleeps)
+
+  def test_watch_featured_games_poll_interval(self):
+    self._SetFeaturedGames([1])
+    mock_sleep = mock.Mock(return_value=False)
+
+    with mock.patch.object(riot_api_lib, 'SleepWhileActive', mock_sleep):
+      list(
+          self.service.WatchFeaturedGames(
+              spectator_pb2.WatchFeaturedGamesRequest(poll_interval_secs=1),
+              self.context))
+
+    mock_sleep.assert_called_once_with(self.context, 10)
+
+  def test_watch_featured_games_stops_when_cancelled(self):
+    self._SetFeaturedGames([1])
+    deltas = self.service.WatchFeaturedGames(
+        spectator_pb2.WatchFeaturedGamesRequest(), self.context)
+    next(deltas)
+
+    self.context.Cancel()
+
+    self.assertEqual([], list(deltas))
+    self.assertEqual(1, len(self.fake_get.calls))
+
+  def test_watch_featured_games_limits_watchers(self):
+    self._SetFeaturedGames([1])
+    service = riot_api_server.SpectatorService(max_watchers=1)
+    deltas = service.WatchFeaturedGames(
+        spectator_pb2.WatchFeaturedGamesRequest(), self.context)
+    next(deltas)
+    context = riottest.FakeContext()
+
+    with self.assertRaisesRegex(riottest.AbortError, 'At most 1'):
+      next(
+          service.WatchFeaturedGames(spectator_pb2.WatchFeaturedGamesRequest(),
+                                     context))
+    self.assertEqual(grpc.StatusCode.RESOURCE_EXHAUSTED, context.code)
+    # Ending a watcher makes room for another.
+    deltas.close()
+    self.assertEqual(
+        [1],
+        [game.game_id for game in next(
+            service.WatchFeaturedGames(
+                spectator_pb2.WatchFeaturedGamesRequest(),
+                riottest.FakeContext())).started])
+
+
+class ValidationTest(unittest.TestCase):
+
+  def test_missing_required_fields(self):
+    test_cases = [
+        (riot_api_server.SummonerService().GetSummoner,
+         summoner_pb2.GetSummonerRequest(summoner_name=''), 'summoner_name'),
+        (riot_api_server.SummonerService().GetSummoner,
+         summoner_pb2.GetSummonerRequest(encrypted_account_id=''),
+         'encrypted_account_id'),
+        (riot_api_server.MatchService().ListMatches,
+         match_pb2.ListMatchesRequest(), 'encrypted_account_id'),
+        (riot_api_server.MatchService().ListAllMatches,
+         match_pb2.ListAllMatchesRequest(), 'encrypted_account_id'),
+        (riot_api_server.MatchService().ListMatchesByQueueAndTimeRange,
+         match_pb2.ListMatchesByQueueAndTimeRangeRequest(),
+         'encrypted_account_id'),
+        (riot_api_server.MatchService().ListTournamentMatchIds,
+         match_pb2.ListTournamentMatchIdsRequest(), 'tournament_code'),
+        (riot_api_server.MatchService().GetMatch,
+         match_pb2.GetMatchRequest(tournament_code='NA-code'), 'game_id'),
+        (riot_api_server.ChampionMasteryService().ListChampionMasteries,
+         champion_mastery_pb2.ListChampionMasteriesRequest(),
+         'encrypted_summoner_id'),
+        (riot_api_server.ChampionMasteryService().GetChampionMastery,
+         champion_mastery_pb2.GetChampionMasteryRequest(
+             encrypted_summoner_id='summoner-1'), 'champion_id'),
+        (riot_api_server.ChampionMasteryService().GetChampionMasteryScore,
+         champion_mastery_pb2.GetChampionMasteryScoreRequest(),
+         'encrypted_summoner_id'),
+        (riot_api_server.LeagueService().ListLeaguePositions,
+         league_pb2.ListLeaguePositionsRequest(), 'encrypted_summoner_id'),
+        (riot_api_server.ClashService().ListPlayers,
+         clash_pb2.ListPlayersRequest(), 'encrypted_summoner_id'),
+        (riot_api_server.ClashService().GetTeam, clash_pb2.GetTeamRequest(),
+         'team_id'),
+        (riot_api_server.ClashService().GetTournamentByTeam,
+         clash_pb2.GetTournamentByTeamRequest(), 'team_id'),
+        (riot_api_server.ClashService().GetTournament,
+         clash_pb2.GetTournamentRequest(), 'tournament_id'),
+    ]
+    fake_get = riottest.PatchRequestsGet(self, {})
+    for method, request, missing_field in test_cases:
+      with self.subTest(method=method.__name__, missing_field=missing_field):
+        context = riottest.FakeContext()
+
+        with self.assertRaisesRegex(riottest.AbortError, missing_field):
+          method(request, context)
+
+        self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, context.code)
+    self.assertEqual([], fake_get.calls)
+
+
+class AccountServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(AccountServiceTest, self).setUp()
+    self.service = riot_api_server.AccountService()
+    self.context = riottest.FakeContext()
+    self.account = {
+        'puuid': 'puuid-1',
+        'gameName': '하이프 봇',
+        'tagLine': 'KR/1'
+    }
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/riot/account/v1/accounts/by-riot-id/'
+            '%ED%95%98%EC%9D%B4%ED%94%84%20%EB%B4%87/KR%2F1':
+                riottest.Response(self.account),
+            '/riot/account/v1/accounts/by-puuid/puuid-1':
+                riottest.Response(self.account),
+        })
+    self.expected_account = account_pb2.Account(
+        puuid='puuid-1', game_name='하이프 봇', tag_line='KR/1')
+
+  def test_get_account_by_riot_id(self):
+    account = self.service.GetAccountByRiotId(
+        account_pb2.GetAccountByRiotIdRequest(
+            game_name='하이프 봇', tag_line='KR/1'), self.context)
+
+    self.assertEqual(self.expected_account, account)
+    url = self.fake_get.calls[0][0]
+    self.assertEqual(
+        'https://americas.api.riotgames.com/riot/account/v1/accounts/'
+        'by-riot-id/%ED%95%98%EC%9D%B4%ED%94%84%20%EB%B4%87/KR%2F1', url)
+
+  def test_get_account_by_puuid(self):
+    account = self.service.GetAccountByPuuid(
+        account_pb2.GetAccountByPuuidRequest(puuid='puuid-1'), self.context)
+
+    self.assertEqual(self.expected_account, account)
+    self.assertTrue(self.fake_get.calls[0][0].startswith(
+        'https://americas.api.riotgames.com/'))
+
+  def test_get_account_by_riot_id_requires_tag_line(self):
+    with self.assertRaises(riottest.AbortError):
+      self.service.GetAccountByRiotId(
+          account_pb2.GetAccountByRiotIdRequest(game_name='하이프 봇'),
+          self.context)
+
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+    self.assertEqual([], self.fake_get.calls)
+
+
+class ThirdPartyCodeServiceTest(unittest.TestCase):
+
+  def test_get_third_party_code(self):
+    riottest.PatchRequestsGet(
+        self, {
+            '/lol/platform/v3/third-party-code/by-summoner/123':
+                riottest.Response('hype "code"'),
+        })
+
+    code = riot_api_server.ThirdPartyCodeService().GetThirdPartyCode(
+        third_party_code_pb2.GetThirdPartyCodeRequest(summoner_id=123),
+        riottest.FakeContext())
+
+    self.assertEqual('hype "code"', code.code)
+
+
+class TournamentServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(TournamentServiceTest, self).setUp()
+    self.service = riot_api_server.TournamentService()
+    self.context = riottest.FakeContext()
+    self.fake_post = riottest.PatchRequestsPost(self, {
+        '/lol/tournament/v3/providers': riottest.Response(12),
+        '/lol/tournament/v3/tournaments': riottest.Response(345),
+        '/lol/tournament/v3/codes': riottest.Response(['NA-code1', 'NA-code2']),
+    })
+
+  def test_register_provider(self):
+    request = tournament_pb2.RegisterProviderRequest(
+        region='NA', url='https://hypebot.example/results')
+
+    response = self.service.RegisterProvider(request, self.context)
+
+    self.assertEqual(12, response.provider_id)
+    url, _, headers, body = self.fake_post.calls[0]
+    self.assertEqual(
+        'https://americas.api.riotgames.com/lol/tournament/v3/providers', url)
+    self.assertEqual('application/json', headers['Content-Type'])
+    self.assertEqual({
+        'region': 'NA',
+        'url': 'https://hypebot.example/results'
+    }, body)
+
+  def test_register_tournament(self):
+    request = tournament_pb2.RegisterTournamentRequest(
+        provider_id=12, name='Hype Cup')
+
+    response = self.service.RegisterTournament(request, self.context)
+
+    self.assertEqual(345, response.tournament_id)
+    _, _, _, body = self.fake_post.calls[0]
+    self.assertEqual({'providerId': 12, 'name': 'Hype Cup'}, body)
+
+  def test_create_tournament_codes(self):
+    parameters = tournament_pb2.TournamentCodeParameters
+    request = tournament_pb2.CreateTournamentCodesRequest(
+        tournament_id=345,
+        count=2,
+        parameters=parameters(
+            allowed_summoner_ids=['summoner-1', 'summoner-2'],
+            map_type=parameters.SUMMONERS_RIFT,
+            metadata='round 1',
+            pick_type=parameters.TOURNAMENT_DRAFT,
+            spectator_type=parameters.LOBBYONLY,
+            team_size=5))
+
+    response = self.service.CreateTournamentCodes(request, self.context)
+
+    self.assertEqual(['NA-code1', 'NA-code2'], response.codes)
+    _, params, _, body = self.fake_post.calls[0]
+    self.assertEqual({'tournamentId': 345, 'count': 2}, params)
+    self.assertEqual(
+        {
+            'allowedSummonerIds': ['summoner-1', 'summoner-2'],
+            'mapType': 'SUMMONERS_RIFT',
+            'metadata': 'round 1',
+            'pickType': 'TOURNAMENT_DRAFT',
+            'spectatorType': 'LOBBYONLY',
+            'teamSize': 5,
+        }, body)
+
+  def test_error_aborts(self):
+    self.fake_post.responses['/lol/tournament/v3/tournaments'] = (
+        riottest.Response({'status': {'status_code': 400}}, 400))
+
+    with self.assertRaises(riottest.AbortError):
+      self.service.RegisterTournament(
+          tournament_pb2.RegisterTournamentRequest(provider_id=12),
+          self.context)
+
+    self.assertEqual(grpc.StatusCode.INVALID_ARGUMENT, self.context.code)
+
+
+class TournamentStubServiceTest(unittest.TestCase):
+
+  def setUp(self):
+    super(TournamentStubServiceTest, self).setUp()
+    self.service = riot_api_server.TournamentStubService()
+    self.context = riottest.FakeContext()
+
+  def test_register_provider_uses_stub(self):
+    fake_post = riottest.PatchRequestsPost(
+        self, {'/lol/tournament-stub/v3/providers': riottest.Response(1)})
+
+    response = self.service.RegisterProvider(
+        tournament_pb2.RegisterProviderRequest(region='NA'), self.context)
+
+    self.assertEqual(1, response.provider_id)
+    url, _, _, body = fake_post.calls[0]
+    self.assertEqual(
+        'https://americas.api.riotgames.com/lol/tournament-stub/v3/providers',
+        url)
+    self.assertEqual({'region': 'NA'}, body)
+
+  def test_list_lobby_events(self):
+    riottest.PatchRequestsGet(
+        self, {
+            '/lol/tournament-stub/v3/lobby-events/by-code/NA%2Fcode':
+                riottest.Response({
+                    'eventList': [{
+                        'summonerId': 'summoner-1',
+                        'eventType': 'PlayerJoinedGameEvent',
+                        'timestamp': '1234'
+                    }]
+                }),
+        })
+
+    events = self.service.ListLobbyEvents(
+        tournament_stub_pb2.ListLobbyEventsRequest(tournament_code='NA/code'),
+        self.context)
+
+    self.assertEqual([
+        tournament_stub_pb2.LobbyEvent(
+            summoner_id='summoner-1',
+            event_type='PlayerJoinedGameEvent',
+            timestamp='1234')
+    ], list(events.event_list))
+
+
+class _FakeRiotHandler(http_server.BaseHTTPRequestHandler):
+  """Serves the server's canned responses, keyed by request path."""
+
+  def do_GET(self):  # pylint: disable=invalid-name
+    self.server.requests.append((self.path, dict(self.headers)))
+    status_code, body = self.server.responses.get(
+        parse.urlparse(self.path).path,
+        (404, {'status': {'message': 'Not found', 'status_code': 404}}))
+    content = json.dumps(body).encode('utf-8')
+    self.send_response(status_code)
+    self.send_header('Content-Type', 'application/json;charset=utf-8')
+    self.send_header('Content-Length', str(len(content)))
+    self.end_headers()
+    self.wfile.write(content)
+
+  def log_message(self, *unused_args):
+    pass
+
+
+class _RecordingSession(requests.Session):
+  """A requests.Session which records the URL of every request it sends."""
+
+  def __init__(self):
+    super(_RecordingSession, self).__init__()
+    self.urls = []
+
+  def request(self, method, url, *args, **kwargs):
+    self.urls.append(url)
+    return super(_RecordingSession, self).request(method, url, *args, **kwargs)
+
+
+class FakeHostTest(unittest.TestCase):
+  """Exercises each service over HTTP against a local fake Riot API."""
+
+  @classmethod
+  def setUpClass(cls):
+    super(FakeHostTest, cls).setUpClass()
+    cls.server = http_server.ThreadingHTTPServer(('127.0.0.1', 0),
+                                                 _FakeRiotHandler)
+    threading.Thread(target=cls.server.serve_forever, daemon=True).start()
+
+  @classmethod
+  def tearDownClass(cls):
+    cls.server.shutdown()
+    cls.server.server_close()
+    super(FakeHostTest, cls).tearDownClass()
+
+  def setUp(self):
+    super(FakeHostTest, self).setUp()
+    self.server.requests = []
+    self.server.responses = {}
+    port = self.server.server_address[1]
+    # Keep the route in the path so tests can check it was chosen correctly.
+    riot_api_lib.SetBaseUrlFn(lambda route: 'http://127.0.0.1:%d/%s' %
+                              (port, route))
+    self.addCleanup(riot_api_lib.SetBaseUrlFn, None)
+    self.session = _RecordingSession()
+    riot_api_lib.SetHttpSession(self.session)
+    self.addCleanup(riot_api_lib.SetHttpSession, None)
+    self.context = riottest.FakeContext(platform_id='EUW1')
+
+  def _Respond(self, path, body, status_code=200):
+    self.server.responses[path] = (status_code, body)
+
+  def test_services_share_session(self):
+    calls = [
+        (riot_api_server.ChampionService().GetChampionRotations,
+         champion_pb2.GetChampionRotationsRequest()),
+        (riot_api_server.LoLStatusService().GetShardData,
+         lol_status_pb2.GetShardDataRequest()),
+        (riot_api_server.StaticDataService().ListVersions,
+         static_data_pb2.ListVersionsRequest()),
+        (riot_api_server.SummonerService().GetSummoner,
+         summoner_pb2.GetSummonerRequest(encrypted_summoner_id='abc')),
+    ]
+    # Nothing is served, so each call fails after one request.
+    for method, request in calls:
+      with self.assertRaises(riottest.AbortError):
+        method(request, self.context)
+
+    self.assertEqual(len(calls), len(self.session.urls))
+    self.assertEqual(len(calls), len(self.server.requests))
+
+  def test_champion_service(self):
+    self._Respond('/euw1/lol/platform/v3/champion-rotations',
+                  {'freeChampionIds': [1, 2, 3]})
+
+    rotations = riot_api_server.ChampionService().GetChampionRotations(
+        champion_pb2.GetChampionRotationsRequest(), self.context)
+
+    self.assertEqual([1, 2, 3], list(rotations.free_champion_ids))
+    _, headers = self.server.requests[0]
+    self.assertEqual('test-key', headers['X-Riot-Token'])
+
+  def test_champion_mastery_service(self):
+    self._Respond(
+        '/euw1/lol/champion-mastery/v4/champion-masteries/by-summoner/abc/'
+        'by-champion/64', {
+            'championId': 64,
+            'championLevel': 7
+        })
+
+    mastery = riot_api_server.ChampionMasteryService().GetChampionMastery(
+        champion_mastery_pb2.GetChampionMasteryRequest(
+            encrypted_summoner_id='abc', champion_id=64), self.context)
+
+    self.assertEqual(7, mastery.champion_level)
+
+  def test_league_service(self):
+    self._Respond('/euw1/lol/league/v4/entries/by-summoner/abc', [{
+        'wins': 10,
+        'losses': 5
+    }])
+
+    response = riot_api_server.LeagueService().ListLeaguePositions(
+        league_pb2.ListLeaguePositionsRequest(encrypted_summoner_id='abc'),
+        self.context)
+
+    self.assertEqual(1, len(response.positions))
+    self.assertEqual(10, response.positions[0].wins)
+
+  def test_lol_status_service(self):
+    self._Respond('/euw1/lol/status/v3/shard-data', {'name': 'EU West'})
+
+    shard = riot_api_server.LoLStatusService().GetShardData(
+        lol_status_pb2.GetShardDataRequest(), self.context)
+
+    self.assertEqual('EU West', shard.name)
+
+  def test_match_service(self):
+    self._Respond('/euw1/lol/match/v4/matches/123', {'gameId': 123})
+
+    match = riot_api_server.MatchService().GetMatch(
+        match_pb2.GetMatchRequest(game_id=123), self.context)
+
+    self.assertEqual(123, match.game_id)
+
+  def test_spectator_service(self):
+    self._Respond('/euw1/lol/spectator/v4/featured-games', {
+        'gameList': [],
+        'clientRefreshInterval': 300
+    })
+
+    response = riot_api_server.SpectatorService().ListFeaturedGames(
+        spectator_pb2.ListFeaturedGamesRequest(), self.context)
+
+    self.assertEqual(300, response.client_refresh_interval)
+
+  def test_static_data_service(self):
+    self._Respond('/euw1/lol/static-data/v3/versions', ['8.24.1', '8.23.1'])
+
+    response = riot_api_server.StaticDataService().ListVersions(
+        static_data_pb2.ListVersionsRequest(), self.context)
+
+    self.assertEqual(['8.24.1', '8.23.1'], list(response.versions))
+
+  def test_summoner_service(self):
+    self._Respond('/euw1/lol/summoner/v4/summoners/abc', {'name': 'Tester'})
+
+    summoner = riot_api_server.SummonerService().GetSummoner(
+        summoner_pb2.GetSummonerRequest(encrypted_summoner_id='abc'),
+        self.context)
+
+    self.assertEqual('Tester', summoner.name)
+
+  def test_summoner_names_are_normalized_and_escaped(self):
+    test_cases = [
+        ('Hide on bush', 'hideonbush'),
+        ('Faker/T1?', 'faker%2Ft1%3F'),
+        ('\ud398\uc774\ucee4', '%ED%8E%98%EC%9D%B4%EC%BB%A4'),
+    ]
+    for name, escaped_name in test_cases:
+      with self.subTest(name=name):
+        self._Respond('/euw1/lol/summoner/v4/summoners/by-name/' + escaped_name,
+                      {'name': name})
+
+        summoner = riot_api_server.SummonerService().GetSummoner(
+            summoner_pb2.GetSummonerRequest(summoner_name=name), self.context)
+
+        self.assertEqual(name, summoner.name)
+
+  def test_errors_are_propagated(self):
+    with self.assertRaises(riottest.AbortError):
+      riot_api_server.SummonerService().GetSummoner(
+          summoner_pb2.GetSummonerRequest(encrypted_summoner_id='unknown'),
+          self.context)
+
+    self.assertEqual(grpc.StatusCode.NOT_FOUND, self.context.code)
+
+
+if __name__ == '__main__':
+  unittest.main()
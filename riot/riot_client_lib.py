@@ -0,0 +1,115 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Helpers for gRPC clients of riot_api_server.
+
+Every call to the server is sent to the platform in its platform-id metadata,
+authenticated with the Riot API key in its api-key metadata. Rather than
+building the metadata for each call, clients can wrap their channel once:
+
+  channel = riot_client_lib.WithRiotMetadata(
+      grpc.insecure_channel('localhost:50051'), platform_pb2.EUW1, api_key)
+  summoner_service = summoner_pb2_grpc.SummonerServiceStub(channel)
+"""
+
+from __future__ import absolute_import
+from __future__ import division
+from __future__ import print_function
+
+import collections
+
+import grpc
+
+from hypebot.protos.riot import platform_pb2
+
+
+class _ClientCallDetails(
+    collections.namedtuple('_ClientCallDetails',
+                           ('method', 'timeout', 'metadata', 'credentials',
+                            'wait_for_ready', 'compression')),
+    grpc.ClientCallDetails):
+  pass
+
+
+def RiotMetadata(platform_id, api_key=None):
+  """Returns the call metadata choosing a platform and API key.
+
+  Args:
+    platform_id: platform_pb2.PlatformId to call, or its name, e.g., "EUW1".
+    api_key: Riot API key to call with. The server's own key is used if None.
+
+  Returns:
+    Tuple of metadata key/value pairs, to pass as an RPC's metadata.
+
+  Raises:
+    ValueError: If platform_id is not a valid PlatformId.
+  """
+  if isinstance(platform_id, str):
+    platform_id = platform_pb2.PlatformId.Value(platform_id.upper())
+  if platform_id == platform_pb2.INVALID_PLATFORM_ID:
+    raise ValueError('platform_id must be a valid platform')
+  metadata = (('platform-id', platform_pb2.PlatformId.Name(platform_id)),)
+  if api_key:
+    metadata += (('api-key', api_key),)
+  return metadata
+
+
+class RiotMetadataInterceptor(grpc.UnaryUnaryClientInterceptor,
+                              grpc.UnaryStreamClientInterceptor):
+  """Adds a platform and API key to the metadata of every call.
+
+  Metadata set by the call itself takes precedence, so individual calls can
+  still choose another platform.
+  """
+
+  def __init__(self, platform_id, api_key=None):
+    """Constructor.
+
+    Args:
+      platform_id: See RiotMetadata.
+      api_key: See RiotMetadata.
+    """
+    self._metadata = RiotMetadata(platform_id, api_key)
+
+  def _AddMetadata(self, client_call_details):
+    metadata = list(client_call_details.metadata or ())
+    call_keys = set(key for key, _ in metadata)
+    metadata.extend(
+        (key, value) for key, value in self._metadata if key not in call_keys)
+    return _ClientCallDetails(
+        client_call_details.method, client_call_details.timeout, metadata,
+        client_call_details.credentials,
+        getattr(client_call_details, 'wait_for_ready', None),
+        getattr(client_call_details, 'compression', None))
+
+  def intercept_unary_unary(self, continuation, client_call_details, request):
+    return continuation(self._AddMetadata(client_call_details), request)
+
+  def intercept_unary_stream(self, continuation, client_call_details, request):
+    return continuation(self._AddMetadata(client_call_details), request)
+
+
+def WithRiotMetadata(channel, platform_id, api_key=None):
+  """Returns channel, sending every call to platform_id with api_key.
+
+  Args:
+    channel: grpc.Channel connected to riot_api_server.
+    platform_id: See RiotMetadata.
+    api_key: See RiotMetadata.
+
+  Returns:
+    The intercepted grpc.Channel, to create service stubs with.
+  """
+  return grpc.intercept_channel(channel,
+                                RiotMetadataInterceptor(platform_id, api_key))
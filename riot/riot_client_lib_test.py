@@ -0,0 +1,106 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Tests for riot_client_lib."""
+
+import unittest
+from unittest import mock
+
+from hypebot.protos.riot import platform_pb2
+from riot import riot_api_lib
+from riot import riot_client_lib
+
+
+def _MakeCallDetails(metadata=None):
+  return mock.Mock(
+      method='/hypebot.riot.v4.SummonerService/GetSummoner',
+      timeout=5,
+      metadata=metadata,
+      credentials=None,
+      wait_for_ready=None,
+      compression=None)
+
+
+class RiotMetadataTest(unittest.TestCase):
+
+  def test_riot_metadata(self):
+    test_cases = [
+        (platform_pb2.EUW1, 'key',
+         (('platform-id', 'EUW1'), ('api-key', 'key'))),
+        ('euw1', 'key', (('platform-id', 'EUW1'), ('api-key', 'key'))),
+        # The server's own key is used.
+        (platform_pb2.KR, None, (('platform-id', 'KR'),)),
+    ]
+    for platform_id, api_key, expected_metadata in test_cases:
+      with self.subTest(platform_id=platform_id, api_key=api_key):
+        self.assertEqual(expected_metadata,
+                         riot_client_lib.RiotMetadata(platform_id, api_key))
+
+  def test_invalid_platform(self):
+    for platform_id in (platform_pb2.INVALID_PLATFORM_ID, 'Narnia'):
+      with self.subTest(platform_id=platform_id):
+        with self.assertRaises(ValueError):
+          riot_client_lib.RiotMetadata(platform_id, 'key')
+
+  def test_metadata_is_read_by_server(self):
+    context = mock.Mock()
+    context.invocation_metadata.return_value = riot_client_lib.RiotMetadata(
+        platform_pb2.EUW1, 'client-key')
+
+    self.assertEqual('euw1', riot_api_lib.GetValidatedPlatformId(context))
+    self.assertEqual('client-key', riot_api_lib.GetCallerApiKey(context))
+
+
+class RiotMetadataInterceptorTest(unittest.TestCase):
+
+  def setUp(self):
+    super(RiotMetadataInterceptorTest, self).setUp()
+    self.interceptor = riot_client_lib.RiotMetadataInterceptor(
+        platform_pb2.EUW1, 'client-key')
+    self.continuation = mock.Mock()
+
+  def test_unary_unary(self):
+    result = self.interceptor.intercept_unary_unary(self.continuation,
+                                                    _MakeCallDetails(),
+                                                    'request')
+
+    self.assertEqual(self.continuation.return_value, result)
+    call_details, request = self.continuation.call_args[0]
+    self.assertEqual('request', request)
+    self.assertEqual([('platform-id', 'EUW1'), ('api-key', 'client-key')],
+                     call_details.metadata)
+    self.assertEqual('/hypebot.riot.v4.SummonerService/GetSummoner',
+                     call_details.method)
+    self.assertEqual(5, call_details.timeout)
+
+  def test_unary_stream(self):
+    self.interceptor.intercept_unary_stream(
+        self.continuation, _MakeCallDetails([('x-trace', 'abc')]), 'request')
+
+    call_details, _ = self.continuation.call_args[0]
+    self.assertEqual([('x-trace', 'abc'), ('platform-id', 'EUW1'),
+                      ('api-key', 'client-key')], call_details.metadata)
+
+  def test_call_metadata_takes_precedence(self):
+    self.interceptor.intercept_unary_unary(
+        self.continuation, _MakeCallDetails([('platform-id', 'KR')]),
+        'request')
+
+    call_details, _ = self.continuation.call_args[0]
+    self.assertEqual([('platform-id', 'KR'), ('api-key', 'client-key')],
+                     call_details.metadata)
+
+
+if __name__ == '__main__':
+  unittest.main()
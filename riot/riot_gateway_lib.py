@@ -0,0 +1,373 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""REST/JSON gateway to the Riot API services, for clients without gRPC.
+
+Each Route translates the path and query parameters of a GET request into the
+RPC's request proto and calls the servicer directly, so REST calls share all of
+the Riot call logic with gRPC calls. Nested fields are set with dotted query
+parameters, e.g., "request.begin_index=100", and repeated fields by repeating
+the parameter. Responses are rendered with riot_api_lib.MarshalResponse.
+
+The Platform-Id, Api-Key and X-Request-Id headers are used like the metadata of
+the same names of gRPC calls. Each call runs through the same interceptors as
+gRPC calls, so it gets a request ID, is logged and has its Riot requests
+attributed to its RPC.
+
+The gateway serves plaintext HTTP without authentication, and calls without an
+Api-Key spend the server's own keys, so it only listens on loopback addresses.
+"""
+
+from __future__ import absolute_import
+from __future__ import division
+from __future__ import print_function
+
+import collections
+import functools
+from http import server
+import ipaddress
+import json
+import re
+import threading
+import time
+from urllib import parse
+
+from absl import logging
+from google.protobuf import descriptor
+from google.protobuf import json_format
+import grpc
+
+from hypebot.protos.riot.v4 import match_pb2
+from hypebot.protos.riot.v4 import summoner_pb2
+from riot import riot_api_lib
+
+# gRPC status codes mapped to HTTP statuses, as grpc-gateway does. Anything not
+# listed here is an internal server error.
+_GRPC_TO_HTTP_STATUS = {
+    grpc.StatusCode.CANCELLED: 499,
+    grpc.StatusCode.INVALID_ARGUMENT: 400,
+    grpc.StatusCode.DEADLINE_EXCEEDED: 504,
+    grpc.StatusCode.NOT_FOUND: 404,
+    grpc.StatusCode.PERMISSION_DENIED: 403,
+    grpc.StatusCode.UNAUTHENTICATED: 401,
+    grpc.StatusCode.RESOURCE_EXHAUSTED: 429,
+    grpc.StatusCode.UNIMPLEMENTED: 501,
+    grpc.StatusCode.UNAVAILABLE: 503,
+}
+
+# HTTP headers passed to the servicers as call metadata.
+_METADATA_HEADERS = ('Platform-Id', 'Api-Key', 'X-Request-Id')
+
+
+class _HandlerCallDetails(
+    collections.namedtuple('_HandlerCallDetails',
+                           ('method', 'invocation_metadata')),
+    grpc.HandlerCallDetails):
+  pass
+
+
+class _GatewayContext(riot_api_lib.BackgroundContext):
+  """Context for a REST call, with metadata taken from its HTTP headers."""
+
+  def __init__(self, headers, deadline_secs=None):
+    """Constructor.
+
+    Args:
+      headers: Mapping of the request's HTTP headers.
+      deadline_secs: Seconds the call may take, like a gRPC deadline. None for
+        no deadline.
+    """
+    self._metadata = tuple((header.lower(), headers[header])
+                           for header in _METADATA_HEADERS
+                           if headers.get(header))
+    self._deadline = None
+    if deadline_secs:
+      self._deadline = time.monotonic() + deadline_secs
+    self._code = None
+    # Initial and trailing metadata, e.g., the request ID and Riot's rate limit
+    # headers, which are returned as response headers.
+    self.response_headers = {}
+
+  def invocation_metadata(self):
+    return self._metadata
+
+  def is_active(self):
+    return self._deadline is None or time.monotonic() < self._deadline
+
+  def time_remaining(self):
+    if self._deadline is None:
+      return None
+    return max(0, self._deadline - time.monotonic())
+
+  def send_initial_metadata(self, metadata):
+    self.response_headers.update(metadata)
+
+  def set_trailing_metadata(self, trailers):
+    self.response_headers.update(trailers)
+
+  def abort(self, code, details):
+    self._code = code
+    super(_GatewayContext, self).abort(code, details)
+
+  def code(self):
+    return self._code
+
+
+class Route(object):
+  """Maps GET requests for a path template to an RPC."""
+
+  def __init__(self, path_template, rpc, request_class, service_name):
+    """Constructor.
+
+    Args:
+      path_template: Path with parameters in braces, e.g.,
+        "/v4/summoners/by-name/{summoner_name}". Each parameter sets the request
+        field of the same name, which may be dotted to set a nested field.
+      rpc: Servicer method to call with the request and a context.
+      request_class: Proto message class of the RPC's request.
+      service_name: Full name of the RPC's service, e.g.,
+        "hypebot.riot.v4.SummonerService".
+    """
+    self.rpc = rpc
+    # The full method name, as interceptors see it for gRPC calls.
+    self.method = '/%s/%s' % (service_name, rpc.__name__)
+    self._request_class = request_class
+    self._param_names = re.findall(r'{([\w.]+)}', path_template)
+    self._regex = re.compile(
+        '^%s$' % re.sub(r'{[\w.]+}', '([^/]+)', path_template))
+
+  def Match(self, path):
+    """Returns the path parameters if path matches the route, else None."""
+    match = self._regex.match(path)
+    if not match:
+      return None
+    return dict(
+        zip(self._param_names, [parse.unquote(v) for v in match.groups()]))
+
+  def ParseRequest(self, path_params, query):
+    """Builds the RPC's request from path_params and a query string.
+
+    Args:
+      path_params: Dict returned by Match.
+      query: The URL's query string.
+
+    Returns:
+      The request proto.
+
+    Raises:
+      json_format.ParseError: If a parameter doesn't match a request field.
+    """
+    fields = {}
+    params = list(parse.parse_qs(query).items())
+    params += [(name, [value]) for name, value in path_params.items()]
+    for name, values in params:
+      _SetField(fields, self._request_class.DESCRIPTOR, name.split('.'), values)
+    return json_format.ParseDict(fields, self._request_class())
+
+
+def _SetField(fields, message_descriptor, path, values):
+  """Sets the field at path in fields, a dict to be parsed by ParseDict."""
+  field = message_descriptor.fields_by_name.get(path[0])
+  if not field:
+    raise json_format.ParseError('%s has no field %s' %
+                                 (message_descriptor.name, path[0]))
+  if len(path) > 1:
+    if not field.message_type:
+      raise json_format.ParseError('%s.%s is not a message' %
+                                   (message_descriptor.name, path[0]))
+    _SetField(
+        fields.setdefault(path[0], {}), field.message_type, path[1:], values)
+  elif field.label == descriptor.FieldDescriptor.LABEL_REPEATED:
+    fields.setdefault(path[0], []).extend(values)
+  else:
+    fields[path[0]] = values[-1]
+
+
+def _ErrorResponse(code, message, headers=None):
+  body = json.dumps({'code': code.value[0], 'message': message})
+  return (_GRPC_TO_HTTP_STATUS.get(code, 500), headers or {},
+          body.encode('utf-8'))
+
+
+def _Intercept(interceptors, handler_call_details, handler):
+  """Returns handler wrapped by interceptors, as a grpc.Server would wrap it."""
+
+  def _Continuation(index, details):
+    if index == len(interceptors):
+      return handler
+    return interceptors[index].intercept_service(
+        functools.partial(_Continuation, index + 1), details)
+
+  return _Continuation(0, handler_call_details)
+
+
+class Gateway(object):
+  """Serves REST requests by calling the RPCs of the first matching Route."""
+
+  def __init__(self, routes, interceptors=(), deadline_secs=None):
+    """Constructor.
+
+    Args:
+      routes: Routes to serve, in the order they're matched.
+      interceptors: grpc.ServerInterceptors to run each call through, outermost
+        first, like a grpc.Server's.
+      deadline_secs: Seconds each call may take. None for no deadline.
+    """
+    self._routes = routes
+    self._interceptors = list(interceptors)
+    self._deadline_secs = deadline_secs
+
+  def Handle(self, path, query, headers):
+    """Serves a GET request.
+
+    Args:
+      path: The URL's path.
+      query: The URL's query string.
+      headers: Mapping of the request's HTTP headers.
+
+    Returns:
+      Tuple of the HTTP status, a dict of response headers, and the JSON body.
+    """
+    for route in self._routes:
+      path_params = route.Match(path)
+      if path_params is not None:
+        break
+    else:
+      return _ErrorResponse(grpc.StatusCode.NOT_FOUND, 'No route for %s' % path)
+
+    context = _GatewayContext(headers, self._deadline_secs)
+
+    def _Call(unused_request, context):
+      # Parsed inside the interceptors, so bad requests are logged too.
+      try:
+        request = route.ParseRequest(path_params, query)
+      except json_format.ParseError as e:
+        context.abort(grpc.StatusCode.INVALID_ARGUMENT, str(e))
+      return route.rpc(request, context)
+
+    handler = _Intercept(
+        self._interceptors,
+        _HandlerCallDetails(route.method, context.invocation_metadata()),
+        grpc.unary_unary_rpc_method_handler(_Call))
+    try:
+      response = handler.unary_unary(None, context)
+    except riot_api_lib.Error as e:
+      return _ErrorResponse(e.code, str(e), context.response_headers)
+    return (200, context.response_headers,
+            riot_api_lib.MarshalResponse(response))
+
+
+def SummonerRoutes(summoner_service):
+  """Returns the Routes for a SummonerService."""
+  request_class = summoner_pb2.GetSummonerRequest
+  service_name = summoner_pb2.DESCRIPTOR.services_by_name[
+      'SummonerService'].full_name
+  return [
+      Route('/v4/summoners/by-account/{encrypted_account_id}',
+            summoner_service.GetSummoner, request_class, service_name),
+      Route('/v4/summoners/by-name/{summoner_name}',
+            summoner_service.GetSummoner, request_class, service_name),
+      Route('/v4/summoners/by-puuid/{encrypted_puuid}',
+            summoner_service.GetSummoner, request_class, service_name),
+      Route('/v4/summoners/{encrypted_summoner_id}',
+            summoner_service.GetSummoner, request_class, service_name),
+  ]
+
+
+def MatchRoutes(match_service):
+  """Returns the Routes for a MatchService."""
+  service_name = match_pb2.DESCRIPTOR.services_by_name['MatchService'].full_name
+  return [
+      Route('/v4/matchlists/by-account/{encrypted_account_id}',
+            match_service.ListMatches, match_pb2.ListMatchesRequest,
+            service_name),
+      Route('/v4/matchlists/by-account/{request.encrypted_account_id}/all',
+            match_service.ListAllMatches, match_pb2.ListAllMatchesRequest,
+            service_name),
+      Route('/v4/matches/by-tournament-code/{tournament_code}/ids',
+            match_service.ListTournamentMatchIds,
+            match_pb2.ListTournamentMatchIdsRequest, service_name),
+      Route('/v4/matches/{game_id}', match_service.GetMatch,
+            match_pb2.GetMatchRequest, service_name),
+      # Matches are requested with game_ids=1&game_ids=2.
+      Route('/v4/matches', match_service.GetMatches,
+            match_pb2.GetMatchesRequest, service_name),
+  ]
+
+
+def _MakeHandler(gateway):
+  """Returns a request handler class serving gateway."""
+
+  class _Handler(server.BaseHTTPRequestHandler):
+
+    def do_GET(self):
+      url = parse.urlparse(self.path)
+      try:
+        status, headers, body = gateway.Handle(url.path, url.query,
+                                               self.headers)
+      except Exception:  # pylint: disable=broad-except
+        logging.exception('REST call to %s failed', url.path)
+        status, headers, body = _ErrorResponse(grpc.StatusCode.INTERNAL,
+                                               'Internal error')
+      self.send_response(status)
+      self.send_header('Content-Type', 'application/json')
+      self.send_header('Content-Length', str(len(body)))
+      for header, value in headers.items():
+        self.send_header(header, value)
+      self.end_headers()
+      self.wfile.write(body)
+
+    def log_message(self, fmt, *args):
+      logging.vlog(1, fmt, *args)
+
+  return _Handler
+
+
+def IsLoopbackAddress(address):
+  """Returns whether address, e.g., "localhost:8080", only accepts local calls.
+
+  Args:
+    address: host:port to listen on.
+  """
+  host = address.rpartition(':')[0]
+  if host == 'localhost':
+    return True
+  try:
+    return ipaddress.ip_address(host).is_loopback
+  except ValueError:
+    return False
+
+
+def StartServer(address, gateway):
+  """Serves gateway on address, e.g., "localhost:8080", in the background.
+
+  Args:
+    address: Loopback address to listen on. Port 0 picks a free port.
+    gateway: The Gateway to serve.
+
+  Returns:
+    The started http.server.ThreadingHTTPServer.
+
+  Raises:
+    ValueError: If address isn't a loopback address.
+  """
+  if not IsLoopbackAddress(address):
+    raise ValueError('The REST gateway has no TLS or authentication, so it '
+                     'only serves loopback addresses, not %s' % address)
+  host, _, port = address.rpartition(':')
+  http_server = server.ThreadingHTTPServer((host, int(port)),
+                                           _MakeHandler(gateway))
+  http_server.daemon_threads = True
+  threading.Thread(target=http_server.serve_forever, daemon=True).start()
+  return http_server
@@ -0,0 +1,195 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Tests for riot_gateway_lib."""
+
+import itertools
+import json
+import unittest
+from unittest import mock
+from urllib import error
+from urllib import parse
+from urllib import request as urllib_request
+
+from hypebot.protos.riot.v4 import constants_pb2
+import prometheus_client
+from riot import riot_api_server
+from riot import riot_gateway_lib
+from riot import riottest
+
+
+class GatewayTest(unittest.TestCase):
+
+  def setUp(self):
+    super(GatewayTest, self).setUp()
+    # requests is faked out for Riot, so the gateway is called with urllib.
+    self.fake_get = riottest.PatchRequestsGet(
+        self, {
+            '/lol/summoner/v4/summoners/by-name/hypebot':
+                riottest.Response({
+                    'id': 'summoner-id',
+                    'name': 'Hype Bot',
+                    'summonerLevel': 30
+                }, headers={'X-App-Rate-Limit': '20:1'}),
+            '/lol/match/v4/matchlists/by-account/account-id':
+                riottest.Response({
+                    'matches': [{
+                        'gameId': 1
+                    }],
+                    'totalGames': 1
+                }),
+            '/lol/match/v4/matches/1':
+                riottest.Response({'gameId': 1}),
+            '/lol/match/v4/matches/2':
+                riottest.Response({'gameId': 2}),
+        })
+    self.gateway = riot_gateway_lib.Gateway(
+        riot_gateway_lib.SummonerRoutes(riot_api_server.SummonerService()) +
+        riot_gateway_lib.MatchRoutes(riot_api_server.MatchService()),
+        interceptors=[
+            riot_api_server.RequestIdInterceptor(),
+            riot_api_server.LoggingInterceptor(),
+            riot_api_server.MetricsInterceptor(),
+        ],
+        deadline_secs=30)
+    http_server = riot_gateway_lib.StartServer('localhost:0', self.gateway)
+    self.addCleanup(http_server.server_close)
+    self.addCleanup(http_server.shutdown)
+    self.base_url = 'http://localhost:%d' % http_server.server_address[1]
+
+  def _Get(self, path, **headers):
+    """Returns the status, headers and decoded JSON body of a GET for path."""
+    headers.update({'Platform-Id': 'EUW1', 'Api-Key': 'rest-key'})
+    request = urllib_request.Request(self.base_url + path, headers=headers)
+    try:
+      with urllib_request.urlopen(request) as response:
+        return response.status, response.headers, json.load(response)
+    except error.HTTPError as e:
+      return e.code, e.headers, json.load(e)
+
+  def test_get_summoner(self):
+    status, headers, body = self._Get('/v4/summoners/by-name/Hype%20Bot')
+
+    self.assertEqual(200, status)
+    self.assertEqual('application/json', headers['Content-Type'])
+    self.assertEqual('20:1', headers['x-app-rate-limit'])
+    self.assertEqual('summoner-id', body['id'])
+    self.assertEqual('Hype Bot', body['name'])
+    # Defaults are included.
+    self.assertEqual('', body['account_id'])
+    url, _, riot_headers = self.fake_get.calls[0]
+    self.assertTrue(url.startswith('https://euw1.api.riotgames.com/'))
+    self.assertEqual('rest-key', riot_headers['X-Riot-Token'])
+
+  def test_list_matches_query_params(self):
+    query = parse.urlencode(
+        [('queues', 'RANKED_SOLO_5x5'), ('queues', 'RANKED_FLEX_SR'),
+         ('begin_index', '100'), ('end_index', '200')])
+
+    status, _, body = self._Get('/v4/matchlists/by-account/account-id?' +
+                                query)
+
+    self.assertEqual(200, status)
+    self.assertEqual('1', body['matches'][0]['game_id'])
+    _, params, _ = self.fake_get.calls[0]
+    self.assertEqual([
+        constants_pb2.QueueType.RANKED_SOLO_5x5,
+        constants_pb2.QueueType.RANKED_FLEX_SR
+    ], params['queue'])
+    self.assertEqual(100, params['beginIndex'])
+    self.assertEqual(200, params['endIndex'])
+
+  def test_get_matches(self):
+    status, _, body = self._Get('/v4/matches?game_ids=1&game_ids=2')
+
+    self.assertEqual(200, status)
+    self.assertEqual(['1', '2'], [m['game_id'] for m in body['matches']])
+
+  def test_riot_error(self):
+    status, _, body = self._Get('/v4/summoners/by-name/Nobody')
+
+    self.assertEqual(404, status)
+    self.assertEqual(5, body['code'])
+
+  def test_unknown_param(self):
+    status, _, body = self._Get('/v4/matches/1?bogus=1')
+
+    self.assertEqual(400, status)
+    self.assertIn('bogus', body['message'])
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_unknown_route(self):
+    status, _, _ = self._Get('/v4/champions')
+
+    self.assertEqual(404, status)
+
+  def test_request_id(self):
+    status, headers, _ = self._Get(
+        '/v4/summoners/by-name/hypebot', **{'X-Request-Id': 'rest-id-1'})
+
+    self.assertEqual(200, status)
+    self.assertEqual('rest-id-1', headers['x-request-id'])
+    _, _, riot_headers = self.fake_get.calls[0]
+    self.assertEqual('rest-id-1', riot_headers['X-Request-Id'])
+
+  def test_attributes_requests_to_method(self):
+    labels = {
+        'service': 'hypebot.riot.v4.SummonerService',
+        'method': 'GetSummoner',
+        'platform': 'euw1',
+        'http_status': '200',
+    }
+    before = prometheus_client.REGISTRY.get_sample_value(
+        'riot_api_requests_total', labels) or 0
+
+    self._Get('/v4/summoners/by-name/hypebot')
+
+    self.assertEqual(
+        before + 1,
+        prometheus_client.REGISTRY.get_sample_value('riot_api_requests_total',
+                                                    labels))
+
+  def test_deadline_exceeded(self):
+    with mock.patch.object(riot_gateway_lib, 'time') as mock_time:
+      # Each reading of the clock is a minute after the last.
+      mock_time.monotonic.side_effect = itertools.count(0, 60)
+      status, _, body = self.gateway.Handle('/v4/summoners/by-name/hypebot',
+                                            '', {
+                                                'Platform-Id': 'EUW1',
+                                                'Api-Key': 'rest-key'
+                                            })
+
+    self.assertEqual(504, status)
+    self.assertEqual(4, json.loads(body)['code'])
+    self.assertEqual([], self.fake_get.calls)
+
+  def test_refuses_non_loopback_address(self):
+    with self.assertRaises(ValueError):
+      riot_gateway_lib.StartServer('0.0.0.0:0', self.gateway)
+
+
+class IsLoopbackAddressTest(unittest.TestCase):
+
+  def test_loopback(self):
+    for address in ('localhost:8080', '127.0.0.1:8080', '127.0.0.2:80'):
+      self.assertTrue(riot_gateway_lib.IsLoopbackAddress(address), address)
+
+  def test_not_loopback(self):
+    for address in ('0.0.0.0:8080', ':8080', '10.0.0.1:8080',
+                    'example.com:8080'):
+      self.assertFalse(riot_gateway_lib.IsLoopbackAddress(address), address)
+
+
+if __name__ == '__main__':
+  unittest.main()
@@ -0,0 +1,107 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Prometheus metrics for requests sent to the Riot API."""
+
+from __future__ import absolute_import
+from __future__ import division
+from __future__ import print_function
+
+from http import server
+import json
+import threading
+from urllib import parse
+
+import prometheus_client
+
+_LABELS = ('service', 'method', 'platform', 'http_status')
+
+_REQUESTS = prometheus_client.Counter(
+    'riot_api_requests_total', 'Requests sent to the Riot API.', _LABELS)
+_LATENCY = prometheus_client.Histogram(
+    'riot_api_request_latency_seconds',
+    'Time taken for the Riot API to respond.', _LABELS)
+
+# gRPC servers handle each call on its own thread, so the method being served
+# is tracked per thread.
+_local = threading.local()
+
+
+def SetRpcMethod(rpc_method):
+  """Attributes requests from this thread to rpc_method.
+
+  Args:
+    rpc_method: Full name of the gRPC method being served, e.g.,
+      "/hypebot.riot.v4.SummonerService/GetSummoner". None clears it.
+  """
+  _local.rpc_method = rpc_method
+
+
+def GetRpcMethod():
+  """Returns the method requests from this thread are attributed to, or None."""
+  return getattr(_local, 'rpc_method', None)
+
+
+def RecordRequest(platform, http_status, latency_secs):
+  """Records a request to the Riot API made by the current thread.
+
+  Args:
+    platform: Platform ID or regional route the request was sent to.
+    http_status: Status code of Riot's response, or "error" if no response was
+      received.
+    latency_secs: How long the request took.
+  """
+  rpc_method = GetRpcMethod() or '/unknown/unknown'
+  service, _, method = rpc_method.lstrip('/').partition('/')
+  labels = (service, method, platform, str(http_status))
+  _REQUESTS.labels(*labels).inc()
+  _LATENCY.labels(*labels).observe(latency_secs)
+
+
+def _MakeHandler(debug_handlers):
+  """Returns a request handler class serving metrics and debug_handlers."""
+
+  class _Handler(prometheus_client.MetricsHandler):
+
+    def do_GET(self):
+      handler = debug_handlers.get(parse.urlparse(self.path).path)
+      if not handler:
+        return super(_Handler, self).do_GET()
+      body = json.dumps(handler(), indent=2, sort_keys=True).encode('utf-8')
+      self.send_response(200)
+      self.send_header('Content-Type', 'application/json')
+      self.send_header('Content-Length', str(len(body)))
+      self.end_headers()
+      self.wfile.write(body)
+
+  return _Handler
+
+
+def StartServer(address, debug_handlers=None):
+  """Serves /metrics on address, e.g., "localhost:9090", in the background.
+
+  Args:
+    address: Address to listen on. Port 0 picks a free port.
+    debug_handlers: Optional dict from path, e.g., "/debug/ratelimits", to a
+      function returning a JSON serializable value to serve at that path.
+
+  Returns:
+    The started http.server.ThreadingHTTPServer.
+  """
+  host, _, port = address.rpartition(':')
+  http_server = server.ThreadingHTTPServer((host, int(port)),
+                                           _MakeHandler(debug_handlers or {}))
+  http_server.daemon_threads = True
+  threading.Thread(target=http_server.serve_forever, daemon=True).start()
+  return http_server
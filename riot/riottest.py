@@ -0,0 +1,318 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Utilities for testing the Riot API services without talking to Riot.
+
+This file will be a dependency of all riot tests, but will not be included in
+the server binary.
+"""
+
+from __future__ import absolute_import
+from __future__ import division
+from __future__ import print_function
+
+import collections
+import io
+import json
+import os
+from unittest import mock
+from urllib import parse
+
+import requests
+from requests import adapters
+from requests import structures
+from requests import utils
+
+from riot import riot_api_lib
+
+
+class AbortError(Exception):
+  """Raised by FakeContext.abort, mirroring grpc's behavior."""
+
+
+class FakeContext(object):
+  """Minimal grpc.ServicerContext for calling servicers directly."""
+
+  def __init__(self, platform_id='NA1', api_key='test-key'):
+    self.metadata = (('platform-id', platform_id), ('api-key', api_key))
+    self.code = None
+    self.details = None
+    self.active = True
+    self._callbacks = []
+
+  def Cancel(self):
+    """Ends the call, as if the client cancelled it."""
+    self.active = False
+    for callback in self._callbacks:
+      callback()
+
+  def invocation_metadata(self):
+    return self.metadata
+
+  def abort(self, code, details):
+    self.code = code
+    self.details = details
+    raise AbortError(details)
+
+  def is_active(self):
+    return self.active
+
+  def time_remaining(self):
+    return None
+
+  def add_callback(self, callback):
+    if not self.active:
+      return False
+    self._callbacks.append(callback)
+    return True
+
+  def set_trailing_metadata(self, unused_metadata):
+    pass
+
+
+def MakeResponse(body, status_code=200, headers=None):
+  """Builds a requests.Response whose content is body encoded as JSON."""
+  response = requests.Response()
+  response.status_code = status_code
+  response._content = json.dumps(body).encode('utf-8')
+  response._content_consumed = True
+  response.headers.update(headers or {})
+  return response
+
+
+# A canned reply. body is anything JSON serializable.
+Response = collections.namedtuple('Response',
+                                  ['body', 'status_code', 'headers'])
+Response.__new__.__defaults__ = (200, None)
+
+
+class FakeRequestsGet(object):
+  """Stand-in for requests.get which serves canned responses by URL path.
+
+  Paths without a canned response get a Riot style 404. Every call is recorded
+  in calls as a (url, params, headers) tuple.
+  """
+
+  def __init__(self, responses):
+    """Constructor.
+
+    Args:
+      responses: Dict from URL path, e.g., "/lol/summoner/v4/summoners/abc", to
+        the Response to return for it.
+    """
+    self.responses = responses
+    self.calls = []
+
+  def __call__(self, url, params=None, headers=None, **unused_kwargs):
+    self.calls.append((url, params, headers))
+    return self._Respond(url)
+
+  def _Respond(self, url):
+    canned = self.responses.get(
+        parse.urlparse(url).path,
+        Response({'status': {
+            'message': 'Data not found',
+            'status_code': 404
+        }}, 404))
+    response = MakeResponse(canned.body, canned.status_code, canned.headers)
+    response.url = url
+    return response
+
+
+class FakeRequestsPost(FakeRequestsGet):
+  """Stand-in for requests.post which serves canned responses by URL path.
+
+  Every call is recorded in calls as a (url, params, headers, body) tuple, with
+  the JSON body decoded.
+  """
+
+  def __call__(self, url, params=None, headers=None, data=None,
+               **unused_kwargs):
+    self.calls.append((url, params, headers, json.loads(data or 'null')))
+    return self._Respond(url)
+
+
+def PatchRequestsGet(test_case, responses):
+  """Replaces requests.get with a FakeRequestsGet for the rest of the test.
+
+  Args:
+    test_case: The unittest.TestCase being run. The patch is undone during its
+      cleanup.
+    responses: See FakeRequestsGet.
+
+  Returns:
+    The FakeRequestsGet, so tests can inspect the calls made.
+  """
+  fake_get = FakeRequestsGet(responses)
+  patcher = mock.patch.object(requests, 'get', fake_get)
+  patcher.start()
+  test_case.addCleanup(patcher.stop)
+  return fake_get
+
+
+def PatchRequestsPost(test_case, responses):
+  """Replaces requests.post with a FakeRequestsPost for the rest of the test.
+
+  Args:
+    test_case: The unittest.TestCase being run. The patch is undone during its
+      cleanup.
+    responses: See FakeRequestsGet.
+
+  Returns:
+    The FakeRequestsPost, so tests can inspect the calls made.
+  """
+  fake_post = FakeRequestsPost(responses)
+  patcher = mock.patch.object(requests, 'post', fake_post)
+  patcher.start()
+  test_case.addCleanup(patcher.stop)
+  return fake_post
+
+
+# Where UseCassette keeps cassettes, by name.
+_CASSETTE_DIR = os.path.join(os.path.dirname(__file__), 'testdata', 'cassettes')
+
+# Placeholder which replaces the API key used to record a cassette.
+_REDACTED = 'REDACTED'
+
+# Response headers which are never recorded.
+_UNRECORDED_HEADERS = frozenset(['set-cookie'])
+
+
+class Cassette(adapters.HTTPAdapter):
+  """Transport adapter which records Riot's responses and replays them.
+
+  If the cassette file doesn't exist, requests are sent to Riot and their
+  responses are recorded, to be written by Save. Otherwise, requests are served
+  from the file without any network access. Requests are matched by method and
+  URL. If a request was recorded several times, its responses are replayed in
+  order.
+
+  The API key is never written: request headers aren't recorded, and the key is
+  replaced wherever it appears in a URL, response header or body.
+  """
+
+  def __init__(self, path, api_key=None):
+    """Constructor.
+
+    Args:
+      path: The cassette's JSON file.
+      api_key: The key requests are sent with when recording, to be redacted.
+    """
+    super(Cassette, self).__init__()
+    self.path = path
+    self.recording = not os.path.exists(path)
+    self._api_key = api_key
+    self._interactions = []
+    if not self.recording:
+      with open(path) as f:
+        self._interactions = json.load(f)['interactions']
+    self._replayed = set()
+
+  def _Redact(self, text):
+    if self._api_key:
+      text = text.replace(self._api_key, _REDACTED)
+    return text
+
+  def _RedactUrl(self, url):
+    parts = parse.urlsplit(url)
+    params = [(name, _REDACTED if name.lower() == 'api_key' else value)
+              for name, value in parse.parse_qsl(
+                  parts.query, keep_blank_values=True)]
+    return self._Redact(
+        parse.urlunsplit(parts._replace(query=parse.urlencode(params))))
+
+  def send(self, request, **kwargs):  # pylint: disable=arguments-differ
+    url = self._RedactUrl(request.url)
+    if self.recording:
+      response = super(Cassette, self).send(request, **kwargs)
+      self._interactions.append({
+          'request': {
+              'method': request.method,
+              'url': url
+          },
+          'response': {
+              'status_code': response.status_code,
+              'headers': {
+                  name: self._Redact(value)
+                  for name, value in response.headers.items()
+                  if name.lower() not in _UNRECORDED_HEADERS
+              },
+              'body': self._Redact(response.content.decode('utf-8')),
+          }
+      })
+      return response
+    for i, interaction in enumerate(self._interactions):
+      if (i not in self._replayed and
+          interaction['request'] == {'method': request.method, 'url': url}):
+        self._replayed.add(i)
+        return self._BuildResponse(request, interaction['response'])
+    raise requests.ConnectionError(
+        'No recorded response for %s %s in %s. Delete the cassette to record '
+        'it again.' % (request.method, url, self.path))
+
+  def _BuildResponse(self, request, recorded):
+    response = requests.Response()
+    response.status_code = recorded['status_code']
+    response.headers = structures.CaseInsensitiveDict(recorded['headers'])
+    response.encoding = utils.get_encoding_from_headers(response.headers)
+    response.raw = io.BytesIO(recorded['body'].encode('utf-8'))
+    response.url = request.url
+    response.request = request
+    return response
+
+  def Save(self):
+    """Writes the recorded interactions to the cassette file."""
+    if not self.recording:
+      return
+    cassette = json.dumps({'interactions': self._interactions},
+                          indent=2,
+                          sort_keys=True,
+                          ensure_ascii=False)
+    if self._api_key and self._api_key in cassette:
+      raise ValueError('Refusing to write the API key to %s' % self.path)
+    os.makedirs(os.path.dirname(self.path), exist_ok=True)
+    with open(self.path, 'w') as f:
+      f.write(cassette + '\n')
+
+
+def UseCassette(test_case, name):
+  """Serves Riot requests from a recorded cassette for the rest of the test.
+
+  The first run records the cassette from the real Riot API, using the key in
+  the RIOT_API_KEY environment variable. Later runs, e.g., in CI, replay it and
+  need no key. Delete the cassette to record it again.
+
+  Args:
+    test_case: The unittest.TestCase being run.
+    name: Name of the cassette in riot/testdata/cassettes, without the .json
+      extension.
+
+  Returns:
+    A FakeContext to make calls with.
+  """
+  path = os.path.join(_CASSETTE_DIR, name + '.json')
+  api_key = None
+  if not os.path.exists(path):
+    api_key = os.environ.get('RIOT_API_KEY')
+    if not api_key:
+      test_case.fail('%s has not been recorded. Set RIOT_API_KEY to record '
+                     'it.' % path)
+  cassette = Cassette(path, api_key)
+  session = requests.Session()
+  session.mount('https://', cassette)
+  session.mount('http://', cassette)
+  riot_api_lib.SetHttpSession(session)
+  test_case.addCleanup(riot_api_lib.SetHttpSession, None)
+  test_case.addCleanup(cassette.Save)
+  return FakeContext(api_key=api_key or _REDACTED)
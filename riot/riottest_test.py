@@ -0,0 +1,123 @@
+# Lint as: python3
+# Copyright 2020 The Hypebot Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Tests for riottest."""
+
+import json
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+import requests
+from requests import adapters
+
+from hypebot.protos.riot.v4 import summoner_pb2
+from riot import riot_api_lib
+from riot import riottest
+
+_API_KEY = 'RGAPI-secret-key'
+
+
+class CassetteTest(unittest.TestCase):
+
+  def setUp(self):
+    super(CassetteTest, self).setUp()
+    tmp_dir = tempfile.TemporaryDirectory()
+    self.addCleanup(tmp_dir.cleanup)
+    self.path = os.path.join(tmp_dir.name, 'cassette.json')
+    self.sent = []
+
+  def _FakeSend(self, request, **unused_kwargs):
+    """Stands in for sending request to Riot."""
+    self.sent.append(request)
+    response = requests.Response()
+    response.status_code = 200
+    response._content = json.dumps({
+        'name': 'Call %d' % len(self.sent),
+        'accountId': 'echoed-%s' % _API_KEY
+    }).encode('utf-8')
+    response._content_consumed = True
+    response.headers.update({
+        'Content-Type': 'application/json;charset=utf-8',
+        'X-App-Rate-Limit': '20:1',
+        'X-Echoed-Key': _API_KEY,
+        'Set-Cookie': 'session=abc',
+    })
+    response.url = request.url
+    return response
+
+  def _CallRiot(self, cassette, context, params=None):
+    session = requests.Session()
+    session.mount('https://', cassette)
+    riot_api_lib.SetHttpSession(session)
+    self.addCleanup(riot_api_lib.SetHttpSession, None)
+    return riot_api_lib.CallRiot(context, 'lol/summoner/v4/summoners/abc',
+                                 params or {}, summoner_pb2.Summoner())
+
+  def _Record(self, calls):
+    cassette = riottest.Cassette(self.path, _API_KEY)
+    self.assertTrue(cassette.recording)
+    with mock.patch.object(adapters.HTTPAdapter, 'send', self._FakeSend):
+      for params in calls:
+        self._CallRiot(cassette, riottest.FakeContext(api_key=_API_KEY),
+                       params)
+    cassette.Save()
+
+  def test_record_never_writes_api_key(self):
+    self._Record([{'api_key': _API_KEY}])
+
+    self.assertEqual(_API_KEY, self.sent[0].headers['X-Riot-Token'])
+    with open(self.path) as f:
+      contents = f.read()
+    self.assertNotIn(_API_KEY, contents)
+    self.assertNotIn('X-Riot-Token', contents)
+    self.assertNotIn('Set-Cookie', contents)
+    interaction = json.loads(contents)['interactions'][0]
+    self.assertEqual(
+        'https://na1.api.riotgames.com/lol/summoner/v4/summoners/abc?'
+        'api_key=REDACTED', interaction['request']['url'])
+    self.assertEqual('20:1',
+                     interaction['response']['headers']['X-App-Rate-Limit'])
+
+  def test_replay(self):
+    self._Record([{}, {}])
+    cassette = riottest.Cassette(self.path)
+    self.assertFalse(cassette.recording)
+    context = riottest.FakeContext(api_key='other-key')
+
+    # Responses to the same request are replayed in order.
+    self.assertEqual('Call 1', self._CallRiot(cassette, context).name)
+    summoner = self._CallRiot(cassette, context)
+
+    self.assertEqual('Call 2', summoner.name)
+    self.assertEqual('echoed-REDACTED', summoner.account_id)
+    self.assertEqual(2, len(self.sent))
+
+  def test_replay_unrecorded_request(self):
+    self._Record([{}])
+    cassette = riottest.Cassette(self.path)
+
+    with self.assertRaisesRegex(riot_api_lib.UnavailableError,
+                                'No recorded response'):
+      self._CallRiot(cassette, riottest.FakeContext(), {'locale': 'ko_KR'})
+
+  def test_use_cassette_requires_key_to_record(self):
+    with mock.patch.dict(os.environ, clear=True):
+      with self.assertRaisesRegex(AssertionError, 'RIOT_API_KEY'):
+        riottest.UseCassette(self, 'never-recorded')
+
+
+if __name__ == '__main__':
+  unittest.main()